@@ -1,49 +1,34 @@
 export const runtime = "nodejs";
 
-const OPENROUTER_BASE =
-  process.env.OPENROUTER_BASE_URL ?? "https://openrouter.ai/api/v1";
-const API_KEY = process.env.OPENROUTER_API_KEY ?? "";
+const API_BASE = process.env.API_BASE ?? "http://localhost:8080";
 
 export async function POST(req: Request) {
-  if (!API_KEY) {
-    return new Response("OPENROUTER_API_KEY not configured", {
-      status: 500,
-    });
-  }
-
   const body = await req.json();
 
-  // Ensure streaming is requested
-  const upstreamBody = {
-    model: body.model ?? "openai/gpt-4o",
-    messages: [{ role: "user", content: body.prompt }],
-    stream: true,
-  };
-
-  const res = await fetch(`${OPENROUTER_BASE}/chat/completions`, {
+  // Streamed generations go through the Go API so they share the dispatcher
+  // queue, rate limiter and metrics with /api/infer.
+  const upstream = await fetch(`${API_BASE}/api/infer/stream`, {
     method: "POST",
-    headers: {
-      Authorization: `Bearer ${API_KEY}`,
-      "Content-Type": "application/json",
-    },
-    body: JSON.stringify(upstreamBody),
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify(body),
   });
 
-  if (!res.ok) {
-    const text = await res.text();
+  if (!upstream.ok) {
+    const text = await upstream.text();
     return new Response(text, {
-      status: res.status,
+      status: upstream.status,
       headers: {
-        "content-type": res.headers.get("content-type") ?? "text/plain",
+        "content-type": upstream.headers.get("content-type") ?? "text/plain",
       },
     });
   }
 
-  // Forward the streaming body to the client, preserving content type
-  return new Response(res.body, {
-    status: res.status,
+  // Forward the SSE body to the client, preserving content type
+  return new Response(upstream.body, {
+    status: upstream.status,
     headers: {
-      "content-type": res.headers.get("content-type") ?? "text/event-stream",
+      "content-type":
+        upstream.headers.get("content-type") ?? "text/event-stream",
     },
   });
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/infra/dburl"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/modelsync"
+)
+
+// Scheduled (EventBridge) variant of cmd/model-sync, configured by env:
+//   MODEL_SYNC_LISTING   listing URL (default OpenRouter /models)
+//   MODEL_SYNC_SOURCE    source name recorded on synced rows (default openrouter)
+//   MODEL_SYNC_INCLUDE   only sync model IDs matching this regexp
+//   MODEL_SYNC_FREE_ONLY "true" to only sync free models
+//   MODEL_SYNC_MODALITY  only sync models with this modality
+//   MODEL_SYNC_DRY_RUN   "true" to log the changes without committing them
+
+var (
+	once    sync.Once
+	initErr error
+
+	pg   *pgxpool.Pool
+	opts modelsync.Options
+)
+
+func initOnce() {
+	ctx := context.Background()
+
+	opts = modelsync.Options{
+		Listing: getenv("MODEL_SYNC_LISTING", modelsync.DefaultOpenRouterURL),
+		Source:  getenv("MODEL_SYNC_SOURCE", "openrouter"),
+		APIKey:  os.Getenv("OPENROUTER_API_KEY"),
+		Filter: modelsync.Filter{
+			FreeOnly: strings.ToLower(os.Getenv("MODEL_SYNC_FREE_ONLY")) == "true",
+			Modality: os.Getenv("MODEL_SYNC_MODALITY"),
+		},
+		DryRun: strings.ToLower(os.Getenv("MODEL_SYNC_DRY_RUN")) == "true",
+	}
+	if s := os.Getenv("MODEL_SYNC_INCLUDE"); s != "" {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			initErr = fmt.Errorf("MODEL_SYNC_INCLUDE: %w", err)
+			return
+		}
+		opts.Filter.Include = re
+	}
+
+	dbURL, err := dburl.Load(ctx)
+	if err != nil {
+		initErr = err
+		return
+	}
+	pg, err = pgxpool.New(ctx, dbURL)
+	if err != nil {
+		initErr = err
+		return
+	}
+}
+
+type scheduledEvent struct{}
+
+func handler(ctx context.Context, _ scheduledEvent) (modelsync.Result, error) {
+	once.Do(initOnce)
+	if initErr != nil {
+		return modelsync.Result{}, initErr
+	}
+
+	res, err := modelsync.Run(ctx, pg, &http.Client{Timeout: 30 * time.Second}, opts)
+	if err != nil {
+		return res, err
+	}
+	log.Printf("model-sync: upserted=%d added=%q deactivated=%q skipped=%q dry_run=%t",
+		res.Upserted, res.Added, res.Deactivated, res.Skipped, opts.DryRun)
+	return res, nil
+}
+
+func main() {
+	lambda.Start(handler)
+}
+
+func getenv(k, def string) string {
+	if v := os.Getenv(k); v != "" {
+		return v
+	}
+	return def
+}
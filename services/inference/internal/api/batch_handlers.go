@@ -0,0 +1,178 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/batch"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+)
+
+// maxBatchBody bounds an uploaded batch (JSON spec or JSONL prompt file).
+const maxBatchBody = 16 << 20
+
+// POST /api/batches
+// Body: a batch.Spec as JSON, or (Content-Type application/x-ndjson or
+// application/jsonl) a prompt file with the rest of the spec in the query:
+// ?models=a,b&concurrency=4&name=suite-1. Returns 202 with the run; poll
+// GET /api/batches/{id} for progress.
+func (h *HTTP) handleCreateBatch(w http.ResponseWriter, r *http.Request) {
+	reqID := newReqID()
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBody)
+
+	spec, err := decodeBatchSpec(r)
+	if err != nil {
+		logf(reqID, `msg="bad batch" err=%q remote=%q`, err.Error(), r.RemoteAddr)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := spec.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, m := range spec.Models {
+		if err := h.checkModelParams(r.Context(), reqID, dispatcher.InferenceRequest{Model: m, Params: spec.Params}); err != nil {
+			writeModelError(w, err)
+			return
+		}
+	}
+
+	spec.OwnerKey, spec.BudgetKey = queueKey(r), budgetKey(r)
+	run, err := h.B.Create(r.Context(), spec)
+	if err != nil {
+		if errors.Is(err, dispatcher.ErrInvalidRequest) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logf(reqID, `msg="batch create failed" err=%q`, err.Error())
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := h.B.Start(r.Context(), run.ID, spec.BudgetKey); err != nil {
+		// The run is stored; the resumer will pick it up.
+		logf(reqID, `msg="batch start failed" run_id=%d err=%q`, run.ID, err.Error())
+	}
+
+	logf(reqID, `msg="batch created" run_id=%d items=%d models=%q`, run.ID, run.Progress.Total, strings.Join(run.Models, ","))
+	w.Header().Set("Location", "/api/batches/"+strconv.FormatInt(run.ID, 10))
+	writeJSON(w, run, http.StatusAccepted)
+}
+
+func decodeBatchSpec(r *http.Request) (batch.Spec, error) {
+	var spec batch.Spec
+	ct := r.Header.Get("Content-Type")
+	if !strings.HasPrefix(ct, "application/x-ndjson") && !strings.HasPrefix(ct, "application/jsonl") {
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			return spec, errors.New("bad json")
+		}
+		return spec, nil
+	}
+
+	prompts, err := batch.ParseJSONL(r.Body)
+	if err != nil {
+		return spec, err
+	}
+	q := r.URL.Query()
+	spec.Prompts = prompts
+	spec.Name = q.Get("name")
+	for _, m := range strings.Split(q.Get("models"), ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			spec.Models = append(spec.Models, m)
+		}
+	}
+	if v := q.Get("concurrency"); v != "" {
+		if spec.Concurrency, err = strconv.Atoi(v); err != nil {
+			return spec, errors.New("bad concurrency")
+		}
+	}
+	return spec, nil
+}
+
+// GET /api/batches/{id}
+// Only the submitter (see budgetKey) sees a run; anyone else gets 404.
+func (h *HTTP) handleGetBatch(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "batch run not found", http.StatusNotFound)
+		return
+	}
+	run, err := h.B.Get(r.Context(), id, budgetKey(r))
+	if err != nil {
+		if errors.Is(err, batch.ErrNotFound) {
+			http.Error(w, "batch run not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, run, http.StatusOK)
+}
+
+// POST /api/batches/{id}/resume[?retry_failed=true]
+// Restarts a pending or orphaned run, optionally retrying failed items.
+// A run still executing elsewhere returns 409.
+func (h *HTTP) handleResumeBatch(w http.ResponseWriter, r *http.Request) {
+	reqID := newReqID()
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "batch run not found", http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Query().Get("retry_failed") == "true" {
+		n, err := h.B.RetryFailed(r.Context(), id, budgetKey(r))
+		if err != nil && !errors.Is(err, batch.ErrFinished) {
+			h.batchError(w, reqID, err)
+			return
+		}
+		logf(reqID, `msg="batch items reset" run_id=%d items=%d`, id, n)
+	}
+
+	if _, err := h.B.Start(r.Context(), id, budgetKey(r)); err != nil {
+		h.batchError(w, reqID, err)
+		return
+	}
+	run, err := h.B.Get(r.Context(), id, budgetKey(r))
+	if err != nil {
+		h.batchError(w, reqID, err)
+		return
+	}
+	writeJSON(w, run, http.StatusAccepted)
+}
+
+// DELETE /api/batches/{id}
+// Cancels a pending or running run; finished runs return 409.
+func (h *HTTP) handleCancelBatch(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "batch run not found", http.StatusNotFound)
+		return
+	}
+	run, err := h.B.Cancel(r.Context(), id, budgetKey(r))
+	switch {
+	case errors.Is(err, batch.ErrFinished):
+		writeJSON(w, run, http.StatusConflict)
+	case err != nil:
+		h.batchError(w, newReqID(), err)
+	default:
+		writeJSON(w, run, http.StatusOK)
+	}
+}
+
+func (h *HTTP) batchError(w http.ResponseWriter, reqID string, err error) {
+	switch {
+	case errors.Is(err, batch.ErrNotFound):
+		http.Error(w, "batch run not found", http.StatusNotFound)
+	case errors.Is(err, batch.ErrBusy), errors.Is(err, batch.ErrFinished):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, batch.ErrClosed):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		logf(reqID, `msg="batch request failed" err=%q`, err.Error())
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
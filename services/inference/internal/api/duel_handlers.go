@@ -0,0 +1,192 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/models"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/obs"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/voting"
+)
+
+type duelReq struct {
+	Title  string                      `json:"title"` // optional; defaults to the start of the prompt
+	Prompt string                      `json:"prompt"`
+	ModelA string                      `json:"modelA"` // both or neither; neither = two random active models
+	ModelB string                      `json:"modelB"`
+	Params dispatcher.GenerationParams `json:"params"`
+}
+
+const duelTitleMax = 80
+
+// handleDuel generates two responses to one prompt, persists them as a new
+// response pair and returns it in the same shape as GET /api/pairs/random.
+func (h *HTTP) handleDuel(w http.ResponseWriter, r *http.Request) {
+	reqID := newReqID()
+
+	var req duelReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	req.Prompt = strings.TrimSpace(req.Prompt)
+	if req.Prompt == "" {
+		http.Error(w, "prompt required", http.StatusBadRequest)
+		return
+	}
+	if (req.ModelA == "") != (req.ModelB == "") {
+		http.Error(w, "set both modelA and modelB, or neither", http.StatusBadRequest)
+		return
+	}
+	if req.ModelA != "" && req.ModelA == req.ModelB {
+		http.Error(w, "modelA and modelB must differ", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.requestTimeout)
+	defer cancel()
+
+	if req.ModelA == "" {
+		if h.Models == nil {
+			http.Error(w, "modelA and modelB required", http.StatusBadRequest)
+			return
+		}
+		ids, err := h.Models.RandomActive(ctx, 2)
+		if err != nil {
+			if errors.Is(err, models.ErrNotFound) {
+				http.Error(w, "not enough active models", http.StatusServiceUnavailable)
+				return
+			}
+			logf(reqID, `msg="pick models failed" err=%q`, err.Error())
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		req.ModelA, req.ModelB = ids[0], ids[1]
+	}
+
+	sides := []dispatcher.InferenceRequest{
+		{Prompt: req.Prompt, Model: req.ModelA, Params: req.Params},
+		{Prompt: req.Prompt, Model: req.ModelB, Params: req.Params},
+	}
+	for _, ir := range sides {
+		if err := ir.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.checkModelParams(ctx, reqID, ir); err != nil {
+			writeModelError(w, err)
+			return
+		}
+	}
+
+	// Enqueue both sides first so they run concurrently on separate workers.
+	replies := make([]chan dispatcher.InferenceResult, len(sides))
+	for i, ir := range sides {
+		replies[i] = make(chan dispatcher.InferenceResult, 1)
+		stats, err := h.S.TryEnqueue(dispatcher.InferenceJob{
+			Req:        ir,
+			Ctx:        ctx,
+			ReplyCh:    replies[i],
+			EnqueuedAt: time.Now(),
+			Key:        queueKey(r),
+			BudgetKey:  budgetKey(r),
+			Priority:   queuePriority(r),
+			RequestID:  reqID,
+		})
+		if err != nil {
+			if writeBudgetError(w, reqID, ir.Model, err) {
+				return
+			}
+			if writeUnavailable(w, reqID, ir.Model, err) {
+				return
+			}
+			code := http.StatusInternalServerError
+			if errors.Is(err, dispatcher.ErrQueueFull) {
+				code = http.StatusTooManyRequests
+			}
+			logf(reqID, `msg="duel enqueue failed" status=%d err=%q model=%q cap=%d len=%d`, code, err.Error(), ir.Model, stats.Cap, stats.Len)
+			incReq(code, "unknown", ir.Model)
+			http.Error(w, "busy; try again", code)
+			return // cancel() stops the side that was already queued
+		}
+	}
+
+	results := make([]dispatcher.InferenceResult, len(sides))
+	for i := range sides {
+		select {
+		case res := <-replies[i]:
+			results[i] = res
+		case <-ctx.Done():
+			results[i] = dispatcher.InferenceResult{Err: ctx.Err()}
+		}
+
+		res, model := results[i], sides[i].Model
+		if res.Err != nil {
+			code := errStatus(res.Err)
+			setRetryAfter(w, res.Err)
+			logf(reqID, `msg="duel generation failed" status=%d err=%q provider=%q model=%q`, code, res.Err.Error(), res.Provider, model)
+			incReq(code, res.Provider, model)
+			http.Error(w, res.Err.Error(), code)
+			return
+		}
+		incReq(http.StatusOK, res.Provider, model)
+		obs.QueueWait.WithLabelValues(res.Provider, model).Observe(res.QueueWait.Seconds())
+		obs.ExecTime.WithLabelValues(res.Provider, model).Observe(res.ExecTime.Seconds())
+		obs.TotalTime.WithLabelValues(res.Provider, model).Observe((res.QueueWait + res.ExecTime).Seconds())
+	}
+
+	// A fallback can leave both sides answered by one model, which is no
+	// comparison; the caller may retry once the primary has recovered.
+	if a, b := answeredModel(results[0], req.ModelA), answeredModel(results[1], req.ModelB); a == b {
+		logf(reqID, `msg="duel sides collapsed" model_a=%q model_b=%q answered=%q`, req.ModelA, req.ModelB, a)
+		http.Error(w, "both sides were answered by "+a+" after a fallback; try again", http.StatusServiceUnavailable)
+		return
+	}
+
+	// The prompt went to the providers as sent; the stored copy is masked.
+	prompt := h.redactText(req.Prompt)
+	title := h.redactText(strings.TrimSpace(req.Title))
+	if title == "" {
+		title = truncateRunes(prompt, duelTitleMax)
+	}
+
+	// Persist with its own deadline: the generations may have used most of ctx.
+	dbCtx, dbCancel := context.WithTimeout(context.WithoutCancel(r.Context()), 3*time.Second)
+	defer dbCancel()
+
+	pair, err := h.V.CreatePair(dbCtx, title, prompt,
+		duelResponse(results[0], req.ModelA),
+		duelResponse(results[1], req.ModelB),
+	)
+	if err != nil {
+		logf(reqID, `msg="duel persist failed" err=%q`, err.Error())
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	logf(reqID, `msg="duel created" pair_id=%d model_a=%q model_b=%q`, pair.PairID, req.ModelA, req.ModelB)
+	writeJSON(w, pair, http.StatusCreated)
+}
+
+func duelResponse(res dispatcher.InferenceResult, requested string) voting.NewResponse {
+	return voting.NewResponse{
+		Provider:     res.Provider,
+		Model:        answeredModel(res, requested),
+		Content:      res.Text,
+		FinishReason: res.Meta.FinishReason,
+		Safety:       res.Meta.Safety,
+	}
+}
+
+func truncateRunes(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
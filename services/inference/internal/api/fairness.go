@@ -0,0 +1,42 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/authmw"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+)
+
+// queueKey identifies the caller for fair queueing. It is the budget
+// identity (see budgetKey): tenant, API key and voter ID headers are not
+// verified by this service, and honouring them would let a client open a
+// fresh lane, and so jump the queue, on every request.
+func queueKey(r *http.Request) string {
+	return budgetKey(r)
+}
+
+// budgetKey identifies the caller for daily budgets: the verified token's
+// subject, else the connecting address. It reads no client-supplied
+// headers (X-Forwarded-For included), which would let a caller start a
+// fresh budget at will. Behind a proxy that does not set
+// RemoteAddr, anonymous callers share the proxy's budget.
+func budgetKey(r *http.Request) string {
+	if u, ok := authmw.FromContext(r.Context()); ok && u.Subject != "" {
+		return "sub:" + u.Issuer + "|" + u.Subject
+	}
+	host, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		host = strings.TrimSpace(r.RemoteAddr)
+	}
+	if host == "" {
+		return ""
+	}
+	return "ip:" + host
+}
+
+// queuePriority reads the optional X-Priority header ("interactive" or "batch").
+func queuePriority(r *http.Request) dispatcher.Priority {
+	return dispatcher.ParsePriority(strings.ToLower(strings.TrimSpace(r.Header.Get("X-Priority"))))
+}
@@ -8,15 +8,21 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/batch"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/budget"
 	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/jobs"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/models"
 	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/obs"
 	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/search"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/usage"
 	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/voting"
 	// "github.com/Tiger-Du/CrowdAudit/services/inference/internal/authmw"
 	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/search_conversations"
@@ -55,6 +61,17 @@ type HTTP struct {
 
 	inferMW   func(http.Handler) http.Handler // optional
 	Community *search_conversations.CommunityService
+	Models    *models.Service // optional; enables per-model param limits
+	Catalog   *models.Catalog // optional; enables /api/models and rejects unknown models
+	J         *jobs.Service   // optional; enables /api/jobs
+	B         *batch.Service  // optional; enables /api/batches
+	U         *usage.Ledger   // optional; enables /api/usage
+
+	// redact masks personal data in duel prompts before they are stored;
+	// jobs and batch runs mask theirs in their own service
+	// (jobs.WithRedactor, batch.WithRedactor). Optional; stored as sent
+	// without it.
+	redact func(dispatcher.InferenceRequest) dispatcher.InferenceRequest
 }
 
 type Option func(*HTTP)
@@ -71,6 +88,32 @@ func WithSearch(svc *search.Service) Option {
 	return func(h *HTTP) { h.Search = svc }
 }
 
+func WithModels(m *models.Service) Option {
+	return func(h *HTTP) { h.Models = m }
+}
+
+func WithCatalog(c *models.Catalog) Option {
+	return func(h *HTTP) { h.Catalog = c }
+}
+
+func WithJobs(j *jobs.Service) Option {
+	return func(h *HTTP) { h.J = j }
+}
+
+func WithBatches(b *batch.Service) Option {
+	return func(h *HTTP) { h.B = b }
+}
+
+func WithUsage(u *usage.Ledger) Option {
+	return func(h *HTTP) { h.U = u }
+}
+
+// WithRedactor sets how duel prompts are masked before they are persisted.
+// Jobs and batch runs are configured on their services.
+func WithRedactor(f func(dispatcher.InferenceRequest) dispatcher.InferenceRequest) Option {
+	return func(h *HTTP) { h.redact = f }
+}
+
 func WithInferMiddleware(mw func(http.Handler) http.Handler) Option {
 	return func(h *HTTP) { h.inferMW = mw }
 }
@@ -86,6 +129,14 @@ func New(s *dispatcher.Server, opts ...Option) *HTTP {
 	return h
 }
 
+// redactText returns s as it may be stored.
+func (h *HTTP) redactText(s string) string {
+	if h.redact == nil {
+		return s
+	}
+	return h.redact(dispatcher.InferenceRequest{Prompt: s}).Prompt
+}
+
 func (h *HTTP) Routes() http.Handler {
 	mux := http.NewServeMux()
 
@@ -124,9 +175,52 @@ func (h *HTTP) Routes() http.Handler {
 			infer = h.inferMW(infer)
 		}
 		mux.Handle("POST /api/infer", infer)
+
+		stream := http.Handler(http.HandlerFunc(h.handleInferStream))
+		if h.inferMW != nil {
+			stream = h.inferMW(stream)
+		}
+		mux.Handle("POST /api/infer/stream", stream)
 	}
 	// mux.Handle("POST /api/infer", auth(http.Handler(infer)))
 
+	if h.S != nil && h.V != nil {
+		duel := http.Handler(http.HandlerFunc(h.handleDuel))
+		if h.inferMW != nil {
+			duel = h.inferMW(duel)
+		}
+		mux.Handle("POST /api/duel", duel)
+	}
+
+	if h.S != nil && h.J != nil {
+		createJob := http.Handler(http.HandlerFunc(h.handleCreateJob))
+		if h.inferMW != nil {
+			createJob = h.inferMW(createJob)
+		}
+		mux.Handle("POST /api/jobs", createJob)
+		mux.HandleFunc("GET /api/jobs/{id}", h.handleGetJob)
+		mux.HandleFunc("DELETE /api/jobs/{id}", h.handleCancelJob)
+	}
+
+	if h.B != nil {
+		createBatch := http.Handler(http.HandlerFunc(h.handleCreateBatch))
+		if h.inferMW != nil {
+			createBatch = h.inferMW(createBatch)
+		}
+		mux.Handle("POST /api/batches", createBatch)
+		mux.HandleFunc("GET /api/batches/{id}", h.handleGetBatch)
+		mux.HandleFunc("POST /api/batches/{id}/resume", h.handleResumeBatch)
+		mux.HandleFunc("DELETE /api/batches/{id}", h.handleCancelBatch)
+	}
+
+	if h.U != nil {
+		mux.HandleFunc("GET /api/usage", h.handleUsage)
+	}
+
+	if h.Catalog != nil {
+		mux.HandleFunc("GET /api/models", h.handleListModels)
+	}
+
 	if h.V != nil {
 		mux.HandleFunc("GET /api/pairs/random", h.handleGetRandomPair)
 		mux.HandleFunc("POST /api/votes", h.handleCreateVote)
@@ -286,9 +380,9 @@ func (h *HTTP) handleInfer(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Optional: basic validation to avoid weird empty prompts
-	if req.Prompt == "" {
-		logf(reqID, `msg="validation error" err="empty prompt"`)
-		http.Error(w, "prompt is required", http.StatusBadRequest)
+	if err := req.Validate(); err != nil {
+		logf(reqID, `msg="validation error" err=%q`, err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -296,18 +390,33 @@ func (h *HTTP) handleInfer(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), h.requestTimeout)
 	defer cancel()
 
+	if err := h.checkModelParams(ctx, reqID, req); err != nil {
+		writeModelError(w, err)
+		return
+	}
+
 	replyCh := make(chan dispatcher.InferenceResult, 1)
 	job := dispatcher.InferenceJob{
 		Req:        req,
 		Ctx:        ctx,
 		ReplyCh:    replyCh,
 		EnqueuedAt: time.Now(),
+		Key:        queueKey(r),
+		BudgetKey:  budgetKey(r),
+		Priority:   queuePriority(r),
+		RequestID:  reqID,
 	}
 
 	// Enqueue with backpressure
 
 	stats, err := h.S.TryEnqueue(job)
 	if err != nil {
+		if writeBudgetError(w, reqID, req.Model, err) {
+			return
+		}
+		if writeUnavailable(w, reqID, req.Model, err) {
+			return
+		}
 		if errors.Is(err, dispatcher.ErrQueueFull) {
 			// QUEUE FULL → 429
 			logf(reqID, `msg="queue full" status=429 model=%q cap=%d len=%d`, req.Model, stats.Cap, stats.Len)
@@ -328,20 +437,11 @@ func (h *HTTP) handleInfer(w http.ResponseWriter, r *http.Request) {
 	// Wait for worker result or cancellation/timeout
 	select {
 	case res := <-replyCh:
-		// PROVIDER ERROR
+		// PROVIDER ERROR (or timeout, cancellation, open circuit, shutdown)
 		if res.Err != nil {
-			code := http.StatusBadGateway
-			if errors.Is(res.Err, context.DeadlineExceeded) {
-				code = http.StatusGatewayTimeout
-				// CONTEXT TIMEOUT
-				logf(reqID, `msg="request timeout" status=%d err=%q model=%q`, code, res.Err.Error(), req.Model)
-			} else if errors.Is(res.Err, context.Canceled) {
-				code = http.StatusGatewayTimeout
-				// CONTEXT CANCELLATION
-				logf(reqID, `msg="request cancelled" status=%d err=%q model=%q`, code, res.Err.Error(), req.Model)
-			} else {
-				logf(reqID, `msg="provider error" status=%d err=%q provider=%q model=%q`, code, res.Err.Error(), res.Provider, req.Model)
-			}
+			code := errStatus(res.Err)
+			setRetryAfter(w, res.Err)
+			logf(reqID, `msg="inference failed" status=%d err=%q provider=%q model=%q`, code, res.Err.Error(), res.Provider, req.Model)
 			incReq(code, res.Provider, req.Model)
 			http.Error(w, res.Err.Error(), code)
 			return
@@ -368,6 +468,19 @@ func (h *HTTP) handleInfer(w http.ResponseWriter, r *http.Request) {
 			"text":        res.Text,
 			"provider":    res.Provider,
 			"token_usage": res.TokenUsage,
+			"usage": map[string]int{
+				"prompt_tokens":     res.Meta.PromptTokens,
+				"completion_tokens": res.Meta.CompletionTokens,
+			},
+			"finish_reason": res.Meta.FinishReason,
+			"safety":        res.Meta.Safety,
+			"guardrails":    res.Meta.Guardrails,
+			// As sent to the provider: catalog limits reject, never clamp, and
+			// unset fields take the provider's defaults.
+			"requested_params": req.Params,
+			"cached":           res.Meta.Cached,
+			"model":            answeredModel(res, req.Model),
+			"attempts":         attemptsDTO(res.Attempts),
 		})
 
 	case <-ctx.Done():
@@ -379,3 +492,163 @@ func (h *HTTP) handleInfer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// checkModelParams rejects models that are not active in the catalog and
+// validates req.Params against the model's eligible_models limits. Without a
+// loaded catalog, models without a catalog row only get the generic checks.
+func (h *HTTP) checkModelParams(ctx context.Context, reqID string, req dispatcher.InferenceRequest) error {
+	var (
+		lim dispatcher.ParamLimits
+		err error
+	)
+	checked := false
+	if h.Catalog != nil {
+		lim, checked, err = h.Catalog.Check(req.Model)
+		if err != nil {
+			logf(reqID, `msg="unknown model" model=%q`, req.Model)
+			return err
+		}
+	}
+	if !checked {
+		if h.Models == nil || req.Model == "" {
+			return nil
+		}
+		lim, err = h.Models.Limits(ctx, req.Model)
+		if err != nil {
+			if !errors.Is(err, models.ErrNotFound) {
+				// Fail open: a catalog outage should not take inference down with it.
+				logf(reqID, `msg="model limits lookup failed" err=%q model=%q`, err.Error(), req.Model)
+			}
+			return nil
+		}
+	}
+	if err := req.Params.Validate(lim); err != nil {
+		logf(reqID, `msg="validation error" err=%q model=%q`, err.Error(), req.Model)
+		return err
+	}
+	return nil
+}
+
+// writeModelError answers a checkModelParams error with 400; unknown models
+// get a JSON body listing the valid ones.
+func writeModelError(w http.ResponseWriter, err error) {
+	var ume *models.UnknownModelError
+	if errors.As(err, &ume) {
+		writeJSON(w, map[string]any{
+			"error":        "unknown_model",
+			"message":      ume.Error(),
+			"model":        ume.Model,
+			"valid_models": ume.Valid,
+		}, http.StatusBadRequest)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+type attemptDTO struct {
+	Model     string `json:"model"`
+	Provider  string `json:"provider"`
+	Error     string `json:"error,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+func attemptsDTO(in []dispatcher.Attempt) []attemptDTO {
+	out := make([]attemptDTO, 0, len(in))
+	for _, a := range in {
+		out = append(out, attemptDTO{Model: a.Model, Provider: a.Provider, Error: a.Error, LatencyMS: a.Latency.Milliseconds()})
+	}
+	return out
+}
+
+// answeredModel is the model that produced res, which is a fallback when
+// the requested model failed.
+func answeredModel(res dispatcher.InferenceResult, requested string) string {
+	if res.Model != "" {
+		return res.Model
+	}
+	return requested
+}
+
+// setRetryAfter sets Retry-After (whole seconds, rounded up) when err carries a
+// retry hint.
+func setRetryAfter(w http.ResponseWriter, err error) {
+	var coe *dispatcher.CircuitOpenError
+	if errors.As(err, &coe) {
+		secs := int(math.Ceil(coe.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(max(secs, 1)))
+	}
+}
+
+// errStatus maps a dispatcher/provider error to the HTTP status we return.
+func errStatus(err error) int {
+	switch {
+	case errors.Is(err, dispatcher.ErrShuttingDown):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, dispatcher.ErrInvalidRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, dispatcher.ErrCircuitOpen):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// writeBudgetError answers a job the budget gate refused and reports whether
+// err was one: 402 when the caller's own daily budget is spent, 429 with
+// Retry-After until the reset when a provider's is.
+func writeBudgetError(w http.ResponseWriter, reqID, model string, err error) bool {
+	var ex *budget.ExceededError
+	switch {
+	case errors.As(err, &ex):
+		code := http.StatusPaymentRequired
+		if ex.Scope == budget.ScopeProvider {
+			code = http.StatusTooManyRequests
+			secs := int(math.Ceil(time.Until(ex.ResetsAt).Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(max(secs, 1)))
+		}
+		logf(reqID, `msg="budget exceeded" status=%d scope=%s subject=%q unit=%s used=%g limit=%g model=%q`,
+			code, ex.Scope, ex.Subject, ex.Unit, ex.Used, ex.Limit, model)
+		incReq(code, "unknown", model)
+		writeJSON(w, map[string]any{
+			"error":     "budget_exceeded",
+			"message":   ex.Error(),
+			"scope":     ex.Scope,
+			"subject":   ex.Subject,
+			"unit":      ex.Unit,
+			"limit":     ex.Limit,
+			"used":      ex.Used,
+			"resets_at": ex.ResetsAt,
+		}, code)
+		return true
+	case errors.Is(err, budget.ErrUnavailable):
+		logf(reqID, `msg="budget check unavailable" status=503 model=%q`, model)
+		incReq(http.StatusServiceUnavailable, "unknown", model)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+	return false
+}
+
+// writeUnavailable answers a job the dispatcher refused with 503 and reports
+// whether err was such a refusal: this instance is draining (retry
+// elsewhere), or the job's deadline falls before its expected completion
+// (Retry-After is the expected queue wait).
+func writeUnavailable(w http.ResponseWriter, reqID, model string, err error) bool {
+	var adm *dispatcher.AdmissionError
+	switch {
+	case errors.Is(err, dispatcher.ErrShuttingDown):
+		logf(reqID, `msg="shutting down" status=503 model=%q`, model)
+		w.Header().Set("Retry-After", "1")
+	case errors.As(err, &adm):
+		logf(reqID, `msg="deadline cannot be met" status=503 model=%q remaining=%s expected=%s queue_wait=%s`, model, adm.Remaining, adm.Expected, adm.QueueWait)
+		secs := int(math.Ceil(adm.QueueWait.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(max(secs, 1)))
+	default:
+		return false
+	}
+	incReq(http.StatusServiceUnavailable, "unknown", model)
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	return true
+}
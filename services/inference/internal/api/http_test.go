@@ -3,13 +3,20 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/batch"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/budget"
 	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/models"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/providers"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/usage"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/voting"
 )
 
 func TestInfer_MethodNotAllowed(t *testing.T) {
@@ -18,7 +25,7 @@ func TestInfer_MethodNotAllowed(t *testing.T) {
 		return "unused", "test", 0, nil
 	}
 	disp := dispatcher.New(10, 1, provider)
-	defer disp.Shutdown()
+	defer disp.Shutdown(context.Background())
 
 	h := New(disp)
 	handler := h.Routes()
@@ -38,7 +45,7 @@ func TestInfer_BadJSON(t *testing.T) {
 		return "unused", "test", 0, nil
 	}
 	disp := dispatcher.New(10, 1, provider)
-	defer disp.Shutdown()
+	defer disp.Shutdown(context.Background())
 
 	h := New(disp)
 	handler := h.Routes()
@@ -60,7 +67,7 @@ func TestInfer_OK(t *testing.T) {
 		return "hi " + req.Prompt, "test", 7, nil
 	}
 	disp := dispatcher.New(10, 1, provider)
-	defer disp.Shutdown()
+	defer disp.Shutdown(context.Background())
 
 	h := New(disp, WithRequestTimeout(2*time.Second))
 	handler := h.Routes()
@@ -91,7 +98,7 @@ func TestInfer_QueueFull_Returns429(t *testing.T) {
 		return "unused", "test", 0, nil
 	}
 	disp := dispatcher.New(1, 0, provider)
-	defer disp.Shutdown()
+	defer disp.Shutdown(context.Background())
 
 	// Pre-fill the queue via public API (TryEnqueue) with a dummy job so it's definitely full.
 	dummyReply := make(chan dispatcher.InferenceResult, 1)
@@ -128,7 +135,7 @@ func TestInfer_Timeout_Returns504(t *testing.T) {
 		}
 	}
 	disp := dispatcher.New(10, 1, provider)
-	defer disp.Shutdown()
+	defer disp.Shutdown(context.Background())
 
 	h := New(disp, WithRequestTimeout(50*time.Millisecond))
 	handler := h.Routes()
@@ -144,3 +151,549 @@ func TestInfer_Timeout_Returns504(t *testing.T) {
 		t.Fatalf("expected 504 got %d body=%s", rr.Code, rr.Body.String())
 	}
 }
+
+func TestInferStream_OK(t *testing.T) {
+	provider := func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		return "unused", "test", 0, nil
+	}
+	streamer := func(ctx context.Context, req dispatcher.InferenceRequest, onDelta func(string) error) (string, int, error) {
+		for _, d := range []string{"hi ", req.Prompt} {
+			if err := onDelta(d); err != nil {
+				return "test", 0, err
+			}
+		}
+		return "test", 3, nil
+	}
+	disp := dispatcher.New(10, 1, provider, dispatcher.WithStreamProvider(streamer))
+	defer disp.Shutdown(context.Background())
+
+	h := New(disp, WithRequestTimeout(2*time.Second))
+	handler := h.Routes()
+
+	body := `{"prompt":"hello","model":"stub"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/infer/stream", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 got %d body=%s", rr.Code, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected text/event-stream got %q", ct)
+	}
+
+	var text strings.Builder
+	var sawDone bool
+	for _, line := range strings.Split(rr.Body.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			sawDone = true
+			continue
+		}
+		var chunk streamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("bad chunk %q: %v", data, err)
+		}
+		for _, c := range chunk.Choices {
+			text.WriteString(c.Delta.Content)
+		}
+	}
+	if text.String() != "hi hello" {
+		t.Fatalf("expected streamed text %q got %q", "hi hello", text.String())
+	}
+	if !sawDone {
+		t.Fatalf("expected [DONE] terminator body=%s", rr.Body.String())
+	}
+}
+
+func TestInferStream_ProviderErrorBeforeFirstToken(t *testing.T) {
+	provider := func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		return "", "test", 0, errors.New("upstream down")
+	}
+	// No stream provider: the dispatcher falls back to the plain provider.
+	disp := dispatcher.New(10, 1, provider)
+	defer disp.Shutdown(context.Background())
+
+	h := New(disp, WithRequestTimeout(2*time.Second))
+	handler := h.Routes()
+
+	body := `{"prompt":"hello","model":"stub"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/infer/stream", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502 got %d body=%s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestInfer_Messages(t *testing.T) {
+	var got dispatcher.InferenceRequest
+	provider := func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		got = req
+		return "ok", "test", 0, nil
+	}
+	disp := dispatcher.New(10, 1, provider)
+	defer disp.Shutdown(context.Background())
+
+	h := New(disp, WithRequestTimeout(2*time.Second))
+	handler := h.Routes()
+
+	body := `{"model":"stub","messages":[
+		{"role":"system","content":"be terse"},
+		{"role":"user","content":"hi"},
+		{"role":"assistant","content":"hello"},
+		{"role":"user","content":"again"}
+	]}`
+	req := httptest.NewRequest(http.MethodPost, "/api/infer", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 got %d body=%s", rr.Code, rr.Body.String())
+	}
+	conv := got.Conversation()
+	if len(conv) != 4 || conv[0].Role != dispatcher.RoleSystem || conv[2].Role != dispatcher.RoleAssistant {
+		t.Fatalf("conversation not passed through in order: %#v", conv)
+	}
+	if got.LastUserContent() != "again" {
+		t.Fatalf("expected last user turn %q got %q", "again", got.LastUserContent())
+	}
+}
+
+func TestInfer_InvalidMessages_Returns400(t *testing.T) {
+	provider := func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		return "unused", "test", 0, nil
+	}
+	disp := dispatcher.New(10, 1, provider)
+	defer disp.Shutdown(context.Background())
+
+	h := New(disp)
+	handler := h.Routes()
+
+	for _, body := range []string{
+		`{"model":"stub"}`,
+		`{"model":"stub","prompt":"hi","messages":[{"role":"user","content":"hi"}]}`,
+		`{"model":"stub","messages":[{"role":"tool","content":"x"}]}`,
+		`{"model":"stub","messages":[{"role":"user","content":"a"},{"role":"system","content":"b"}]}`,
+		`{"model":"stub","messages":[{"role":"system","content":"only system"}]}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/infer", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("body %s: expected 400 got %d body=%s", body, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestInfer_Params(t *testing.T) {
+	var got dispatcher.GenerationParams
+	provider := func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		got = req.Params
+		return "ok", "test", 0, nil
+	}
+	disp := dispatcher.New(10, 1, provider)
+	defer disp.Shutdown(context.Background())
+
+	h := New(disp, WithRequestTimeout(2*time.Second))
+	handler := h.Routes()
+
+	body := `{"prompt":"hello","model":"stub","params":{"temperature":0,"max_tokens":64,"seed":42,"stop":["\n\n"]}}`
+	req := httptest.NewRequest(http.MethodPost, "/api/infer", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 got %d body=%s", rr.Code, rr.Body.String())
+	}
+	if got.Temperature == nil || *got.Temperature != 0 || got.MaxTokens == nil || *got.MaxTokens != 64 {
+		t.Fatalf("params not passed to provider: %#v", got)
+	}
+
+	var out struct {
+		Params dispatcher.GenerationParams `json:"requested_params"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &out); err != nil {
+		t.Fatalf("bad response json: %v body=%s", err, rr.Body.String())
+	}
+	if out.Params.Seed == nil || *out.Params.Seed != 42 || len(out.Params.Stop) != 1 {
+		t.Fatalf("requested params not echoed: %s", rr.Body.String())
+	}
+}
+
+func TestInfer_InvalidParams_Returns400(t *testing.T) {
+	provider := func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		return "unused", "test", 0, nil
+	}
+	disp := dispatcher.New(10, 1, provider)
+	defer disp.Shutdown(context.Background())
+
+	h := New(disp)
+	handler := h.Routes()
+
+	for _, params := range []string{
+		`{"temperature":3}`,
+		`{"max_tokens":0}`,
+		`{"top_p":0}`,
+		`{"seed":5000000000}`,
+		`{"stop":["a","b","c","d","e"]}`,
+	} {
+		body := `{"prompt":"hello","model":"stub","params":` + params + `}`
+		req := httptest.NewRequest(http.MethodPost, "/api/infer", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("params %s: expected 400 got %d body=%s", params, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestDuel_Validation(t *testing.T) {
+	provider := func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		return "unused", "test", 0, nil
+	}
+	disp := dispatcher.New(10, 1, provider)
+	defer disp.Shutdown(context.Background())
+
+	// Validation fails before the voting service touches the database.
+	h := New(disp, WithVoting(voting.NewService(nil)))
+	handler := h.Routes()
+
+	for _, body := range []string{
+		`nope`,
+		`{"prompt":"  ","modelA":"a","modelB":"b"}`,
+		`{"prompt":"hello","modelA":"a"}`,
+		`{"prompt":"hello","modelA":"a","modelB":"a"}`,
+		`{"prompt":"hello"}`, // no model catalog configured to pick from
+		`{"prompt":"hello","modelA":"a","modelB":"b","params":{"temperature":-1}}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/duel", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("body %s: expected 400 got %d body=%s", body, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestDuel_RejectsSidesCollapsedByFallback(t *testing.T) {
+	provider := func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		if req.Model == "a" {
+			return "", "test", 0, &dispatcher.ProviderError{Provider: "test", StatusCode: http.StatusServiceUnavailable, Message: "down"}
+		}
+		return "from " + req.Model, "test", 1, nil
+	}
+	disp := dispatcher.New(10, 2, provider, dispatcher.WithRetryPolicy(dispatcher.RetryPolicy{
+		MaxAttempts: 1,
+		Fallbacks:   map[string][]string{"a": {"b"}},
+	}))
+	defer disp.Shutdown(context.Background())
+
+	// The duel is refused before the voting service touches the database.
+	handler := New(disp, WithVoting(voting.NewService(nil))).Routes()
+	req := httptest.NewRequest(http.MethodPost, "/api/duel", strings.NewReader(`{"prompt":"hello","modelA":"a","modelB":"b"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), "answered by b") {
+		t.Fatalf("expected 503 naming the shared model, got %d body=%s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestInfer_CancelledByShutdown_Returns503(t *testing.T) {
+	started := make(chan struct{})
+	provider := func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		close(started)
+		<-ctx.Done()
+		return "", "test", 0, ctx.Err()
+	}
+	disp := dispatcher.New(10, 1, provider)
+	handler := New(disp).Routes()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/infer", strings.NewReader(`{"prompt":"hi","model":"m"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(rr, req)
+	}()
+
+	<-started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // no drain time: the running call is cancelled
+	_ = disp.Shutdown(ctx)
+	<-done
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d got %d body=%s", http.StatusServiceUnavailable, rr.Code, rr.Body.String())
+	}
+}
+
+func TestInfer_CircuitOpen_Returns503(t *testing.T) {
+	provider := func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		return "", "test", 0, &dispatcher.ProviderError{Provider: "test", StatusCode: http.StatusBadGateway, Message: "down"}
+	}
+	cb := dispatcher.NewCircuitBreaker(dispatcher.BreakerConfig{FailureThreshold: 1, OpenFor: time.Minute})
+	disp := dispatcher.New(10, 1, provider, dispatcher.WithCircuitBreaker(cb))
+	defer disp.Shutdown(context.Background())
+
+	handler := New(disp, WithRequestTimeout(2*time.Second)).Routes()
+
+	codes := make([]int, 2)
+	var rr *httptest.ResponseRecorder
+	for i := range codes {
+		req := httptest.NewRequest(http.MethodPost, "/api/infer", strings.NewReader(`{"prompt":"hello","model":"stub"}`))
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		codes[i] = rr.Code
+	}
+
+	if codes[0] != http.StatusBadGateway || codes[1] != http.StatusServiceUnavailable {
+		t.Fatalf("codes = %v, want [502 503]", codes)
+	}
+	if ra := rr.Header().Get("Retry-After"); ra == "" || ra == "0" {
+		t.Fatalf("Retry-After = %q", ra)
+	}
+}
+
+func TestUsage_BadRange_Returns400(t *testing.T) {
+	h := New(nil, WithUsage(&usage.Ledger{}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/usage?from=2025-02-01&to=2025-01-01", nil)
+	rr := httptest.NewRecorder()
+	h.Routes().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d got %d body=%s", http.StatusBadRequest, rr.Code, rr.Body.String())
+	}
+}
+
+func TestUsage_OtherUsersAreNotSelectable(t *testing.T) {
+	h := New(nil, WithUsage(&usage.Ledger{}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/usage?user=ip:198.51.100.9", nil)
+	rr := httptest.NewRecorder()
+	h.Routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("?user=: expected %d got %d body=%s", http.StatusBadRequest, rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/usage", nil)
+	req.RemoteAddr = ""
+	rr = httptest.NewRecorder()
+	h.Routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("unidentified caller: expected %d got %d body=%s", http.StatusForbidden, rr.Code, rr.Body.String())
+	}
+}
+
+func TestInfer_BudgetExceeded(t *testing.T) {
+	provider := func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		return "unused", "test", 0, nil
+	}
+	resets := time.Now().Add(time.Hour)
+	cases := []struct {
+		scope string
+		code  int
+	}{
+		{budget.ScopeUser, http.StatusPaymentRequired},
+		{budget.ScopeProvider, http.StatusTooManyRequests},
+	}
+	for _, tc := range cases {
+		gate := func(dispatcher.InferenceJob) (func(dispatcher.InferenceResult), error) {
+			return nil, &budget.ExceededError{Scope: tc.scope, Subject: "test", Unit: "tokens", Limit: 100, Used: 90, ResetsAt: resets}
+		}
+		disp := dispatcher.New(10, 1, provider, dispatcher.WithGate(gate))
+		handler := New(disp, WithRequestTimeout(2*time.Second)).Routes()
+
+		req := httptest.NewRequest(http.MethodPost, "/api/infer", strings.NewReader(`{"prompt":"hello","model":"stub"}`))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		disp.Shutdown(context.Background())
+
+		if rr.Code != tc.code {
+			t.Fatalf("%s: expected %d got %d body=%s", tc.scope, tc.code, rr.Code, rr.Body.String())
+		}
+		var body map[string]any
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body["error"] != "budget_exceeded" || body["scope"] != tc.scope || body["limit"] != 100.0 {
+			t.Fatalf("%s: body = %v", tc.scope, body)
+		}
+		if ra := rr.Header().Get("Retry-After"); (tc.scope == budget.ScopeProvider) != (ra != "") {
+			t.Fatalf("%s: Retry-After = %q", tc.scope, ra)
+		}
+	}
+}
+
+func TestInfer_KeysIgnoreClientHeaders(t *testing.T) {
+	provider := func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		return "ok", "test", 1, nil
+	}
+	jobs := make(chan dispatcher.InferenceJob, 3)
+	gate := func(job dispatcher.InferenceJob) (func(dispatcher.InferenceResult), error) {
+		jobs <- job
+		return nil, nil
+	}
+	disp := dispatcher.New(10, 1, provider, dispatcher.WithGate(gate))
+	defer disp.Shutdown(context.Background())
+	handler := New(disp, WithRequestTimeout(2*time.Second)).Routes()
+
+	for _, hdr := range []string{"X-API-Key", "X-Tenant-Id", "X-Voter-Id"} {
+		req := httptest.NewRequest(http.MethodPost, "/api/infer", strings.NewReader(`{"prompt":"hello","model":"stub"}`))
+		req.RemoteAddr = "198.51.100.7:4321"
+		req.Header.Set(hdr, "fresh-"+hdr)
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200 got %d", hdr, rr.Code)
+		}
+		if job := <-jobs; job.BudgetKey != "ip:198.51.100.7" || job.Key != "ip:198.51.100.7" {
+			t.Fatalf("%s: budget key = %q, queue key = %q, want the connecting address", hdr, job.BudgetKey, job.Key)
+		}
+	}
+}
+
+func TestCreateBatch_IsRateLimited(t *testing.T) {
+	limited := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		})
+	}
+	handler := New(nil, WithBatches(batch.NewService(nil, nil, time.Minute)), WithInferMiddleware(limited)).Routes()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/batches", strings.NewReader(`{"models":["stub"],"prompts":[{"prompt":"hi"}]}`))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 from the infer middleware, got %d", rr.Code)
+	}
+}
+
+func TestInfer_UnknownModel_Returns400WithValidModels(t *testing.T) {
+	provider := func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		return "ok", "test", 1, nil
+	}
+	disp := dispatcher.New(10, 1, provider)
+	defer disp.Shutdown(context.Background())
+
+	catalog := models.NewCatalog(nil, 0)
+	catalog.Set([]models.Model{{ID: "stub", Category: "fast"}, {ID: "slow", Category: "reasoning"}})
+	handler := New(disp, WithCatalog(catalog), WithRequestTimeout(2*time.Second)).Routes()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/infer", strings.NewReader(`{"prompt":"hello","model":"retired"}`))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d got %d body=%s", http.StatusBadRequest, rr.Code, rr.Body.String())
+	}
+	var body struct {
+		Error       string   `json:"error"`
+		ValidModels []string `json:"valid_models"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error != "unknown_model" || len(body.ValidModels) != 2 {
+		t.Fatalf("body = %+v", body)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/infer", strings.NewReader(`{"prompt":"hello","model":"stub"}`))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("active model: expected %d got %d body=%s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/models?category=fast", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	var list modelsResp
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Models) != 1 || list.Models[0].ID != "stub" {
+		t.Fatalf("GET /api/models?category=fast = %+v", list.Models)
+	}
+}
+
+func TestInfer_ReplaysRecordedFixtures(t *testing.T) {
+	dir := t.TempDir()
+	infer := func(provider dispatcher.ProviderFunc, body string) *httptest.ResponseRecorder {
+		disp := dispatcher.New(10, 1, provider)
+		defer disp.Shutdown(context.Background())
+		req := httptest.NewRequest(http.MethodPost, "/api/infer", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		New(disp, WithRequestTimeout(2*time.Second)).Routes().ServeHTTP(rr, req)
+		return rr
+	}
+
+	live := func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		dispatcher.MetaFromContext(ctx).FinishReason = "stop"
+		return "recorded " + req.Prompt, "live", 5, nil
+	}
+	recorded := infer(providers.RecordReplay(live, dir, providers.FixtureRecord), `{"prompt":"hello","model":"m"}`)
+	if recorded.Code != http.StatusOK {
+		t.Fatalf("record: expected 200 got %d body=%s", recorded.Code, recorded.Body.String())
+	}
+
+	replay := providers.RecordReplay(nil, dir, providers.FixtureReplay)
+	rr := infer(replay, `{"prompt":"hello","model":"m"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("replay: expected 200 got %d body=%s", rr.Code, rr.Body.String())
+	}
+	var out map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["text"] != "recorded hello" || out["provider"] != "live" || out["finish_reason"] != "stop" {
+		t.Fatalf("replayed body = %s", rr.Body.String())
+	}
+
+	if rr := infer(replay, `{"prompt":"goodbye","model":"m"}`); rr.Code != http.StatusBadGateway || !strings.Contains(rr.Body.String(), "no recorded fixture") {
+		t.Fatalf("miss: expected 502 naming the missing fixture, got %d body=%s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestInfer_ShuttingDown_Returns503(t *testing.T) {
+	provider := func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		return "ok", "test", 1, nil
+	}
+	disp := dispatcher.New(10, 1, provider)
+	if err := disp.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/infer", strings.NewReader(`{"prompt":"hello","model":"stub"}`))
+	rr := httptest.NewRecorder()
+	New(disp, WithRequestTimeout(2*time.Second)).Routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After, got %d body=%s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,207 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/obs"
+)
+
+// Stream events mirror the OpenAI/OpenRouter chunk shape so the web client can
+// keep parsing `choices[0].delta.content` and the trailing `data: [DONE]`.
+type streamDelta struct {
+	Content string `json:"content"`
+}
+
+type streamChoice struct {
+	Delta streamDelta `json:"delta"`
+}
+
+type streamUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type streamError struct {
+	Message string `json:"message"`
+}
+
+type streamChunk struct {
+	Choices  []streamChoice `json:"choices"`
+	Provider string         `json:"provider,omitempty"`
+	Model    string         `json:"model,omitempty"`
+	Usage    *streamUsage   `json:"usage,omitempty"`
+	Error    *streamError   `json:"error,omitempty"`
+
+	Params       *dispatcher.GenerationParams   `json:"requested_params,omitempty"` // see handleInfer
+	FinishReason string                         `json:"finish_reason,omitempty"`
+	Safety       *dispatcher.Safety             `json:"safety,omitempty"`
+	Guardrails   []dispatcher.GuardrailDecision `json:"guardrails,omitempty"`
+}
+
+func writeSSE(w http.ResponseWriter, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", b)
+	return err
+}
+
+func (h *HTTP) handleInferStream(w http.ResponseWriter, r *http.Request) {
+	reqID := newReqID()
+
+	var req dispatcher.InferenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logf(reqID, `msg="bad json" err=%q remote=%q`, err.Error(), r.RemoteAddr)
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		logf(reqID, `msg="validation error" err=%q`, err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.requestTimeout)
+	defer cancel()
+
+	if err := h.checkModelParams(ctx, reqID, req); err != nil {
+		writeModelError(w, err)
+		return
+	}
+
+	deltaCh := make(chan string)
+	replyCh := make(chan dispatcher.InferenceResult, 1)
+	job := dispatcher.InferenceJob{
+		Req:        req,
+		Ctx:        ctx,
+		ReplyCh:    replyCh,
+		EnqueuedAt: time.Now(),
+		Key:        queueKey(r),
+		BudgetKey:  budgetKey(r),
+		Priority:   queuePriority(r),
+		RequestID:  reqID,
+		DeltaCh:    deltaCh,
+	}
+
+	stats, err := h.S.TryEnqueue(job)
+	if err != nil {
+		if writeBudgetError(w, reqID, req.Model, err) {
+			return
+		}
+		if writeUnavailable(w, reqID, req.Model, err) {
+			return
+		}
+		if errors.Is(err, dispatcher.ErrQueueFull) {
+			logf(reqID, `msg="queue full" status=429 model=%q cap=%d len=%d stream=true`, req.Model, stats.Cap, stats.Len)
+			incReq(http.StatusTooManyRequests, "unknown", req.Model)
+			http.Error(w, "busy; try again", http.StatusTooManyRequests)
+			return
+		}
+		logf(reqID, `msg="enqueue failed" err=%q model=%q stream=true`, err.Error(), req.Model)
+		incReq(http.StatusInternalServerError, "unknown", req.Model)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	logf(reqID, `msg="enqueued" model=%q queue_cap=%d queue_len=%d stream=true`, req.Model, stats.Cap, stats.Len)
+
+	// Headers are only committed once there is something to stream, so errors
+	// that happen before the first token still get a proper status code.
+	rc := http.NewResponseController(w)
+	started := false
+	start := func() {
+		started = true
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no") // disable proxy buffering (nginx)
+		w.WriteHeader(http.StatusOK)
+	}
+	fail := func(code int, provider, msg string) {
+		incReq(code, provider, req.Model)
+		if !started {
+			http.Error(w, msg, code)
+			return
+		}
+		_ = writeSSE(w, streamChunk{Choices: []streamChoice{}, Error: &streamError{Message: msg}})
+		_ = rc.Flush()
+	}
+
+	for {
+		select {
+		case d := <-deltaCh:
+			if !started {
+				start()
+			}
+			// A failed write means the client is gone; the worker notices via ctx.
+			if err := writeSSE(w, streamChunk{Choices: []streamChoice{{Delta: streamDelta{Content: d}}}}); err != nil {
+				cancel()
+				continue
+			}
+			_ = rc.Flush()
+
+		case res := <-replyCh:
+			if res.Err != nil {
+				code := errStatus(res.Err)
+				logf(reqID, `msg="stream error" status=%d err=%q provider=%q model=%q started=%t`, code, res.Err.Error(), res.Provider, req.Model, started)
+				if !started {
+					setRetryAfter(w, res.Err)
+				}
+				fail(code, res.Provider, res.Err.Error())
+				return
+			}
+
+			total := res.QueueWait + res.ExecTime
+			logf(reqID,
+				`msg="ok" status=200 provider=%q model=%q queue_wait_ms=%d exec_ms=%d total_ms=%d token_usage=%d stream=true`,
+				res.Provider,
+				req.Model,
+				res.QueueWait.Milliseconds(),
+				res.ExecTime.Milliseconds(),
+				total.Milliseconds(),
+				res.TokenUsage,
+			)
+			incReq(http.StatusOK, res.Provider, req.Model)
+			obs.QueueWait.WithLabelValues(res.Provider, req.Model).Observe(res.QueueWait.Seconds())
+			if !res.FirstTokenAt.IsZero() {
+				obs.StreamTTFT.WithLabelValues(res.Provider, req.Model).Observe(res.FirstTokenAt.Sub(job.EnqueuedAt).Seconds())
+			}
+			obs.StreamTotalTime.WithLabelValues(res.Provider, req.Model).Observe(total.Seconds())
+
+			if !started {
+				start()
+			}
+			_ = writeSSE(w, streamChunk{
+				Choices:  []streamChoice{},
+				Provider: res.Provider,
+				Model:    req.Model,
+				Usage: &streamUsage{
+					PromptTokens:     res.Meta.PromptTokens,
+					CompletionTokens: res.Meta.CompletionTokens,
+					TotalTokens:      res.TokenUsage,
+				},
+				Params:       &req.Params,
+				FinishReason: res.Meta.FinishReason,
+				Safety:       res.Meta.Safety,
+				Guardrails:   res.Meta.Guardrails,
+			})
+			_, _ = fmt.Fprint(w, "data: [DONE]\n\n")
+			_ = rc.Flush()
+			return
+
+		case <-ctx.Done():
+			code := http.StatusGatewayTimeout
+			logf(reqID, `msg="ctx done before result" status=%d err=%q model=%q stream=true`, code, ctx.Err().Error(), req.Model)
+			fail(code, "unknown", "request cancelled/timeout")
+			return
+		}
+	}
+}
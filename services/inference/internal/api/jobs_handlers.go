@@ -0,0 +1,88 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/jobs"
+)
+
+// POST /api/jobs
+// Body: same as /api/infer. Returns 202 with the queued job; poll
+// GET /api/jobs/{id} for the result.
+func (h *HTTP) handleCreateJob(w http.ResponseWriter, r *http.Request) {
+	reqID := newReqID()
+
+	var req dispatcher.InferenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logf(reqID, `msg="bad json" err=%q remote=%q`, err.Error(), r.RemoteAddr)
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		logf(reqID, `msg="validation error" err=%q`, err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.checkModelParams(r.Context(), reqID, req); err != nil {
+		writeModelError(w, err)
+		return
+	}
+
+	job, stats, err := h.J.Submit(r.Context(), req, queueKey(r), budgetKey(r), queuePriority(r))
+	if err != nil {
+		if writeBudgetError(w, reqID, req.Model, err) {
+			return
+		}
+		if writeUnavailable(w, reqID, req.Model, err) {
+			return
+		}
+		if errors.Is(err, dispatcher.ErrQueueFull) {
+			logf(reqID, `msg="queue full" status=429 model=%q cap=%d len=%d job=true`, req.Model, stats.Cap, stats.Len)
+			incReq(http.StatusTooManyRequests, "unknown", req.Model)
+			http.Error(w, "busy; try again", http.StatusTooManyRequests)
+			return
+		}
+		logf(reqID, `msg="job submit failed" err=%q model=%q`, err.Error(), req.Model)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	logf(reqID, `msg="job enqueued" job_id=%s model=%q queue_cap=%d queue_len=%d`, job.ID, req.Model, stats.Cap, stats.Len)
+	w.Header().Set("Location", "/api/jobs/"+job.ID)
+	writeJSON(w, job, http.StatusAccepted)
+}
+
+// GET /api/jobs/{id}
+// Only the submitter (see budgetKey) sees a job; anyone else gets 404.
+func (h *HTTP) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	job, err := h.J.Get(r.Context(), r.PathValue("id"), budgetKey(r))
+	if err != nil {
+		if errors.Is(err, jobs.ErrNotFound) {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, job, http.StatusOK)
+}
+
+// DELETE /api/jobs/{id}
+// Cancels a queued or running job; finished jobs return 409.
+func (h *HTTP) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	job, err := h.J.Cancel(r.Context(), r.PathValue("id"), budgetKey(r))
+	switch {
+	case errors.Is(err, jobs.ErrNotFound):
+		http.Error(w, "job not found", http.StatusNotFound)
+	case errors.Is(err, jobs.ErrFinished):
+		writeJSON(w, job, http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, job, http.StatusOK)
+	}
+}
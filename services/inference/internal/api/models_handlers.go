@@ -0,0 +1,17 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/models"
+)
+
+type modelsResp struct {
+	Models []models.Model `json:"models"`
+}
+
+// GET /api/models?category=fast
+// Lists the active models /api/infer accepts, optionally in one category.
+func (h *HTTP) handleListModels(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, modelsResp{Models: h.Catalog.List(r.URL.Query().Get("category"))}, http.StatusOK)
+}
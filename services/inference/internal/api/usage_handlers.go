@@ -0,0 +1,87 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/usage"
+)
+
+const usageDefaultWindow = 30 * 24 * time.Hour
+
+type usageResp struct {
+	From    time.Time   `json:"from"`
+	To      time.Time   `json:"to"`
+	GroupBy []string    `json:"group_by"`
+	Rows    []usage.Row `json:"rows"`
+}
+
+// GET /api/usage?group_by=day,model&from=2025-01-01&to=2025-02-01&model=...
+// Aggregates the caller's own usage (see budgetKey) over [from, to); dates
+// are UTC days or RFC 3339 timestamps. Defaults: group_by=day, the last 30
+// days. Usage across callers is only read from usage_ledger directly.
+func (h *HTTP) handleUsage(w http.ResponseWriter, r *http.Request) {
+	reqID := newReqID()
+	qs := r.URL.Query()
+
+	if qs.Has("user") {
+		http.Error(w, "user is not selectable; usage is reported for the caller", http.StatusBadRequest)
+		return
+	}
+	caller := budgetKey(r)
+	if caller == "" {
+		http.Error(w, "caller not identified", http.StatusForbidden)
+		return
+	}
+
+	q := usage.Query{UserKey: usage.UserKey(caller), Model: qs.Get("model")}
+	for _, g := range strings.Split(qs.Get("group_by"), ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			q.GroupBy = append(q.GroupBy, g)
+		}
+	}
+	if len(q.GroupBy) == 0 {
+		q.GroupBy = []string{"day"}
+	}
+
+	var err error
+	if q.To, err = parseUsageTime(qs.Get("to"), time.Now().UTC()); err != nil {
+		http.Error(w, "bad to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.From, err = parseUsageTime(qs.Get("from"), q.To.Add(-usageDefaultWindow)); err != nil {
+		http.Error(w, "bad from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !q.From.Before(q.To) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := h.U.Summary(r.Context(), q)
+	if err != nil {
+		if errors.Is(err, usage.ErrBadQuery) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logf(reqID, `msg="usage query failed" err=%q`, err.Error())
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if rows == nil {
+		rows = []usage.Row{}
+	}
+	writeJSON(w, usageResp{From: q.From, To: q.To, GroupBy: q.GroupBy, Rows: rows}, http.StatusOK)
+}
+
+func parseUsageTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,15 +18,22 @@ import (
 	"github.com/segmentio/kafka-go"
 
 	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/api"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/batch"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/budget"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/cache"
 	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/guardrails"
 	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/infra/dburl"
 	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/infra/redisx"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/jobs"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/models"
 	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/obs"
 	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/outbox"
 	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/providers"
 	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/ratelimit"
 	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/search"
 	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/search_conversations"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/usage"
 	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/voting"
 )
 
@@ -51,6 +59,67 @@ type Config struct {
 	OSInsecure    bool
 	QueueSize     int
 	WorkerCount   int
+
+	// Fair queueing: QUEUE_MAX_PER_KEY caps one client's queued jobs (0 = no cap).
+	QueueMaxPerKey int
+
+	// MODEL_CONCURRENCY caps in-flight calls per model or provider prefix
+	// ("model=2,gemini/=8"); it overrides eligible_models.max_concurrency.
+	ModelConcurrency dispatcher.ConcurrencyLimits
+
+	// Optional response cache (the redis-cache instance); off when REDIS_CACHE_URL is empty.
+	ResponseCacheURL string
+	ResponseCacheTTL time.Duration
+
+	// COALESCE_REQUESTS=false gives every identical in-flight request its own provider call.
+	Coalesce bool
+
+	// ADMISSION_CONTROL=false queues jobs even when recent execution times say
+	// they will miss their deadline.
+	AdmissionControl bool
+
+	// JOB_TIMEOUT bounds an /api/jobs request, queue wait included.
+	JobTimeout time.Duration
+
+	// MODEL_CATALOG_REFRESH is how often the active models are re-read.
+	ModelCatalogRefresh time.Duration
+
+	// ENABLE_BUDGETS=false stops enforcing the daily limits in the budgets
+	// table (needs Redis).
+	EnableBudgets bool
+
+	// BATCH_ITEM_TIMEOUT bounds one generation of a batch run, queue wait included.
+	BatchItemTimeout time.Duration
+
+	// LongRunning is set by cmd/inference-api, whose process outlives each
+	// request. Async jobs (/api/jobs) and batch runs (/api/batches) execute
+	// in the background and are only served then; the Lambdas leave it
+	// false, so those routes are not registered there.
+	LongRunning bool
+
+	// Provider routing: DEFAULT_PROVIDER serves models no PROVIDER_ROUTES prefix matches.
+	DefaultProvider string
+	ProviderRoutes  map[string]string
+
+	// PROVIDER_FIXTURES serves provider calls from recorded fixtures instead
+	// of the network; PROVIDER_FIXTURE_MODE=record (default replay) calls the
+	// providers and writes the fixtures.
+	ProviderFixtures    string
+	ProviderFixtureMode providers.FixtureMode
+
+	// Retries of transient provider failures; FALLBACK_MODELS is "model=fb1|fb2,...".
+	Retry dispatcher.RetryPolicy
+
+	// Per provider+model circuit breaker; BREAKER_FAILURE_THRESHOLD=0 disables it.
+	Breaker dispatcher.BreakerConfig
+
+	// WORKERS_MAX above WORKERS_MIN (default WorkerCount) lets the pool grow
+	// under load and shrink back when idle; see LoadAutoscaleConfig.
+	Autoscale dispatcher.AutoscaleConfig
+
+	// GUARDRAILS picks the request checks run before every provider call
+	// ("none" disables them); see LoadGuardrailConfig.
+	Guardrails guardrails.Config
 }
 
 func LoadConfigFromEnv() (Config, error) {
@@ -63,6 +132,63 @@ func LoadConfigFromEnv() (Config, error) {
 		dbURL = ""
 	}
 
+	routes, err := providers.ParseRoutes(getenv("PROVIDER_ROUTES", "stub/=stub"))
+	if err != nil {
+		return Config{}, err
+	}
+
+	retry, err := LoadRetryPolicy()
+	if err != nil {
+		return Config{}, err
+	}
+
+	breaker, err := LoadBreakerConfig()
+	if err != nil {
+		return Config{}, err
+	}
+
+	autoscale, err := LoadAutoscaleConfig()
+	if err != nil {
+		return Config{}, err
+	}
+
+	guards, err := LoadGuardrailConfig()
+	if err != nil {
+		return Config{}, err
+	}
+
+	maxPerKey, err := strconv.Atoi(getenv("QUEUE_MAX_PER_KEY", "50"))
+	if err != nil || maxPerKey < 0 {
+		return Config{}, fmt.Errorf("QUEUE_MAX_PER_KEY must be a non-negative integer")
+	}
+
+	concurrency, err := dispatcher.ParseConcurrencyLimits(os.Getenv("MODEL_CONCURRENCY"))
+	if err != nil {
+		return Config{}, err
+	}
+
+	cacheTTL, err := time.ParseDuration(getenv("RESPONSE_CACHE_TTL", "24h"))
+	if err != nil {
+		return Config{}, fmt.Errorf("RESPONSE_CACHE_TTL: %w", err)
+	}
+
+	jobTimeout, err := time.ParseDuration(getenv("JOB_TIMEOUT", "10m"))
+	if err != nil {
+		return Config{}, fmt.Errorf("JOB_TIMEOUT: %w", err)
+	}
+	catalogRefresh, err := time.ParseDuration(getenv("MODEL_CATALOG_REFRESH", "1m"))
+	if err != nil {
+		return Config{}, fmt.Errorf("MODEL_CATALOG_REFRESH: %w", err)
+	}
+	batchItemTimeout, err := time.ParseDuration(getenv("BATCH_ITEM_TIMEOUT", "5m"))
+	if err != nil {
+		return Config{}, fmt.Errorf("BATCH_ITEM_TIMEOUT: %w", err)
+	}
+	fixtureMode, err := providers.ParseFixtureMode(getenv("PROVIDER_FIXTURE_MODE", "replay"))
+	if err != nil {
+		return Config{}, fmt.Errorf("PROVIDER_FIXTURE_MODE: %w", err)
+	}
+
 	cfg := Config{
 		EnableInfer:   os.Getenv("ENABLE_INFER") != "false",
 		EnableDB:      os.Getenv("ENABLE_DB") != "false",
@@ -78,6 +204,26 @@ func LoadConfigFromEnv() (Config, error) {
 		OSInsecure:    strings.ToLower(os.Getenv("OS_INSECURE")) == "true",
 		QueueSize:     200,
 		WorkerCount:   32,
+
+		QueueMaxPerKey:      maxPerKey,
+		ModelConcurrency:    concurrency,
+		ResponseCacheURL:    os.Getenv("REDIS_CACHE_URL"),
+		ResponseCacheTTL:    cacheTTL,
+		Coalesce:            os.Getenv("COALESCE_REQUESTS") != "false",
+		AdmissionControl:    os.Getenv("ADMISSION_CONTROL") != "false",
+		JobTimeout:          jobTimeout,
+		ModelCatalogRefresh: catalogRefresh,
+		EnableBudgets:       os.Getenv("ENABLE_BUDGETS") != "false",
+		BatchItemTimeout:    batchItemTimeout,
+
+		DefaultProvider:     getenv("DEFAULT_PROVIDER", "openrouter"),
+		ProviderRoutes:      routes,
+		ProviderFixtures:    os.Getenv("PROVIDER_FIXTURES"),
+		ProviderFixtureMode: fixtureMode,
+		Retry:               retry,
+		Breaker:             breaker,
+		Autoscale:           autoscale,
+		Guardrails:          guards,
 	}
 
 	if cfg.EnableDB && cfg.DatabaseURL == "" {
@@ -133,6 +279,17 @@ func Build(ctx context.Context, cfg Config) (*Built, error) {
 		}
 	}
 
+	// --- Response cache (separate Redis) ---
+	// Optional: an unreachable cache only costs the savings, so start without it.
+	var cacheRdb *redis.Client
+	if cfg.ResponseCacheURL != "" {
+		cacheRdb, err = redisx.NewClientFromURL(cfg.ResponseCacheURL)
+		if err != nil {
+			log.Printf("response cache disabled: %v", err)
+			cacheRdb = nil
+		}
+	}
+
 	// --- Outbox publisher (Kafka) ---
 	// In Lambda: do NOT run background loops. Disable via env for Lambda.
 	// Keeping support here for non-Lambda modes.
@@ -182,6 +339,9 @@ func Build(ctx context.Context, cfg Config) (*Built, error) {
 			if rdb != nil {
 				_ = rdb.Close()
 			}
+			if cacheRdb != nil {
+				_ = cacheRdb.Close()
+			}
 			if dbpool != nil {
 				dbpool.Close()
 			}
@@ -195,12 +355,112 @@ func Build(ctx context.Context, cfg Config) (*Built, error) {
 		community = &search_conversations.CommunityService{DB: dbpool}
 	}
 
+	// --- Model catalog ---
+	// Active models are cached in memory and re-read while the sandbox is
+	// warm; /api/infer rejects anything else.
+	var (
+		modelSvc      *models.Service
+		catalog       *models.Catalog
+		catalogCancel context.CancelFunc
+	)
+	if dbpool != nil {
+		modelSvc = models.NewService(dbpool)
+		catalog = models.NewCatalog(modelSvc.Active, cfg.ModelCatalogRefresh)
+		if err := catalog.Refresh(ctx); err != nil {
+			log.Printf("model catalog: %v (accepting any model until a refresh succeeds)", err)
+		}
+		catalogCtx, cancel := context.WithCancel(ctx)
+		catalogCancel = cancel
+		go func() { _ = catalog.Run(catalogCtx) }()
+	}
+
+	// --- Usage ledger ---
+	// Entries are flushed every second; a sandbox frozen between invocations
+	// holds them until it thaws, and loses them if it is reclaimed first.
+	var ledger *usage.Ledger
+	if dbpool != nil && cfg.EnableInfer {
+		ledger = usage.NewLedger(dbpool, modelSvc.Prices)
+	}
+
 	// --- Provider + dispatcher ---
-	var dispatchSvc *dispatcher.Server
+	var (
+		dispatchSvc  *dispatcher.Server
+		budgetCancel context.CancelFunc
+		guard        *guardrails.Pipeline
+	)
 	if cfg.EnableInfer {
-		httpClient := providers.DefaultHTTPClient()
-		provider := providers.OpenRouterProvider(httpClient) // needs key
-		dispatchSvc = dispatcher.New(cfg.QueueSize, cfg.WorkerCount, provider)
+		// Models are routed by prefix (PROVIDER_ROUTES, e.g. "gemini/=gemini,stub/=stub");
+		// everything else goes to DEFAULT_PROVIDER (OpenRouter unless overridden).
+		reg, err := providers.NewRegistryFromConfig(ctx, providers.RegistryConfig{
+			Default:     cfg.DefaultProvider, // openrouter needs OPENROUTER_API_KEY
+			Routes:      cfg.ProviderRoutes,
+			StubDelay:   800 * time.Millisecond,
+			Fixtures:    cfg.ProviderFixtures,
+			FixtureMode: cfg.ProviderFixtureMode,
+		})
+		if err != nil {
+			if publisherCancel != nil {
+				publisherCancel()
+			}
+			if catalogCancel != nil {
+				catalogCancel()
+			}
+			if writer != nil {
+				_ = writer.Close()
+			}
+			if rdb != nil {
+				_ = rdb.Close()
+			}
+			if cacheRdb != nil {
+				_ = cacheRdb.Close()
+			}
+			if ledger != nil {
+				ledger.Close()
+			}
+			if dbpool != nil {
+				dbpool.Close()
+			}
+			return nil, err
+		}
+		gc := cfg.Guardrails
+		if catalog != nil {
+			gc.ContextWindow = catalog.ContextWindow
+		}
+		guard = guardrails.Build(gc)
+		dispatchOpts := []dispatcher.Option{
+			dispatcher.WithStreamProvider(reg.Stream),
+			dispatcher.WithRetryPolicy(cfg.Retry),
+			dispatcher.WithCircuitBreaker(dispatcher.NewCircuitBreaker(cfg.Breaker)),
+			dispatcher.WithAutoscale(cfg.Autoscale),
+			dispatcher.WithQueueConfig(dispatcher.QueueConfig{MaxPerKey: cfg.QueueMaxPerKey}),
+			dispatcher.WithConcurrencyLimits(cfg.ModelConcurrency),
+			// Guardrails run ahead of the cache so redacted prompts are what gets cached;
+			// jobs, duels and batches store prompts through guard.Redact for the same reason.
+			dispatcher.WithMiddleware(guard.Middleware),
+			dispatcher.WithStreamMiddleware(guard.Stream),
+		}
+		if cacheRdb != nil {
+			dispatchOpts = append(dispatchOpts, dispatcher.WithMiddleware(cache.New(cacheRdb, cfg.ResponseCacheTTL).Middleware))
+		}
+		if cfg.Coalesce {
+			dispatchOpts = append(dispatchOpts, dispatcher.WithCoalescing())
+		}
+		if cfg.AdmissionControl {
+			dispatchOpts = append(dispatchOpts, dispatcher.WithAdmissionControl())
+		}
+		if ledger != nil {
+			dispatchOpts = append(dispatchOpts, dispatcher.WithResultHook(ledger.Record))
+		}
+		// Daily budgets; limits are re-read from the budgets table every 30s
+		// while the sandbox is warm.
+		if cfg.EnableBudgets && rdb != nil && dbpool != nil {
+			enf := budget.New(rdb, budget.DBLimits(dbpool), reg.BackendName, ledger.Prices)
+			budgetCtx, cancel := context.WithCancel(ctx)
+			budgetCancel = cancel
+			go func() { _ = enf.Run(budgetCtx) }()
+			dispatchOpts = append(dispatchOpts, dispatcher.WithGate(enf.Gate))
+		}
+		dispatchSvc = dispatcher.New(cfg.QueueSize, cfg.WorkerCount, reg.Call, dispatchOpts...)
 	}
 
 	// --- Voting ---
@@ -209,6 +469,45 @@ func Build(ctx context.Context, cfg Config) (*Built, error) {
 		voteSvc = voting.NewService(dbpool)
 	}
 
+	// --- Per-model concurrency ---
+	if modelSvc != nil && dispatchSvc != nil {
+		if limits, err := modelSvc.ConcurrencyLimits(ctx); err != nil {
+			log.Printf("model concurrency limits: %v (using MODEL_CONCURRENCY only)", err)
+		} else {
+			dispatchSvc.SetConcurrencyLimits(limits.Merge(cfg.ModelConcurrency))
+		}
+	}
+
+	// --- Async jobs ---
+	// Jobs run on this process's workers after the request that submitted
+	// them returns. A Lambda sandbox is frozen between invocations, so its
+	// jobs would stall until swept as lost; like batch runs, /api/jobs is
+	// only served by a long-running process (cmd/inference-api).
+	var (
+		jobSvc     *jobs.Service
+		jobsCancel context.CancelFunc
+	)
+	if cfg.LongRunning && dbpool != nil && dispatchSvc != nil {
+		jobSvc = jobs.NewService(dbpool, dispatchSvc, cfg.JobTimeout, jobs.WithRedactor(guard.Redact))
+		jobsCtx, cancel := context.WithCancel(ctx)
+		jobsCancel = cancel
+		go func() { _ = jobSvc.Run(jobsCtx) }()
+	}
+
+	// --- Batch runs ---
+	// The resumer picks up runs left pending or orphaned by a crashed
+	// instance.
+	var (
+		batchSvc    *batch.Service
+		batchCancel context.CancelFunc
+	)
+	if cfg.LongRunning && dbpool != nil && dispatchSvc != nil {
+		batchSvc = batch.NewService(dbpool, dispatchSvc, cfg.BatchItemTimeout, batch.WithRedactor(guard.Redact))
+		batchCtx, cancel := context.WithCancel(ctx)
+		batchCancel = cancel
+		go func() { _ = batchSvc.RunResumer(batchCtx) }()
+	}
+
 	// --- HTTP API ---
 	opts := []api.Option{}
 	if searchSvc != nil {
@@ -217,6 +516,21 @@ func Build(ctx context.Context, cfg Config) (*Built, error) {
 	if voteSvc != nil {
 		opts = append(opts, api.WithVoting(voteSvc))
 	}
+	if modelSvc != nil {
+		opts = append(opts, api.WithModels(modelSvc), api.WithCatalog(catalog))
+	}
+	if jobSvc != nil {
+		opts = append(opts, api.WithJobs(jobSvc))
+	}
+	if batchSvc != nil {
+		opts = append(opts, api.WithBatches(batchSvc))
+	}
+	if ledger != nil {
+		opts = append(opts, api.WithUsage(ledger))
+	}
+	if guard != nil {
+		opts = append(opts, api.WithRedactor(guard.Redact))
+	}
 	if rdb != nil {
 		lim := ratelimit.NewRedisFixedWindowLimiter(
 			rdb,
@@ -239,15 +553,41 @@ func Build(ctx context.Context, cfg Config) (*Built, error) {
 		if publisherCancel != nil {
 			publisherCancel()
 		}
+		if budgetCancel != nil {
+			budgetCancel()
+		}
+		if jobsCancel != nil {
+			jobsCancel()
+		}
+		if batchCancel != nil {
+			batchCancel()
+		}
+		if catalogCancel != nil {
+			catalogCancel()
+		}
 		if writer != nil {
 			if err := writer.Close(); err != nil {
 				log.Printf("kafka writer close error: %v", err)
 			}
 		}
-		dispatchSvc.Shutdown()
+		if batchSvc != nil {
+			batchSvc.Close() // hands unfinished runs back for the next instance
+		}
+		// Jobs still running at the deadline are cancelled; queued ones get a 503.
+		if dispatchSvc != nil { // nil when ENABLE_INFER=false
+			if err := dispatchSvc.Shutdown(shutdownCtx); err != nil {
+				log.Printf("dispatcher shutdown: %v", err)
+			}
+		}
+		if ledger != nil {
+			ledger.Close() // after the workers, so their last results are recorded
+		}
 		if rdb != nil {
 			_ = rdb.Close()
 		}
+		if cacheRdb != nil {
+			_ = cacheRdb.Close()
+		}
 		if dbpool != nil {
 			dbpool.Close()
 		}
@@ -262,3 +602,108 @@ func getenv(k, def string) string {
 	}
 	return def
 }
+
+// The loaders below read the dispatcher settings shared by every entry point
+// (the Lambdas via LoadConfigFromEnv, and cmd/inference-api).
+
+// LoadRetryPolicy reads RETRY_MAX_ATTEMPTS, RETRY_BASE_DELAY,
+// RETRY_MAX_DELAY and FALLBACK_MODELS.
+func LoadRetryPolicy() (dispatcher.RetryPolicy, error) {
+	p := dispatcher.RetryPolicy{MaxAttempts: 3, BaseDelay: 200 * time.Millisecond, MaxDelay: 2 * time.Second}
+	if v := os.Getenv("RETRY_MAX_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return p, fmt.Errorf("RETRY_MAX_ATTEMPTS must be a positive integer")
+		}
+		p.MaxAttempts = n
+	}
+	for env, d := range map[string]*time.Duration{"RETRY_BASE_DELAY": &p.BaseDelay, "RETRY_MAX_DELAY": &p.MaxDelay} {
+		if v := os.Getenv(env); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil {
+				return p, fmt.Errorf("%s: %w", env, err)
+			}
+			*d = parsed
+		}
+	}
+	fallbacks, err := dispatcher.ParseFallbacks(os.Getenv("FALLBACK_MODELS"))
+	if err != nil {
+		return p, err
+	}
+	p.Fallbacks = fallbacks
+	return p, nil
+}
+
+// LoadBreakerConfig reads the BREAKER_* settings.
+func LoadBreakerConfig() (dispatcher.BreakerConfig, error) {
+	c := dispatcher.BreakerConfig{FailureThreshold: 5, OpenFor: 30 * time.Second, HalfOpenProbes: 1}
+	for env, n := range map[string]*int{"BREAKER_FAILURE_THRESHOLD": &c.FailureThreshold, "BREAKER_HALF_OPEN_PROBES": &c.HalfOpenProbes} {
+		if v := os.Getenv(env); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed < 0 {
+				return c, fmt.Errorf("%s must be a non-negative integer", env)
+			}
+			*n = parsed
+		}
+	}
+	if v := os.Getenv("BREAKER_OPEN_FOR"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return c, fmt.Errorf("BREAKER_OPEN_FOR: %w", err)
+		}
+		c.OpenFor = d
+	}
+	return c, nil
+}
+
+// LoadAutoscaleConfig reads WORKERS_MIN/WORKERS_MAX and the AUTOSCALE_*
+// thresholds; WORKERS_MAX unset keeps the fixed pool.
+func LoadAutoscaleConfig() (dispatcher.AutoscaleConfig, error) {
+	var c dispatcher.AutoscaleConfig
+	for env, n := range map[string]*int{"WORKERS_MIN": &c.MinWorkers, "WORKERS_MAX": &c.MaxWorkers, "AUTOSCALE_QUEUE_DEPTH": &c.QueueDepth} {
+		if v := os.Getenv(env); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed < 0 {
+				return c, fmt.Errorf("%s must be a non-negative integer", env)
+			}
+			*n = parsed
+		}
+	}
+	for env, d := range map[string]*time.Duration{"AUTOSCALE_QUEUE_WAIT_P95": &c.QueueWaitP95, "AUTOSCALE_IDLE_AFTER": &c.IdleAfter} {
+		if v := os.Getenv(env); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil {
+				return c, fmt.Errorf("%s: %w", env, err)
+			}
+			*d = parsed
+		}
+	}
+	return c, nil
+}
+
+// LoadGuardrailConfig reads GUARDRAILS and the GUARDRAIL_* settings.
+func LoadGuardrailConfig() (guardrails.Config, error) {
+	var c guardrails.Config
+	enabled, err := guardrails.ParseNames(getenv("GUARDRAILS", strings.Join(guardrails.Names, ",")))
+	if err != nil {
+		return c, fmt.Errorf("GUARDRAILS: %w", err)
+	}
+	c.Enabled = enabled
+	for _, t := range strings.Split(os.Getenv("GUARDRAIL_BLOCKLIST"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			c.Blocklist = append(c.Blocklist, t)
+		}
+	}
+	switch action := getenv("GUARDRAIL_PII_ACTION", "redact"); action {
+	case "redact":
+	case "reject":
+		c.RejectPII = true
+	default:
+		return c, fmt.Errorf("GUARDRAIL_PII_ACTION must be redact or reject, got %q", action)
+	}
+	c.InjectionRejectAt, err = strconv.Atoi(getenv("GUARDRAIL_INJECTION_REJECT_AT", "2"))
+	if err != nil || c.InjectionRejectAt < 0 {
+		return c, fmt.Errorf("GUARDRAIL_INJECTION_REJECT_AT must be a non-negative integer")
+	}
+	return c, nil
+}
@@ -0,0 +1,61 @@
+package batch
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Prompt is one line of a prompt file:
+//
+//	{"title": "Refusal check 1", "prompt": "How do I pick a lock?"}
+//
+// Title is optional and defaults to the start of the prompt.
+type Prompt struct {
+	Title  string `json:"title,omitempty"`
+	Prompt string `json:"prompt"`
+}
+
+// maxLine bounds a single JSONL line.
+const maxLine = 1 << 20
+
+// ParseJSONL reads prompts, one JSON object per line. Blank lines are skipped.
+func ParseJSONL(r io.Reader) ([]Prompt, error) {
+	var out []Prompt
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), maxLine)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var p Prompt
+		if err := json.Unmarshal([]byte(line), &p); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		p.Prompt = strings.TrimSpace(p.Prompt)
+		if p.Prompt == "" {
+			return nil, fmt.Errorf("line %d: prompt required", n)
+		}
+		out = append(out, p)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+const titleMax = 80
+
+func (p Prompt) title() string {
+	if t := strings.TrimSpace(p.Title); t != "" {
+		return t
+	}
+	r := []rune(p.Prompt)
+	if len(r) <= titleMax {
+		return p.Prompt
+	}
+	return string(r[:titleMax-1]) + "…"
+}
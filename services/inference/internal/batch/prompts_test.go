@@ -0,0 +1,68 @@
+package batch
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+)
+
+func TestParseJSONL(t *testing.T) {
+	in := `{"title": "t1", "prompt": "first"}
+
+{"prompt": "  second  "}
+`
+	got, err := ParseJSONL(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Title != "t1" || got[0].Prompt != "first" || got[1].Prompt != "second" {
+		t.Fatalf("got %+v", got)
+	}
+	if got[1].title() != "second" {
+		t.Fatalf("default title = %q", got[1].title())
+	}
+}
+
+func TestParseJSONL_Errors(t *testing.T) {
+	for _, in := range []string{
+		`{"prompt": "ok"}` + "\n" + `{"prompt": ""}`,
+		`{"prompt": "ok"}` + "\n" + `not json`,
+	} {
+		_, err := ParseJSONL(strings.NewReader(in))
+		if err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+			t.Fatalf("ParseJSONL(%q) err = %v, want line 2 error", in, err)
+		}
+	}
+}
+
+func TestPromptTitle_Truncates(t *testing.T) {
+	p := Prompt{Prompt: strings.Repeat("é", 200)}
+	if n := len([]rune(p.title())); n != titleMax {
+		t.Fatalf("title has %d runes, want %d", n, titleMax)
+	}
+}
+
+func TestSpecValidate(t *testing.T) {
+	spec := Spec{Models: []string{"m"}, Prompts: []Prompt{{Prompt: "p"}}}
+	if err := spec.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if spec.Concurrency != DefaultConcurrency {
+		t.Fatalf("concurrency = %d, want default %d", spec.Concurrency, DefaultConcurrency)
+	}
+
+	bad := []Spec{
+		{Prompts: []Prompt{{Prompt: "p"}}},
+		{Models: []string{"m"}},
+		{Models: []string{""}, PromptIDs: []int64{1}},
+		{Models: []string{"m"}, PromptIDs: []int64{1}, Concurrency: MaxConcurrency + 1},
+		{Models: []string{"a", "b"}, PromptIDs: make([]int64, MaxItems/2+1)},
+	}
+	for i, sp := range bad {
+		if err := sp.Validate(); !errors.Is(err, dispatcher.ErrInvalidRequest) {
+			t.Errorf("case %d: err = %v, want ErrInvalidRequest", i, err)
+		}
+	}
+}
@@ -0,0 +1,712 @@
+package batch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/obs"
+)
+
+var (
+	ErrNotFound = errors.New("batch run not found")
+	ErrFinished = errors.New("batch run already finished")
+	ErrBusy     = errors.New("batch run is being executed by another process")
+	ErrClosed   = errors.New("batch service closed")
+)
+
+// AnyOwner is the owner for callers with database access (cmd/batch-runner
+// and the resumer): it matches every run. Get, Start, Cancel and RetryFailed
+// otherwise only find runs whose budget_key is owner.
+const AnyOwner = "*"
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusRunning   Status = "running"
+	StatusCompleted Status = "completed"
+	StatusCancelled Status = "cancelled"
+)
+
+// Limits on a single run.
+const (
+	DefaultConcurrency = 4
+	MaxConcurrency     = 64
+	MaxItems           = 10000 // prompts x models
+)
+
+const (
+	// heartbeatEvery is how often the executing process refreshes
+	// batch_runs.heartbeat_at; a run whose heartbeat is older than staleAfter
+	// is assumed orphaned by a crash and may be claimed again.
+	heartbeatEvery = 15 * time.Second
+	staleAfter     = 4 * heartbeatEvery
+
+	enqueueBackoffMin = 250 * time.Millisecond
+	enqueueBackoffMax = 5 * time.Second
+)
+
+// Spec describes a new run: every prompt is generated once by every model.
+// Prompts are stored as new rows in prompts; PromptIDs reuse stored ones
+// (for example the prompts of an earlier run).
+type Spec struct {
+	Name        string                      `json:"name"`
+	Models      []string                    `json:"models"`
+	Prompts     []Prompt                    `json:"prompts"`
+	PromptIDs   []int64                     `json:"prompt_ids"`
+	Params      dispatcher.GenerationParams `json:"params"`
+	Concurrency int                         `json:"concurrency"` // in-flight generations; 0 = DefaultConcurrency
+
+	// The submitter's dispatcher.InferenceJob Key and BudgetKey, set by the
+	// server rather than the client; every item is queued and budgeted as
+	// that caller, and only BudgetKey (or AnyOwner) finds the run again.
+	// Empty for operator runs.
+	OwnerKey  string `json:"-"`
+	BudgetKey string `json:"-"`
+}
+
+// Validate checks spec and fills in defaults. Errors wrap
+// dispatcher.ErrInvalidRequest.
+func (sp *Spec) Validate() error {
+	if len(sp.Models) == 0 {
+		return fmt.Errorf("%w: at least one model is required", dispatcher.ErrInvalidRequest)
+	}
+	n := len(sp.Prompts) + len(sp.PromptIDs)
+	if n == 0 {
+		return fmt.Errorf("%w: prompts or prompt_ids is required", dispatcher.ErrInvalidRequest)
+	}
+	if n*len(sp.Models) > MaxItems {
+		return fmt.Errorf("%w: %d prompts x %d models exceeds %d generations", dispatcher.ErrInvalidRequest, n, len(sp.Models), MaxItems)
+	}
+	for i, p := range sp.Prompts {
+		if p.Prompt == "" {
+			return fmt.Errorf("%w: prompts[%d]: prompt required", dispatcher.ErrInvalidRequest, i)
+		}
+	}
+	for _, m := range sp.Models {
+		if m == "" {
+			return fmt.Errorf("%w: empty model", dispatcher.ErrInvalidRequest)
+		}
+		req := dispatcher.InferenceRequest{Prompt: "-", Model: m, Params: sp.Params}
+		if err := req.Validate(); err != nil {
+			return fmt.Errorf("%w: %v", dispatcher.ErrInvalidRequest, err)
+		}
+	}
+	if sp.Concurrency == 0 {
+		sp.Concurrency = DefaultConcurrency
+	}
+	if sp.Concurrency < 0 || sp.Concurrency > MaxConcurrency {
+		return fmt.Errorf("%w: concurrency must be between 1 and %d", dispatcher.ErrInvalidRequest, MaxConcurrency)
+	}
+	return nil
+}
+
+// Progress counts a run's items by status.
+type Progress struct {
+	Total     int `json:"total"`
+	Pending   int `json:"pending"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+}
+
+// Run is a batch run and its progress.
+type Run struct {
+	ID          int64                       `json:"id"`
+	Name        string                      `json:"name"`
+	Status      Status                      `json:"status"`
+	Models      []string                    `json:"models"`
+	Params      dispatcher.GenerationParams `json:"params"`
+	Concurrency int                         `json:"concurrency"`
+	Progress    Progress                    `json:"progress"`
+	CreatedAt   time.Time                   `json:"created_at"`
+	StartedAt   *time.Time                  `json:"started_at,omitempty"`
+	FinishedAt  *time.Time                  `json:"finished_at,omitempty"`
+
+	ownerKey, budgetKey string // see Spec
+}
+
+type item struct {
+	id       int64
+	promptID int64
+	body     string
+	model    string
+}
+
+// Service runs batches through the dispatcher at PriorityBatch, keeping all
+// state in Postgres: each generation is written to responses in the same
+// transaction that marks its item done, so a run interrupted at any point
+// resumes without losing or duplicating outputs.
+type Service struct {
+	db          *pgxpool.Pool
+	disp        *dispatcher.Server
+	itemTimeout time.Duration // per generation, queue wait included
+
+	// redact masks personal data in new prompts before they are stored.
+	// Items are generated from the stored prompt, so providers see the
+	// masked text too. Optional.
+	redact func(dispatcher.InferenceRequest) dispatcher.InferenceRequest
+
+	mu      sync.Mutex
+	closed  bool
+	running map[int64]context.CancelFunc // runs executing in this process
+	wg      sync.WaitGroup
+}
+
+type Option func(*Service)
+
+// WithRedactor masks personal data in prompts before they are stored.
+func WithRedactor(f func(dispatcher.InferenceRequest) dispatcher.InferenceRequest) Option {
+	return func(s *Service) { s.redact = f }
+}
+
+func NewService(db *pgxpool.Pool, disp *dispatcher.Server, itemTimeout time.Duration, opts ...Option) *Service {
+	s := &Service{db: db, disp: disp, itemTimeout: itemTimeout, running: map[int64]context.CancelFunc{}}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// redacted returns p as it may be stored.
+func (s *Service) redacted(p Prompt) Prompt {
+	if s.redact == nil {
+		return p
+	}
+	p.Prompt = s.redact(dispatcher.InferenceRequest{Prompt: p.Prompt}).Prompt
+	p.Title = s.redact(dispatcher.InferenceRequest{Prompt: p.Title}).Prompt
+	return p
+}
+
+// Create stores a pending run for spec. Call Start or Execute to run it.
+func (s *Service) Create(ctx context.Context, spec Spec) (Run, error) {
+	if err := spec.Validate(); err != nil {
+		return Run{}, err
+	}
+	params, err := json.Marshal(spec.Params)
+	if err != nil {
+		return Run{}, err
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return Run{}, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var id int64
+	if err := tx.QueryRow(ctx, `
+insert into batch_runs (name, models, params, concurrency, owner_key, budget_key)
+values ($1, $2, $3, $4, nullif($5, ''), nullif($6, ''))
+returning id
+`, spec.Name, spec.Models, params, spec.Concurrency, spec.OwnerKey, spec.BudgetKey).Scan(&id); err != nil {
+		return Run{}, err
+	}
+
+	promptIDs := append([]int64(nil), spec.PromptIDs...)
+	if len(promptIDs) > 0 {
+		var found int
+		if err := tx.QueryRow(ctx, `select count(*) from prompts where id = any($1)`, promptIDs).Scan(&found); err != nil {
+			return Run{}, err
+		}
+		if found != len(uniq(promptIDs)) {
+			return Run{}, fmt.Errorf("%w: unknown prompt_ids", dispatcher.ErrInvalidRequest)
+		}
+	}
+	if len(spec.Prompts) > 0 {
+		titles := make([]string, len(spec.Prompts))
+		bodies := make([]string, len(spec.Prompts))
+		for i, p := range spec.Prompts {
+			p = s.redacted(p)
+			titles[i], bodies[i] = p.title(), p.Prompt
+		}
+		rows, err := tx.Query(ctx, `
+insert into prompts (title, body)
+select * from unnest($1::text[], $2::text[])
+returning id
+`, titles, bodies)
+		if err != nil {
+			return Run{}, err
+		}
+		ids, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+		if err != nil {
+			return Run{}, err
+		}
+		promptIDs = append(promptIDs, ids...)
+	}
+
+	if _, err := tx.Exec(ctx, `
+insert into batch_items (run_id, prompt_id, model)
+select $1, p, m
+from unnest($2::bigint[]) p cross join unnest($3::text[]) m
+on conflict do nothing
+`, id, promptIDs, spec.Models); err != nil {
+		return Run{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return Run{}, err
+	}
+	return s.Get(ctx, id, AnyOwner)
+}
+
+// Start claims owner's run id and executes it in the background. It returns
+// ErrBusy if another live process holds the run.
+func (s *Service) Start(ctx context.Context, id int64, owner string) (Run, error) {
+	run, err := s.claim(ctx, id, owner)
+	if err != nil {
+		return Run{}, err
+	}
+	go func() {
+		if err := s.execute(context.Background(), run); err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf(`msg="batch run failed" run_id=%d err=%q`, id, err.Error())
+		}
+	}()
+	return run, nil
+}
+
+// Execute claims run id and runs its pending items, returning when the run
+// completes or ctx ends. An interrupted run is left pending for a later
+// Execute, Start or RunResumer.
+func (s *Service) Execute(ctx context.Context, id int64) error {
+	run, err := s.claim(ctx, id, AnyOwner)
+	if err != nil {
+		return err
+	}
+	return s.execute(ctx, run)
+}
+
+// RunResumer restarts runs that are pending or whose executor stopped
+// heartbeating, now and every staleAfter, until ctx ends.
+func (s *Service) RunResumer(ctx context.Context) error {
+	t := time.NewTicker(staleAfter)
+	defer t.Stop()
+	for {
+		if err := s.resumeOnce(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("batch resume error: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+func (s *Service) resumeOnce(ctx context.Context) error {
+	rows, err := s.db.Query(ctx, `
+select id from batch_runs
+where status = 'pending'
+   or (status = 'running' and heartbeat_at < now() - make_interval(secs => $1))
+order by id
+`, staleAfter.Seconds())
+	if err != nil {
+		return err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		// Another instance may claim it first; that is fine.
+		if _, err := s.Start(ctx, id, AnyOwner); err == nil {
+			log.Printf(`msg="batch run resumed" run_id=%d`, id)
+		} else if !errors.Is(err, ErrBusy) && !errors.Is(err, ErrFinished) {
+			return err
+		}
+	}
+	return nil
+}
+
+// claim marks owner's run id as running in this process.
+func (s *Service) claim(ctx context.Context, id int64, owner string) (Run, error) {
+	var params []byte
+	run := Run{ID: id, Status: StatusRunning}
+	err := s.db.QueryRow(ctx, `
+update batch_runs
+set status = 'running', started_at = coalesce(started_at, now()), heartbeat_at = now()
+where id = $1 and ($3::text = '*' or budget_key = $3)
+  and (status = 'pending'
+       or (status = 'running' and heartbeat_at < now() - make_interval(secs => $2)))
+returning name, models, params, concurrency, coalesce(owner_key, ''), coalesce(budget_key, '')
+`, id, staleAfter.Seconds(), owner).Scan(&run.Name, &run.Models, &params, &run.Concurrency, &run.ownerKey, &run.budgetKey)
+	if errors.Is(err, pgx.ErrNoRows) {
+		cur, err := s.Get(ctx, id, owner)
+		if err != nil {
+			return Run{}, err
+		}
+		if cur.Status == StatusRunning {
+			return Run{}, ErrBusy
+		}
+		return Run{}, ErrFinished
+	}
+	if err != nil {
+		return Run{}, err
+	}
+	if err := json.Unmarshal(params, &run.Params); err != nil {
+		return Run{}, err
+	}
+	return run, nil
+}
+
+func (s *Service) execute(ctx context.Context, run Run) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		s.release(run.ID)
+		return ErrClosed
+	}
+	s.running[run.ID] = cancel
+	s.wg.Add(1)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.running, run.ID)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+
+	go s.heartbeat(ctx, cancel, run.ID)
+
+	items, err := s.pending(ctx, run.ID)
+	if err != nil {
+		s.release(run.ID)
+		return err
+	}
+	log.Printf(`msg="batch run started" run_id=%d pending=%d concurrency=%d`, run.ID, len(items), run.Concurrency)
+
+	sem := make(chan struct{}, run.Concurrency)
+	var wg sync.WaitGroup
+loop:
+	for _, it := range items {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break loop
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			s.runItem(ctx, run, it)
+		}()
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		s.release(run.ID)
+		return err
+	}
+
+	dbCtx, done := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer done()
+	_, err = s.db.Exec(dbCtx, `
+update batch_runs
+set status = 'completed', finished_at = now(), heartbeat_at = null
+where id = $1 and status = 'running'
+`, run.ID)
+	if err == nil {
+		log.Printf(`msg="batch run completed" run_id=%d`, run.ID)
+	}
+	return err
+}
+
+// release hands an interrupted run back so any process can pick it up
+// without waiting for its heartbeat to go stale. Cancelled runs stay so.
+func (s *Service) release(id int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.db.Exec(ctx, `
+update batch_runs
+set status = 'pending', heartbeat_at = null
+where id = $1 and status = 'running'
+`, id); err != nil {
+		log.Printf(`msg="batch run release failed" run_id=%d err=%q`, id, err.Error())
+	}
+}
+
+// heartbeat keeps the claim on run id fresh, and stops the run (via cancel)
+// once it was cancelled elsewhere.
+func (s *Service) heartbeat(ctx context.Context, cancel context.CancelFunc, id int64) {
+	t := time.NewTicker(heartbeatEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		tag, err := s.db.Exec(ctx, `update batch_runs set heartbeat_at = now() where id = $1 and status = 'running'`, id)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf(`msg="batch heartbeat failed" run_id=%d err=%q`, id, err.Error())
+			}
+			continue
+		}
+		if tag.RowsAffected() == 0 {
+			log.Printf(`msg="batch run stopped elsewhere" run_id=%d`, id)
+			cancel()
+			return
+		}
+	}
+}
+
+func (s *Service) pending(ctx context.Context, runID int64) ([]item, error) {
+	rows, err := s.db.Query(ctx, `
+select i.id, i.prompt_id, p.body, i.model
+from batch_items i
+join prompts p on p.id = i.prompt_id
+where i.run_id = $1 and i.status = 'pending'
+order by i.id
+`, runID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (item, error) {
+		var it item
+		err := row.Scan(&it.id, &it.promptID, &it.body, &it.model)
+		return it, err
+	})
+}
+
+// runItem generates one item and records the outcome. An item interrupted
+// by ctx or by the dispatcher shutting down stays pending.
+func (s *Service) runItem(ctx context.Context, run Run, it item) {
+	req := dispatcher.InferenceRequest{Prompt: it.body, Model: it.model, Params: run.Params}
+	res := s.generate(ctx, run, it.id, req)
+	if ctx.Err() != nil || errors.Is(res.Err, dispatcher.ErrShuttingDown) {
+		return
+	}
+
+	dbCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+
+	var err error
+	if res.Err != nil {
+		obs.BatchItems.WithLabelValues("failed").Inc()
+		_, err = s.db.Exec(dbCtx, `
+update batch_items
+set status = 'failed', error = $2, provider = nullif($3, ''), finished_at = now()
+where id = $1 and status = 'pending'
+`, it.id, res.Err.Error(), res.Provider)
+	} else {
+		obs.BatchItems.WithLabelValues("succeeded").Inc()
+		model := res.Model
+		if model == "" {
+			model = it.model
+		}
+		err = s.save(dbCtx, it, model, res)
+	}
+	if err != nil {
+		log.Printf(`msg="batch item not saved" run_id=%d item_id=%d err=%q`, run.ID, it.id, err.Error())
+	}
+}
+
+// save stores a generation in responses and marks its item succeeded, in
+// one transaction so a crash cannot leave one without the other.
+func (s *Service) save(ctx context.Context, it item, model string, res dispatcher.InferenceResult) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var responseID int64
+	if err := tx.QueryRow(ctx, `
+insert into responses (prompt_id, provider, model, content, finish_reason, safety)
+values ($1, $2, $3, $4, nullif($5, ''), $6)
+returning id
+`, it.promptID, res.Provider, model, res.Text, res.Meta.FinishReason, res.Meta.Safety).Scan(&responseID); err != nil {
+		return err
+	}
+	tag, err := tx.Exec(ctx, `
+update batch_items
+set status = 'succeeded', response_id = $2, provider = $3, error = null, finished_at = now()
+where id = $1 and status = 'pending'
+`, it.id, responseID, res.Provider)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil // finished by another process meanwhile; drop ours
+	}
+	return tx.Commit(ctx)
+}
+
+// generate runs req on the dispatcher, waiting for room in the queue rather
+// than failing when it is full or too slow for the item's deadline: batch
+// work yields to interactive traffic.
+func (s *Service) generate(ctx context.Context, run Run, itemID int64, req dispatcher.InferenceRequest) dispatcher.InferenceResult {
+	ctx, cancel := context.WithTimeout(ctx, s.itemTimeout)
+	defer cancel()
+
+	key := run.ownerKey
+	if key == "" {
+		key = fmt.Sprintf("batch:%d", run.ID)
+	}
+	replyCh := make(chan dispatcher.InferenceResult, 1)
+	job := dispatcher.InferenceJob{
+		Req:       req,
+		Ctx:       ctx,
+		ReplyCh:   replyCh,
+		Key:       key,
+		BudgetKey: run.budgetKey,
+		Priority:  dispatcher.PriorityBatch,
+
+		RequestID: fmt.Sprintf("batch:%d:%d", run.ID, itemID),
+	}
+	for wait := enqueueBackoffMin; ; wait = min(2*wait, enqueueBackoffMax) {
+		job.EnqueuedAt = time.Now()
+		_, err := s.disp.TryEnqueue(job)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, dispatcher.ErrQueueFull) && !errors.Is(err, dispatcher.ErrDeadlineUnmeetable) {
+			return dispatcher.InferenceResult{Err: err}
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return dispatcher.InferenceResult{Err: ctx.Err()}
+		}
+	}
+
+	select {
+	case res := <-replyCh:
+		return res
+	case <-ctx.Done():
+		return dispatcher.InferenceResult{Err: ctx.Err()}
+	}
+}
+
+// Get returns owner's run id with its progress.
+func (s *Service) Get(ctx context.Context, id int64, owner string) (Run, error) {
+	var (
+		r      Run
+		params []byte
+	)
+	err := s.db.QueryRow(ctx, `
+select r.id, r.name, r.status, r.models, r.params, r.concurrency,
+       r.created_at, r.started_at, r.finished_at,
+       count(i.id),
+       count(i.id) filter (where i.status = 'pending'),
+       count(i.id) filter (where i.status = 'succeeded'),
+       count(i.id) filter (where i.status = 'failed')
+from batch_runs r
+left join batch_items i on i.run_id = r.id
+where r.id = $1 and ($2::text = '*' or r.budget_key = $2)
+group by r.id
+`, id, owner).Scan(&r.ID, &r.Name, &r.Status, &r.Models, &params, &r.Concurrency,
+		&r.CreatedAt, &r.StartedAt, &r.FinishedAt,
+		&r.Progress.Total, &r.Progress.Pending, &r.Progress.Succeeded, &r.Progress.Failed)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Run{}, ErrNotFound
+		}
+		return Run{}, err
+	}
+	if err := json.Unmarshal(params, &r.Params); err != nil {
+		return Run{}, err
+	}
+	return r, nil
+}
+
+// Cancel stops owner's pending or running run. Items already generated are
+// kept.
+func (s *Service) Cancel(ctx context.Context, id int64, owner string) (Run, error) {
+	tag, err := s.db.Exec(ctx, `
+update batch_runs
+set status = 'cancelled', finished_at = now(), heartbeat_at = null
+where id = $1 and ($2::text = '*' or budget_key = $2) and status in ('pending', 'running')
+`, id, owner)
+	if err != nil {
+		return Run{}, err
+	}
+
+	// A run executing in another process notices on its next heartbeat.
+	if tag.RowsAffected() > 0 {
+		s.mu.Lock()
+		if cancel, ok := s.running[id]; ok {
+			cancel()
+		}
+		s.mu.Unlock()
+	}
+
+	r, err := s.Get(ctx, id, owner)
+	if err != nil {
+		return Run{}, err
+	}
+	if tag.RowsAffected() == 0 {
+		return r, ErrFinished
+	}
+	return r, nil
+}
+
+// RetryFailed puts the failed items of owner's run back to pending and
+// reopens the run if it had completed. Start or Execute it afterwards.
+func (s *Service) RetryFailed(ctx context.Context, id int64, owner string) (int, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var status Status
+	if err := tx.QueryRow(ctx, `select status from batch_runs where id = $1 and ($2::text = '*' or budget_key = $2) for update`, id, owner).Scan(&status); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrNotFound
+		}
+		return 0, err
+	}
+	if status == StatusCancelled {
+		return 0, ErrFinished
+	}
+	tag, err := tx.Exec(ctx, `
+update batch_items
+set status = 'pending', error = null, provider = null, finished_at = null
+where run_id = $1 and status = 'failed'
+`, id)
+	if err != nil {
+		return 0, err
+	}
+	if tag.RowsAffected() > 0 && status == StatusCompleted {
+		if _, err := tx.Exec(ctx, `update batch_runs set status = 'pending', finished_at = null where id = $1`, id); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// Close stops the runs executing in this process and waits for them to
+// hand their claim back; they resume on the next Start or RunResumer.
+func (s *Service) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for _, cancel := range s.running {
+		cancel()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func uniq(ids []int64) map[int64]struct{} {
+	m := make(map[int64]struct{}, len(ids))
+	for _, id := range ids {
+		m[id] = struct{}{}
+	}
+	return m
+}
@@ -0,0 +1,112 @@
+package batch
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+)
+
+// testDB connects to the migrated Postgres in TEST_PG_URL, with temporary
+// copies of the batch tables so the real ones are not modified.
+func testDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("TEST_PG_URL")
+	if url == "" {
+		t.Skip("TEST_PG_URL not set")
+	}
+	cfg, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.MaxConns = 1 // the temp tables live on one connection
+	db, err := pgxpool.NewWithConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	if _, err := db.Exec(context.Background(), `
+create temp table prompts (like public.prompts including defaults);
+create temp table batch_runs (like public.batch_runs including defaults);
+create temp table batch_items (like public.batch_items including defaults);
+`); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestService_ScopesRunsToTheirOwner(t *testing.T) {
+	ctx := context.Background()
+	s := NewService(testDB(t), nil, 0)
+
+	run, err := s.Create(ctx, Spec{
+		Models:      []string{"m"},
+		Prompts:     []Prompt{{Prompt: "hello"}},
+		Concurrency: 1,
+		OwnerKey:    "ip:203.0.113.7",
+		BudgetKey:   "ip:203.0.113.7",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const foreign = "ip:198.51.100.9"
+	if _, err := s.Get(ctx, run.ID, foreign); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get by another caller: err = %v, want ErrNotFound", err)
+	}
+	if _, err := s.Start(ctx, run.ID, foreign); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Start by another caller: err = %v, want ErrNotFound", err)
+	}
+	if _, err := s.RetryFailed(ctx, run.ID, foreign); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("RetryFailed by another caller: err = %v, want ErrNotFound", err)
+	}
+	if _, err := s.Cancel(ctx, run.ID, foreign); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Cancel by another caller: err = %v, want ErrNotFound", err)
+	}
+	if _, err := s.Get(ctx, run.ID, ""); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get without a key: err = %v, want ErrNotFound", err)
+	}
+
+	got, err := s.Get(ctx, run.ID, "ip:203.0.113.7")
+	if err != nil || got.Status != StatusPending || got.Progress.Total != 1 {
+		t.Fatalf("Get by the owner = %+v, %v", got, err)
+	}
+	if _, err := s.Get(ctx, run.ID, AnyOwner); err != nil {
+		t.Fatalf("Get by AnyOwner: %v", err)
+	}
+	if got, err := s.Cancel(ctx, run.ID, "ip:203.0.113.7"); err != nil || got.Status != StatusCancelled {
+		t.Fatalf("Cancel by the owner = %+v, %v", got, err)
+	}
+}
+
+func TestService_StoresRedactedPrompts(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	mask := func(req dispatcher.InferenceRequest) dispatcher.InferenceRequest {
+		req.Prompt = strings.ReplaceAll(req.Prompt, "a@b.example", "[email]")
+		return req
+	}
+	s := NewService(db, nil, 0, WithRedactor(mask))
+
+	if _, err := s.Create(ctx, Spec{
+		Models:      []string{"m"},
+		Prompts:     []Prompt{{Title: "from a@b.example", Prompt: "mail a@b.example"}},
+		Concurrency: 1,
+		BudgetKey:   "ip:203.0.113.7",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var title, body string
+	if err := db.QueryRow(ctx, `select title, body from prompts`).Scan(&title, &body); err != nil {
+		t.Fatal(err)
+	}
+	if title != "from [email]" || body != "mail [email]" {
+		t.Fatalf("stored %q / %q, want the address masked", title, body)
+	}
+}
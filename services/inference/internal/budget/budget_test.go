@@ -0,0 +1,122 @@
+package budget
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/usage"
+)
+
+func TestLimits_ForFallsBackToDefault(t *testing.T) {
+	l := Limits{ScopeUser: {
+		"*":     {Tokens: 1000},
+		"alice": {Tokens: 5000, USD: 2},
+	}}
+	if got := l.For(ScopeUser, "alice"); got.Tokens != 5000 || got.USD != 2 {
+		t.Fatalf("alice = %+v", got)
+	}
+	if got := l.For(ScopeUser, "bob"); got.Tokens != 1000 {
+		t.Fatalf("bob = %+v", got)
+	}
+	if got := l.For(ScopeProvider, "gemini"); got != (Limit{}) {
+		t.Fatalf("unconfigured scope = %+v", got)
+	}
+}
+
+func TestEnforcer_EstimateAndActual(t *testing.T) {
+	prices := usage.PriceTable{"m": {InputPerMTok: 1, OutputPerMTok: 2}}
+	e := New(nil, nil, nil, func() usage.PriceTable { return prices })
+
+	maxTokens := 100
+	req := dispatcher.InferenceRequest{Model: "m", Prompt: "12345678", Params: dispatcher.GenerationParams{MaxTokens: &maxTokens}}
+	tokens, usd := e.estimate(req)
+	if tokens != 102 || usd != 202 { // 2 prompt tokens at $1/M + 100 at $2/M
+		t.Fatalf("estimate = %d tokens, %d µUSD", tokens, usd)
+	}
+
+	res := dispatcher.InferenceResult{Model: "m", Meta: dispatcher.ResultMeta{PromptTokens: 500000, CompletionTokens: 250000}}
+	if tokens, usd := e.actual(req, res); tokens != 750000 || usd != 1000000 {
+		t.Fatalf("actual = %d tokens, %d µUSD", tokens, usd)
+	}
+	res.Meta.Cached = true
+	if tokens, usd := e.actual(req, res); tokens != 0 || usd != 0 {
+		t.Fatalf("cached actual = %d tokens, %d µUSD", tokens, usd)
+	}
+}
+
+func TestEnforcer_RedisDown(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1, DialTimeout: 50 * time.Millisecond})
+	defer rdb.Close()
+	e := New(rdb, nil, nil, nil)
+	job := dispatcher.InferenceJob{Req: dispatcher.InferenceRequest{Prompt: "hi", Model: "m", Provider: "stub"}, Ctx: context.Background(), BudgetKey: "ip:198.51.100.1"}
+
+	if settle, err := e.Gate(job); err != nil || settle != nil {
+		t.Fatalf("fail open: settle=%v err=%v", settle != nil, err)
+	}
+	e.FailOpen = false
+	if _, err := e.Gate(job); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("fail closed: err = %v", err)
+	}
+}
+
+func TestCorrections_ChargeProviderOncePerFlight(t *testing.T) {
+	counters := []counter{
+		{scope: ScopeUser, unit: unitTokens, amount: 100},
+		{scope: ScopeUser, unit: unitUSD, amount: 50},
+		{scope: ScopeProvider, unit: unitTokens, amount: 100},
+		{scope: ScopeProvider, unit: unitUSD, amount: 50},
+	}
+	if got := corrections(counters, 30, 20, false); !slices.Equal(got, []int64{-70, -30, -70, -30}) {
+		t.Fatalf("charged result: %v", got)
+	}
+	if got := corrections(counters, 30, 20, true); !slices.Equal(got, []int64{-70, -30, -100, -50}) {
+		t.Fatalf("shared result: %v, want the provider reservation refunded", got)
+	}
+}
+
+func TestRebill_ChargesTheFallbackProvider(t *testing.T) {
+	providerOf := func(req dispatcher.InferenceRequest) string {
+		provider, _, _ := strings.Cut(req.Model, "/")
+		return provider
+	}
+	e := New(nil, nil, providerOf, nil)
+	job := dispatcher.InferenceJob{Req: dispatcher.InferenceRequest{Model: "gemini/flash"}}
+	counters := []counter{
+		{key: "u:tok", scope: ScopeUser, unit: unitTokens, amount: 100},
+		{key: "p:tok", scope: ScopeProvider, subject: "gemini", unit: unitTokens, amount: 100},
+	}
+
+	// Same provider: nothing moves.
+	same := e.rebill(job, "20250101", counters, dispatcher.InferenceResult{Model: "gemini/pro"})
+	if got := corrections(same, 30, 0, false); !slices.Equal(got, []int64{-70, -70}) {
+		t.Fatalf("same provider: %v", got)
+	}
+
+	moved := e.rebill(job, "20250101", counters, dispatcher.InferenceResult{Model: "anthropic/haiku"})
+	if len(moved) != 4 || moved[2].key != "crowdaudit:budget:20250101:p:anthropic:tok" || moved[2].subject != "anthropic" {
+		t.Fatalf("rebilled counters = %+v", moved)
+	}
+	// The user pays as usual, gemini gets its reservation back and anthropic is charged.
+	if got := corrections(moved, 30, 20, false); !slices.Equal(got, []int64{-70, -100, 30, 20}) {
+		t.Fatalf("fallback provider: %v", got)
+	}
+}
+
+func TestExceededError(t *testing.T) {
+	err := error(&ExceededError{Scope: ScopeProvider, Subject: "gemini", Unit: "usd", Limit: 5, Used: 4.5,
+		ResetsAt: time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)})
+	if !errors.Is(err, ErrExceeded) {
+		t.Fatal("ExceededError does not wrap ErrExceeded")
+	}
+	want := "the gemini provider's daily spend budget is exhausted (4.5 of 5 used); it resets at 2025-01-02T00:00:00Z"
+	if err.Error() != want {
+		t.Fatalf("Error() = %q", err.Error())
+	}
+}
@@ -0,0 +1,356 @@
+package budget
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/obs"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/usage"
+)
+
+// ErrExceeded is wrapped by ExceededError.
+var ErrExceeded = errors.New("budget exceeded")
+
+// ErrUnavailable is returned instead of admitting jobs when Redis cannot be
+// reached and FailOpen is false.
+var ErrUnavailable = errors.New("budget service unavailable")
+
+// ExceededError rejects a job whose estimated usage does not fit in a budget.
+type ExceededError struct {
+	Scope    string // ScopeUser or ScopeProvider
+	Subject  string // provider name; empty for users
+	Unit     string // "tokens" or "usd"
+	Limit    float64
+	Used     float64
+	ResetsAt time.Time
+}
+
+func (e *ExceededError) Error() string {
+	whose := "your"
+	if e.Scope == ScopeProvider {
+		whose = fmt.Sprintf("the %s provider's", e.Subject)
+	}
+	unit := "token"
+	if e.Unit == unitUSD {
+		unit = "spend"
+	}
+	return fmt.Sprintf("%s daily %s budget is exhausted (%g of %g used); it resets at %s",
+		whose, unit, e.Used, e.Limit, e.ResetsAt.Format(time.RFC3339))
+}
+
+func (e *ExceededError) Unwrap() error { return ErrExceeded }
+
+const (
+	unitTokens = "tokens"
+	unitUSD    = "usd"
+
+	limitsRefresh = 30 * time.Second
+	redisTimeout  = 150 * time.Millisecond
+	keyTTL        = 48 * time.Hour // outlives the day it counts
+
+	// defaultCompletionEstimate is reserved for requests without max_tokens;
+	// the reservation is corrected once the real usage is known.
+	defaultCompletionEstimate = 512
+
+	microUSD = 1e6 // spend is counted in Redis as integer micro-dollars
+)
+
+// Enforcer applies daily per-user and per-provider budgets. Each job
+// reserves its estimated tokens and spend atomically in Redis before it is
+// queued (Gate), and the reservation is corrected to the actual usage once
+// the job finishes. Users are keyed on the job's BudgetKey, so a budgets
+// row for one names that key (e.g. "ip:203.0.113.7"). Counters are kept
+// per UTC day. All keys are touched by one script, so a Redis Cluster
+// needs them in one slot (e.g. a {hash tag} in Prefix).
+type Enforcer struct {
+	RDB      *redis.Client
+	Prefix   string
+	FailOpen bool // admit jobs when Redis is unavailable
+
+	load       LimitsLoader
+	providerOf func(dispatcher.InferenceRequest) string
+	prices     func() usage.PriceTable
+	now        func() time.Time
+
+	mu     sync.RWMutex
+	limits Limits
+}
+
+// New returns an Enforcer reading its limits from load (see Run).
+// providerOf names the backend a request goes to; prices may be nil, in
+// which case only token budgets can bite.
+func New(rdb *redis.Client, load LimitsLoader, providerOf func(dispatcher.InferenceRequest) string, prices func() usage.PriceTable) *Enforcer {
+	return &Enforcer{
+		RDB:        rdb,
+		Prefix:     "crowdaudit:budget",
+		FailOpen:   true,
+		load:       load,
+		providerOf: providerOf,
+		prices:     prices,
+		now:        time.Now,
+	}
+}
+
+// Run loads the limits now and every 30 seconds until ctx ends, so budgets
+// can be changed in the database without a redeploy.
+func (e *Enforcer) Run(ctx context.Context) error {
+	t := time.NewTicker(limitsRefresh)
+	defer t.Stop()
+	for {
+		if lim, err := e.load(ctx); err != nil {
+			if ctx.Err() == nil {
+				log.Printf("budget limits refresh error: %v", err)
+			}
+		} else {
+			e.SetLimits(lim)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// SetLimits replaces the limits.
+func (e *Enforcer) SetLimits(l Limits) {
+	e.mu.Lock()
+	e.limits = l
+	e.mu.Unlock()
+}
+
+// counter is one Redis budget counter touched by a job.
+type counter struct {
+	key     string
+	limit   int64 // 0 = unlimited (counted, never enforced)
+	amount  int64
+	scope   string
+	subject string
+	unit    string
+	refund  bool // the call went to another provider; see rebill
+}
+
+// reserveLua adds every amount only if none of the limited counters would
+// go over its limit. Returns {0, 0} on success, or {i, used} for the first
+// counter (1-based) that would.
+var reserveLua = redis.NewScript(`
+for i, key in ipairs(KEYS) do
+  local limit = tonumber(ARGV[2*i])
+  local amount = tonumber(ARGV[2*i+1])
+  if limit > 0 then
+    local used = tonumber(redis.call("GET", key) or "0")
+    if used + amount > limit then
+      return {i, used}
+    end
+  end
+end
+for i, key in ipairs(KEYS) do
+  redis.call("INCRBY", key, ARGV[2*i+1])
+  redis.call("PEXPIRE", key, ARGV[1])
+end
+return {0, 0}
+`)
+
+// Gate is a dispatcher.Gate.
+func (e *Enforcer) Gate(job dispatcher.InferenceJob) (func(dispatcher.InferenceResult), error) {
+	now := e.now().UTC()
+	day := now.Format("20060102")
+	resetsAt := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+
+	e.mu.RLock()
+	limits := e.limits
+	e.mu.RUnlock()
+
+	provider := e.provider(job.Req)
+	estTokens, estUSD := e.estimate(job.Req)
+
+	var counters []counter
+	add := func(base, scope, subject string, lim Limit) {
+		counters = append(counters,
+			counter{key: base + ":tok", limit: lim.Tokens, amount: estTokens, scope: scope, subject: subject, unit: unitTokens},
+			counter{key: base + ":usd", limit: toMicro(lim.USD), amount: estUSD, scope: scope, subject: subject, unit: unitUSD},
+		)
+	}
+	if job.BudgetKey != "" {
+		add(e.Prefix+":"+day+":u:"+hashKey(job.BudgetKey), ScopeUser, "", limits.For(ScopeUser, job.BudgetKey))
+	}
+	if provider != "" {
+		add(e.Prefix+":"+day+":p:"+provider, ScopeProvider, provider, limits.For(ScopeProvider, provider))
+	}
+	if len(counters) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, len(counters))
+	args := []any{keyTTL.Milliseconds()}
+	for i, c := range counters {
+		keys[i] = c.key
+		args = append(args, c.limit, c.amount)
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(job.Ctx), redisTimeout)
+	defer cancel()
+	res, err := reserveLua.Run(ctx, e.RDB, keys, args...).Int64Slice()
+	if err == nil && len(res) != 2 {
+		err = fmt.Errorf("unexpected reply %v", res)
+	}
+	if err != nil {
+		log.Printf(`req_id=%s msg="budget reserve failed" err=%q`, job.RequestID, err.Error())
+		if e.FailOpen {
+			return nil, nil
+		}
+		return nil, ErrUnavailable
+	}
+
+	if i := res[0]; i > 0 {
+		c := counters[i-1]
+		obs.BudgetRejections.WithLabelValues(c.scope, c.unit).Inc()
+		ex := &ExceededError{Scope: c.scope, Subject: c.subject, Unit: c.unit, ResetsAt: resetsAt,
+			Limit: float64(c.limit), Used: float64(res[1])}
+		if c.unit == unitUSD {
+			ex.Limit, ex.Used = ex.Limit/microUSD, ex.Used/microUSD
+		}
+		return nil, ex
+	}
+	return func(r dispatcher.InferenceResult) { e.settle(job, day, counters, r) }, nil
+}
+
+// provider names the backend req goes to.
+func (e *Enforcer) provider(req dispatcher.InferenceRequest) string {
+	if e.providerOf != nil {
+		return e.providerOf(req)
+	}
+	return req.Provider
+}
+
+// settle corrects the reservation to the job's actual usage. It runs in
+// the background so it never holds up a worker.
+func (e *Enforcer) settle(job dispatcher.InferenceJob, day string, counters []counter, r dispatcher.InferenceResult) {
+	tokens, usd := e.actual(job.Req, r)
+	counters = e.rebill(job, day, counters, r)
+	deltas := corrections(counters, tokens, usd, r.Shared)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		pipe := e.RDB.Pipeline()
+		for i, c := range counters {
+			if deltas[i] != 0 {
+				pipe.IncrBy(ctx, c.key, deltas[i])
+				pipe.PExpire(ctx, c.key, keyTTL) // rebill may add keys Gate never set
+			}
+		}
+		if pipe.Len() == 0 {
+			return
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Printf(`req_id=%s msg="budget settle failed" err=%q`, job.RequestID, err.Error())
+		}
+	}()
+}
+
+// rebill moves the provider charge to the backend that answered when a
+// fallback model on another provider did: the reserved provider counters
+// are refunded and the answering provider's are charged from zero. Failed
+// attempts report no usage, so the whole call belongs to the answer.
+func (e *Enforcer) rebill(job dispatcher.InferenceJob, day string, counters []counter, r dispatcher.InferenceResult) []counter {
+	if r.Model == "" || r.Model == job.Req.Model {
+		return counters
+	}
+	req := job.Req
+	req.Model = r.Model
+	answered := e.provider(req)
+	if answered == "" || answered == e.provider(job.Req) {
+		return counters
+	}
+	out := make([]counter, 0, len(counters)+2)
+	for _, c := range counters {
+		if c.scope == ScopeProvider {
+			c.refund = true
+		}
+		out = append(out, c)
+	}
+	base := e.Prefix + ":" + day + ":p:" + answered
+	return append(out,
+		counter{key: base + ":tok", scope: ScopeProvider, subject: answered, unit: unitTokens},
+		counter{key: base + ":usd", scope: ScopeProvider, subject: answered, unit: unitUSD},
+	)
+}
+
+// corrections returns what to add to each counter to turn its reservation
+// into the actual usage. Every coalesced caller pays its own user budget,
+// but the one provider call is charged to the provider once: shared copies
+// of the result give their provider reservation back.
+func corrections(counters []counter, tokens, usd int64, shared bool) []int64 {
+	out := make([]int64, len(counters))
+	for i, c := range counters {
+		actual := tokens
+		if c.unit == unitUSD {
+			actual = usd
+		}
+		if c.refund || shared && c.scope == ScopeProvider {
+			actual = 0
+		}
+		out[i] = actual - c.amount
+	}
+	return out
+}
+
+// estimate reserves roughly four characters per prompt token plus the
+// completion cap.
+func (e *Enforcer) estimate(req dispatcher.InferenceRequest) (tokens, usd int64) {
+	chars := 0
+	for _, m := range req.Conversation() {
+		chars += len(m.Content)
+	}
+	prompt := (chars + 3) / 4
+	completion := defaultCompletionEstimate
+	if req.Params.MaxTokens != nil {
+		completion = *req.Params.MaxTokens
+	}
+	return int64(prompt + completion), e.cost(req.Model, prompt, completion, 0)
+}
+
+// actual is what the job really used. Failed calls that report nothing
+// and cache hits cost nothing.
+func (e *Enforcer) actual(req dispatcher.InferenceRequest, r dispatcher.InferenceResult) (tokens, usd int64) {
+	if r.Meta.Cached {
+		return 0, 0
+	}
+	model := r.Model
+	if model == "" {
+		model = req.Model
+	}
+	total := r.TokenUsage
+	if total == 0 {
+		total = r.Meta.PromptTokens + r.Meta.CompletionTokens
+	}
+	return int64(total), e.cost(model, r.Meta.PromptTokens, r.Meta.CompletionTokens, total)
+}
+
+func (e *Enforcer) cost(model string, prompt, completion, total int) int64 {
+	if e.prices == nil {
+		return 0
+	}
+	usd, _ := e.prices().Cost(model, prompt, completion, total)
+	return toMicro(usd)
+}
+
+func toMicro(usd float64) int64 {
+	return int64(math.Ceil(usd * microUSD))
+}
+
+func hashKey(k string) string {
+	sum := sha256.Sum256([]byte(k))
+	return hex.EncodeToString(sum[:8])
+}
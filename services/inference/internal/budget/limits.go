@@ -0,0 +1,66 @@
+package budget
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Scopes a budget applies to.
+const (
+	ScopeUser     = "user"
+	ScopeProvider = "provider"
+)
+
+// defaultSubject is the budgets row that applies to subjects without their own.
+const defaultSubject = "*"
+
+// Limit is a daily cap; zero fields are unlimited.
+type Limit struct {
+	Tokens int64
+	USD    float64
+}
+
+// Limits holds the configured caps by scope and subject.
+type Limits map[string]map[string]Limit
+
+// For returns the limit for subject in scope, falling back to the scope default.
+func (l Limits) For(scope, subject string) Limit {
+	if lim, ok := l[scope][subject]; ok {
+		return lim
+	}
+	return l[scope][defaultSubject]
+}
+
+// LimitsLoader returns the current limits.
+type LimitsLoader func(ctx context.Context) (Limits, error)
+
+// DBLimits reads the budgets table.
+func DBLimits(db *pgxpool.Pool) LimitsLoader {
+	return func(ctx context.Context) (Limits, error) {
+		rows, err := db.Query(ctx, `
+select scope, subject, coalesce(daily_tokens, 0), coalesce(daily_usd, 0)::float8
+from budgets
+`)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		out := Limits{}
+		for rows.Next() {
+			var (
+				scope, subject string
+				lim            Limit
+			)
+			if err := rows.Scan(&scope, &subject, &lim.Tokens, &lim.USD); err != nil {
+				return nil, err
+			}
+			if out[scope] == nil {
+				out[scope] = map[string]Limit{}
+			}
+			out[scope][subject] = lim
+		}
+		return out, rows.Err()
+	}
+}
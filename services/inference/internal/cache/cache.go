@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/obs"
+)
+
+// Cache stores provider responses in Redis so identical deterministic
+// requests are answered without calling (and paying for) the provider again.
+type Cache struct {
+	rdb    *redis.Client
+	ttl    time.Duration
+	Prefix string // key namespace, default "crowdaudit:infer"
+}
+
+func New(rdb *redis.Client, ttl time.Duration) *Cache {
+	return &Cache{rdb: rdb, ttl: ttl, Prefix: "crowdaudit:infer"}
+}
+
+type entry struct {
+	Text             string             `json:"text"`
+	Provider         string             `json:"provider"`
+	TokenUsage       int                `json:"token_usage"`
+	PromptTokens     int                `json:"prompt_tokens"`
+	CompletionTokens int                `json:"completion_tokens"`
+	FinishReason     string             `json:"finish_reason"`
+	Safety           *dispatcher.Safety `json:"safety,omitempty"`
+}
+
+// Cacheable reports whether req may be served from the cache. Only
+// temperature-0 requests are deterministic enough; an unset temperature
+// means the provider default, which is not. req.Cache overrides either way.
+func Cacheable(req dispatcher.InferenceRequest) bool {
+	switch req.Cache {
+	case dispatcher.CacheForce:
+		return true
+	case dispatcher.CacheSkip:
+		return false
+	}
+	t := req.Params.Temperature
+	return t != nil && *t == 0
+}
+
+// Key is the cache key of req, its dispatcher fingerprint.
+func Key(req dispatcher.InferenceRequest) string {
+	return req.Fingerprint()
+}
+
+// Middleware serves cache hits and stores successful responses. Redis
+// errors are logged and treated as misses, so the cache never fails a request.
+func (c *Cache) Middleware(next dispatcher.ProviderFunc) dispatcher.ProviderFunc {
+	return func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		if !Cacheable(req) {
+			obs.CacheRequests.WithLabelValues("bypass").Inc()
+			return next(ctx, req)
+		}
+		key := c.Prefix + ":" + Key(req)
+		meta := dispatcher.MetaFromContext(ctx)
+
+		if e, ok := c.get(ctx, key); ok {
+			obs.CacheRequests.WithLabelValues("hit").Inc()
+			meta.PromptTokens = e.PromptTokens
+			meta.CompletionTokens = e.CompletionTokens
+			meta.FinishReason = e.FinishReason
+			meta.Safety = e.Safety
+			meta.Cached = true
+			return e.Text, e.Provider, e.TokenUsage, nil
+		}
+		obs.CacheRequests.WithLabelValues("miss").Inc()
+
+		text, provider, tokens, err := next(ctx, req)
+		if err == nil {
+			c.set(ctx, key, entry{
+				Text:             text,
+				Provider:         provider,
+				TokenUsage:       tokens,
+				PromptTokens:     meta.PromptTokens,
+				CompletionTokens: meta.CompletionTokens,
+				FinishReason:     meta.FinishReason,
+				Safety:           meta.Safety,
+			})
+		}
+		return text, provider, tokens, err
+	}
+}
+
+func (c *Cache) get(ctx context.Context, key string) (entry, bool) {
+	b, err := c.rdb.Get(ctx, key).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Printf(`msg="response cache get failed" err=%q`, err.Error())
+		}
+		return entry{}, false
+	}
+	var e entry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return entry{}, false
+	}
+	return e, true
+}
+
+func (c *Cache) set(ctx context.Context, key string, e entry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	// The caller may already be out of time; a finished response is still worth keeping.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second)
+	defer cancel()
+	if err := c.rdb.Set(ctx, key, b, c.ttl).Err(); err != nil {
+		log.Printf(`msg="response cache set failed" err=%q`, err.Error())
+	}
+}
@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+)
+
+func ptr[T any](v T) *T { return &v }
+
+func TestCacheable(t *testing.T) {
+	cases := []struct {
+		name string
+		req  dispatcher.InferenceRequest
+		want bool
+	}{
+		{"zero temperature", dispatcher.InferenceRequest{Params: dispatcher.GenerationParams{Temperature: ptr(0.0)}}, true},
+		{"provider default temperature", dispatcher.InferenceRequest{}, false},
+		{"nonzero temperature", dispatcher.InferenceRequest{Params: dispatcher.GenerationParams{Temperature: ptr(0.7)}}, false},
+		{"forced", dispatcher.InferenceRequest{Cache: dispatcher.CacheForce, Params: dispatcher.GenerationParams{Temperature: ptr(0.7)}}, true},
+		{"skipped", dispatcher.InferenceRequest{Cache: dispatcher.CacheSkip, Params: dispatcher.GenerationParams{Temperature: ptr(0.0)}}, false},
+	}
+	for _, c := range cases {
+		if got := Cacheable(c.req); got != c.want {
+			t.Errorf("%s: Cacheable = %t, want %t", c.name, got, c.want)
+		}
+	}
+}
+
+func TestKey(t *testing.T) {
+	prompt := dispatcher.InferenceRequest{Prompt: "hi", Model: "m"}
+	messages := dispatcher.InferenceRequest{Messages: []dispatcher.Message{{Role: dispatcher.RoleUser, Content: "hi"}}, Model: "m"}
+	if Key(prompt) != Key(messages) {
+		t.Fatal("prompt shorthand and the equivalent messages should share a key")
+	}
+
+	forced := prompt
+	forced.Cache = dispatcher.CacheForce
+	if Key(prompt) != Key(forced) {
+		t.Fatal("the cache policy must not change the key")
+	}
+
+	for _, other := range []dispatcher.InferenceRequest{
+		{Prompt: "hi", Model: "m2"},
+		{Prompt: "hi!", Model: "m"},
+		{Prompt: "hi", Model: "m", Params: dispatcher.GenerationParams{MaxTokens: ptr(5)}},
+		{Prompt: "hi", Model: "m", Provider: "stub"},
+	} {
+		if Key(other) == Key(prompt) {
+			t.Fatalf("%+v collides with %+v", other, prompt)
+		}
+	}
+}
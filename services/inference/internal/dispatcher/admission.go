@@ -0,0 +1,114 @@
+package dispatcher
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/obs"
+)
+
+// ErrDeadlineUnmeetable is matched by *AdmissionError.
+var ErrDeadlineUnmeetable = errors.New("deadline cannot be met")
+
+// AdmissionError rejects a job at TryEnqueue because, judging by recent
+// execution times, it would still be queued or running when its context's
+// deadline passes.
+type AdmissionError struct {
+	Model     string
+	Remaining time.Duration // until the job's deadline
+	Expected  time.Duration // estimated queue wait plus execution
+	QueueWait time.Duration // the queue wait part of Expected
+}
+
+func (e *AdmissionError) Error() string {
+	return fmt.Sprintf("%s: %s left, expected %s (%s queued)", ErrDeadlineUnmeetable.Error(),
+		e.Remaining.Round(time.Millisecond), e.Expected.Round(time.Millisecond), e.QueueWait.Round(time.Millisecond))
+}
+
+func (e *AdmissionError) Unwrap() error { return ErrDeadlineUnmeetable }
+
+// WithAdmissionControl makes TryEnqueue reject jobs whose deadline cannot be
+// met with an *AdmissionError instead of queueing them to time out.
+func WithAdmissionControl() Option {
+	return func(s *Server) { s.admit = newExecStats() }
+}
+
+const (
+	execAlpha      = 0.2 // weight of the newest sample in the moving averages
+	admitMinSample = 10  // completed calls before estimates are trusted
+)
+
+// execStats keeps moving averages of provider execution time, overall and
+// per model, as the basis of queue wait estimates.
+type execStats struct {
+	mu      sync.Mutex
+	samples int
+	all     time.Duration
+	byModel map[string]time.Duration
+}
+
+func newExecStats() *execStats {
+	return &execStats{byModel: map[string]time.Duration{}}
+}
+
+func ewma(avg, d time.Duration, first bool) time.Duration {
+	if first {
+		return d
+	}
+	return time.Duration(execAlpha*float64(d) + (1-execAlpha)*float64(avg))
+}
+
+func (e *execStats) observe(model string, d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.all = ewma(e.all, d, e.samples == 0)
+	e.samples++
+	avg, ok := e.byModel[model]
+	e.byModel[model] = ewma(avg, d, !ok)
+}
+
+// estimate returns the expected queue wait and execution time of a job for
+// model behind queued jobs, with busy of live workers occupied. ok is false
+// until enough calls have completed.
+func (e *execStats) estimate(model string, queued, busy, live int) (wait, exec time.Duration, ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.samples < admitMinSample || live <= 0 {
+		return 0, 0, false
+	}
+	exec = e.all
+	if m, found := e.byModel[model]; found {
+		exec = m
+	}
+	// Jobs ahead of this one that no idle worker picks up right away are
+	// served live at a time, at the average execution time.
+	if ahead := queued + busy - live + 1; ahead > 0 {
+		wait = time.Duration(float64(e.all) * float64(ahead) / float64(live))
+	}
+	return wait, exec, true
+}
+
+// admitJob returns an *AdmissionError when job's deadline falls before its
+// expected completion.
+func (s *Server) admitJob(job InferenceJob) error {
+	if s.admit == nil || job.Ctx == nil {
+		return nil
+	}
+	deadline, ok := job.Ctx.Deadline()
+	if !ok {
+		return nil
+	}
+	live, _ := s.Workers()
+	wait, exec, ok := s.admit.estimate(job.Req.Model, s.queue.stats().Len, int(s.busy.Load()), live)
+	if !ok {
+		return nil
+	}
+	remaining := time.Until(deadline)
+	if remaining >= wait+exec {
+		return nil
+	}
+	obs.AdmissionRejections.WithLabelValues(modelLabel(job.Req.Model)).Inc()
+	return &AdmissionError{Model: job.Req.Model, Remaining: remaining, Expected: wait + exec, QueueWait: wait}
+}
@@ -0,0 +1,113 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestExecStats_Estimate(t *testing.T) {
+	e := newExecStats()
+	if _, _, ok := e.estimate("m", 5, 1, 1); ok {
+		t.Fatal("estimate trusted without samples")
+	}
+	for range admitMinSample {
+		e.observe("m", time.Second)
+	}
+	e.observe("fast", 100*time.Millisecond)
+
+	if wait, _, _ := e.estimate("m", 0, 1, 2); wait != 0 {
+		t.Fatalf("idle worker available: wait = %s, want 0", wait)
+	}
+	// 4 workers busy, 6 queued: 7 jobs ahead of a free worker, 4 at a time,
+	// at the overall average of 0.82s.
+	wait, exec, ok := e.estimate("fast", 6, 4, 4)
+	if !ok || exec != 100*time.Millisecond {
+		t.Fatalf("exec = %s ok=%v, want the model's own average", exec, ok)
+	}
+	if want := 1435 * time.Millisecond; wait != want {
+		t.Fatalf("wait = %s, want %s", wait, want)
+	}
+}
+
+func TestAdmission_RejectsUnmeetableDeadlines(t *testing.T) {
+	release := make(chan struct{})
+	provider := func(ctx context.Context, req InferenceRequest) (string, string, int, error) {
+		<-release
+		return "ok", "fake", 1, nil
+	}
+	s := New(10, 1, provider, WithAdmissionControl())
+	defer s.Shutdown(context.Background())
+	defer close(release)
+	for range admitMinSample {
+		s.admit.observe("m", time.Second)
+	}
+
+	enqueue := func(ctx context.Context) (chan InferenceResult, error) {
+		replyCh := make(chan InferenceResult, 1)
+		_, err := s.TryEnqueue(InferenceJob{Req: InferenceRequest{Prompt: "hi", Model: "m"}, Ctx: ctx, ReplyCh: replyCh, EnqueuedAt: time.Now()})
+		return replyCh, err
+	}
+	if _, err := enqueue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for s.busy.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	short, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err := enqueue(short)
+	var adm *AdmissionError
+	if !errors.As(err, &adm) || !errors.Is(err, ErrDeadlineUnmeetable) || adm.Expected < time.Second {
+		t.Fatalf("err = %v, want an AdmissionError expecting at least 1s", err)
+	}
+	if st := s.QueueStats(); st.Len != 0 {
+		t.Fatalf("rejected job was queued: %+v", st)
+	}
+
+	long, cancel2 := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel2()
+	if _, err := enqueue(long); err != nil {
+		t.Fatalf("meetable deadline rejected: %v", err)
+	}
+}
+
+func TestQueue_DropsExpiredJobs(t *testing.T) {
+	release := make(chan struct{})
+	provider := func(ctx context.Context, req InferenceRequest) (string, string, int, error) {
+		<-release
+		return "ok", "fake", 1, nil
+	}
+	s := New(10, 1, provider)
+	defer s.Shutdown(context.Background())
+	defer close(release)
+
+	running := make(chan InferenceResult, 1)
+	if _, err := s.TryEnqueue(InferenceJob{Req: InferenceRequest{Prompt: "a", Model: "m"}, Ctx: context.Background(), ReplyCh: running, EnqueuedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	for s.busy.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	queued := make(chan InferenceResult, 1)
+	if _, err := s.TryEnqueue(InferenceJob{Req: InferenceRequest{Prompt: "b", Model: "m"}, Ctx: ctx, ReplyCh: queued, EnqueuedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case res := <-queued:
+		if !errors.Is(res.Err, context.DeadlineExceeded) {
+			t.Fatalf("expired job err = %v", res.Err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expired job was not answered while the worker was busy")
+	}
+	if st := s.QueueStats(); st.Len != 0 {
+		t.Fatalf("expired job still queued: %+v", st)
+	}
+}
@@ -0,0 +1,177 @@
+package dispatcher
+
+import (
+	"log"
+	"slices"
+	"time"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/obs"
+)
+
+// AutoscaleConfig sizes the worker pool to the load. Autoscaling is off
+// unless MaxWorkers exceeds the floor.
+type AutoscaleConfig struct {
+	MinWorkers int // floor; defaults to the workers given to New
+	MaxWorkers int // ceiling
+
+	// The pool grows when, since the last resize check, the p95 queue wait
+	// reached QueueWaitP95 (default 250ms) or QueueDepth jobs were queued
+	// (0 = as many as there are workers).
+	QueueWaitP95 time.Duration
+	QueueDepth   int
+
+	// It shrinks once the queue has been empty, with at most half the
+	// workers busy, for IdleAfter (default 30s).
+	IdleAfter time.Duration
+
+	Interval time.Duration // how often the pool is resized (default 1s)
+}
+
+// WithAutoscale lets the worker pool grow and shrink between c.MinWorkers
+// and c.MaxWorkers instead of staying at the size given to New.
+func WithAutoscale(c AutoscaleConfig) Option {
+	return func(s *Server) { s.scale = &c }
+}
+
+// maxWaitSamples bounds the queue waits kept between resize checks.
+const maxWaitSamples = 4096
+
+// spawnLocked starts n workers unless Shutdown has begun. Callers hold scaleMu.
+func (s *Server) spawnLocked(n int) {
+	if s.stopping {
+		return
+	}
+	for range n {
+		s.wg.Add(1)
+		s.live++
+		go s.worker(s.nextID)
+		s.nextID++
+	}
+	obs.DispatcherWorkers.Set(float64(s.live))
+}
+
+func (s *Server) workerExited() {
+	s.scaleMu.Lock()
+	s.live--
+	obs.DispatcherWorkers.Set(float64(s.live))
+	s.scaleMu.Unlock()
+}
+
+// observeWait records a dequeued job's queue wait for the next resize check.
+func (s *Server) observeWait(d time.Duration) {
+	if s.scale == nil {
+		return
+	}
+	s.waitsMu.Lock()
+	if len(s.waits) < maxWaitSamples {
+		s.waits = append(s.waits, d)
+	}
+	s.waitsMu.Unlock()
+}
+
+// Workers returns the number of running workers and the size the pool is
+// converging on; they differ while retired workers finish their jobs.
+func (s *Server) Workers() (live, target int) {
+	s.scaleMu.Lock()
+	defer s.scaleMu.Unlock()
+	return s.live, s.target
+}
+
+// autoscale resizes the pool every Interval until Shutdown.
+func (s *Server) autoscale() {
+	t := time.NewTicker(s.scale.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stopCtx.Done():
+			return
+		case now := <-t.C:
+			s.resize(now)
+		}
+	}
+}
+
+// resize applies one scaling decision from the queue waits observed since
+// the previous call and the current queue depth.
+func (s *Server) resize(now time.Time) {
+	c := s.scale
+
+	s.waitsMu.Lock()
+	waits := s.waits
+	s.waits = nil
+	s.waitsMu.Unlock()
+	p95 := percentile(waits, 0.95)
+	depth := s.queue.stats().Len
+	busy := int(s.busy.Load())
+
+	s.scaleMu.Lock()
+	defer s.scaleMu.Unlock()
+	if s.stopping {
+		return
+	}
+	cur := s.target
+
+	depthLimit := c.QueueDepth
+	if depthLimit <= 0 {
+		depthLimit = cur
+	}
+	reason := ""
+	switch {
+	case c.QueueWaitP95 > 0 && p95 >= c.QueueWaitP95:
+		reason = "queue_wait"
+	case depth >= depthLimit && depth > 0:
+		reason = "queue_depth"
+	}
+	if reason != "" {
+		s.idleSince = time.Time{}
+		if cur >= c.MaxWorkers {
+			return
+		}
+		next := min(c.MaxWorkers, cur+max(1, cur/2))
+		s.setTargetLocked(next, "up", reason)
+		log.Printf(`msg="dispatcher scaled" direction=up from=%d to=%d reason=%s queue_wait_p95=%s queue_len=%d`, cur, next, reason, p95, depth)
+		return
+	}
+
+	if depth > 0 || busy > cur/2 {
+		s.idleSince = time.Time{}
+		return
+	}
+	if s.idleSince.IsZero() {
+		s.idleSince = now
+		return
+	}
+	if now.Sub(s.idleSince) < c.IdleAfter || cur <= c.MinWorkers {
+		return
+	}
+	next := max(c.MinWorkers, busy, cur-max(1, (cur-busy)/2))
+	s.idleSince = now // wait another IdleAfter before shrinking again
+	if next < cur {
+		s.setTargetLocked(next, "down", "idle")
+		log.Printf(`msg="dispatcher scaled" direction=down from=%d to=%d reason=idle busy=%d`, cur, next, busy)
+	}
+}
+
+// setTargetLocked moves the pool towards n workers: growing first cancels
+// pending retirements, shrinking retires idle workers as they free up.
+// Callers hold scaleMu.
+func (s *Server) setTargetLocked(n int, direction, reason string) {
+	if diff := n - s.target; diff > 0 {
+		s.spawnLocked(diff - s.queue.unretire(diff))
+	} else if diff < 0 {
+		s.queue.retire(-diff)
+	}
+	s.target = n
+	obs.DispatcherWorkerTarget.Set(float64(n))
+	obs.DispatcherScaleEvents.WithLabelValues(direction, reason).Inc()
+}
+
+// percentile returns the p-th quantile of ds (nearest rank), or 0.
+func percentile(ds []time.Duration, p float64) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	slices.Sort(ds)
+	i := int(float64(len(ds))*p+0.5) - 1
+	return ds[min(max(i, 0), len(ds)-1)]
+}
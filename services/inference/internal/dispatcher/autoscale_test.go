@@ -0,0 +1,77 @@
+package dispatcher
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAutoscale_GrowsOnBacklogAndShrinksWhenIdle(t *testing.T) {
+	release := make(chan struct{})
+	provider := func(ctx context.Context, req InferenceRequest) (string, string, int, error) {
+		<-release
+		return "ok", "fake", 1, nil
+	}
+	// A long Interval keeps the background loop out of the way; the test
+	// drives resize itself.
+	s := New(10, 1, provider, WithAutoscale(AutoscaleConfig{MinWorkers: 1, MaxWorkers: 4, QueueDepth: 2, IdleAfter: time.Minute, Interval: time.Hour}))
+	defer s.Shutdown(context.Background())
+
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+
+	replies := make(chan InferenceResult, 3)
+	for range 3 {
+		if _, err := s.TryEnqueue(InferenceJob{Req: InferenceRequest{Prompt: "hi", Model: "m"}, Ctx: context.Background(), ReplyCh: replies, EnqueuedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor("the first job to start", func() bool { return s.busy.Load() == 1 })
+
+	now := time.Now()
+	s.resize(now) // 2 queued >= QueueDepth
+	if live, target := s.Workers(); live != 2 || target != 2 {
+		t.Fatalf("after backlog: live=%d target=%d, want 2 2", live, target)
+	}
+
+	s.observeWait(time.Second) // p95 over the default 250ms
+	s.resize(now)
+	if _, target := s.Workers(); target != 3 {
+		t.Fatalf("after slow queue wait: target=%d, want 3", target)
+	}
+
+	close(release)
+	for range 3 {
+		<-replies
+	}
+	waitFor("the workers to go idle", func() bool { return s.busy.Load() == 0 })
+
+	s.resize(now) // starts the idle period
+	if _, target := s.Workers(); target != 3 {
+		t.Fatalf("shrank before IdleAfter: target=%d", target)
+	}
+	s.resize(now.Add(time.Minute))
+	waitFor("a worker to retire", func() bool { live, target := s.Workers(); return live == 2 && target == 2 })
+	s.resize(now.Add(2 * time.Minute))
+	s.resize(now.Add(3 * time.Minute))
+	waitFor("the pool to reach its floor", func() bool { live, target := s.Workers(); return live == 1 && target == 1 })
+}
+
+func TestPercentile(t *testing.T) {
+	var ds []time.Duration
+	for i := 1; i <= 100; i++ {
+		ds = append(ds, time.Duration(i)*time.Millisecond)
+	}
+	if got := percentile(ds, 0.95); got != 95*time.Millisecond {
+		t.Fatalf("p95 = %s", got)
+	}
+	if got := percentile(nil, 0.95); got != 0 {
+		t.Fatalf("p95 of nothing = %s", got)
+	}
+}
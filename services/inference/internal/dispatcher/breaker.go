@@ -0,0 +1,191 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/obs"
+)
+
+// ErrCircuitOpen is wrapped by CircuitOpenError; the API maps it to 503.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// CircuitOpenError is returned without calling the provider while the
+// circuit for a provider+model is open.
+type CircuitOpenError struct {
+	Provider   string
+	Model      string
+	RetryAfter time.Duration // until the circuit lets a probe through
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit open for %s/%s; retry in %s", e.Provider, e.Model, e.RetryAfter.Round(time.Second))
+}
+
+func (e *CircuitOpenError) Unwrap() error { return ErrCircuitOpen }
+
+// BreakerConfig sets the circuit breaker thresholds. A zero FailureThreshold
+// disables the breaker.
+type BreakerConfig struct {
+	FailureThreshold int           // consecutive failures that open the circuit
+	OpenFor          time.Duration // how long an open circuit rejects calls before probing
+	HalfOpenProbes   int           // concurrent trial calls allowed while half-open (default 1)
+}
+
+type breakerState int
+
+// Gauge values of inference_circuit_state.
+const (
+	stateClosed breakerState = iota
+	stateHalfOpen
+	stateOpen
+)
+
+type breakerKey struct {
+	provider string // req.Provider; empty when routed by model prefix
+	model    string
+}
+
+type circuit struct {
+	state     breakerState
+	failures  int
+	openUntil time.Time
+	probes    int    // in-flight calls while half-open
+	label     string // provider label for metrics, learned from results
+}
+
+// CircuitBreaker tracks one circuit per provider+model and wraps provider
+// functions so calls to a failing backend fail fast instead of piling up.
+type CircuitBreaker struct {
+	cfg BreakerConfig
+	now func() time.Time
+
+	mu       sync.Mutex
+	circuits map[breakerKey]*circuit
+}
+
+func NewCircuitBreaker(cfg BreakerConfig) *CircuitBreaker {
+	if cfg.HalfOpenProbes < 1 {
+		cfg.HalfOpenProbes = 1
+	}
+	return &CircuitBreaker{cfg: cfg, now: time.Now, circuits: map[breakerKey]*circuit{}}
+}
+
+// WithCircuitBreaker guards the provider (and stream provider) with cb.
+func WithCircuitBreaker(cb *CircuitBreaker) Option {
+	return func(s *Server) { s.breaker = cb }
+}
+
+// Wrap returns a ProviderFunc that consults the breaker around next.
+func (cb *CircuitBreaker) Wrap(next ProviderFunc) ProviderFunc {
+	return func(ctx context.Context, req InferenceRequest) (string, string, int, error) {
+		key, err := cb.allow(req)
+		if err != nil {
+			return "", req.Provider, 0, err
+		}
+		text, provider, tokens, err := next(ctx, req)
+		cb.record(key, provider, err)
+		return text, provider, tokens, err
+	}
+}
+
+// WrapStream is Wrap for stream providers.
+func (cb *CircuitBreaker) WrapStream(next StreamProviderFunc) StreamProviderFunc {
+	return func(ctx context.Context, req InferenceRequest, onDelta func(string) error) (string, int, error) {
+		key, err := cb.allow(req)
+		if err != nil {
+			return req.Provider, 0, err
+		}
+		provider, tokens, err := next(ctx, req, onDelta)
+		cb.record(key, provider, err)
+		return provider, tokens, err
+	}
+}
+
+func (cb *CircuitBreaker) allow(req InferenceRequest) (breakerKey, error) {
+	key := breakerKey{provider: req.Provider, model: req.Model}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	c := cb.circuits[key]
+	if c == nil {
+		c = &circuit{label: req.Provider}
+		cb.circuits[key] = c
+	}
+
+	now := cb.now()
+	if c.state == stateOpen && !now.Before(c.openUntil) {
+		cb.setState(key, c, stateHalfOpen)
+	}
+	switch c.state {
+	case stateOpen:
+		return key, &CircuitOpenError{Provider: c.labelOr(), Model: req.Model, RetryAfter: c.openUntil.Sub(now)}
+	case stateHalfOpen:
+		if c.probes >= cb.cfg.HalfOpenProbes {
+			return key, &CircuitOpenError{Provider: c.labelOr(), Model: req.Model, RetryAfter: cb.cfg.OpenFor}
+		}
+		c.probes++
+	}
+	return key, nil
+}
+
+func (cb *CircuitBreaker) record(key breakerKey, provider string, err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	c := cb.circuits[key]
+	if provider != "" {
+		c.label = provider
+	}
+	if c.state == stateOpen {
+		return // a call admitted before the circuit opened; its outcome is stale
+	}
+	if c.state == stateHalfOpen && c.probes > 0 {
+		c.probes--
+	}
+	if errors.Is(err, context.Canceled) {
+		return // the caller left; says nothing about the backend either way
+	}
+
+	if !breakerFailure(err) {
+		c.failures = 0
+		if c.state != stateClosed {
+			cb.setState(key, c, stateClosed)
+		}
+		return
+	}
+
+	c.failures++
+	if c.state == stateHalfOpen || c.failures >= cb.cfg.FailureThreshold {
+		c.openUntil = cb.now().Add(cb.cfg.OpenFor)
+		cb.setState(key, c, stateOpen)
+	}
+}
+
+// breakerFailure reports whether err counts against the backend's health.
+// Client errors do not; cancelled calls are neutral and never get here.
+func breakerFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Is(err, context.DeadlineExceeded) || Retryable(err)
+}
+
+func (cb *CircuitBreaker) setState(key breakerKey, c *circuit, st breakerState) {
+	c.state = st
+	if st != stateHalfOpen {
+		c.probes = 0
+	}
+	obs.CircuitState.WithLabelValues(c.labelOr(), key.model).Set(float64(st))
+}
+
+func (c *circuit) labelOr() string {
+	if c.label == "" {
+		return "unknown"
+	}
+	return c.label
+}
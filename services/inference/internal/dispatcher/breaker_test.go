@@ -0,0 +1,106 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker_OpensHalfOpensAndCloses(t *testing.T) {
+	now := time.Unix(0, 0)
+	cb := NewCircuitBreaker(BreakerConfig{FailureThreshold: 2, OpenFor: 10 * time.Second})
+	cb.now = func() time.Time { return now }
+
+	fail := true
+	calls := 0
+	call := cb.Wrap(func(ctx context.Context, req InferenceRequest) (string, string, int, error) {
+		calls++
+		if fail {
+			return "", "fake", 0, &ProviderError{Provider: "fake", StatusCode: http.StatusServiceUnavailable, Message: "down"}
+		}
+		return "ok", "fake", 1, nil
+	})
+	req := InferenceRequest{Prompt: "hi", Model: "m"}
+
+	for range 2 {
+		if _, _, _, err := call(context.Background(), req); errors.Is(err, ErrCircuitOpen) {
+			t.Fatal("circuit opened before the threshold")
+		}
+	}
+
+	_, _, _, err := call(context.Background(), req)
+	var coe *CircuitOpenError
+	if !errors.As(err, &coe) || coe.RetryAfter != 10*time.Second || calls != 2 {
+		t.Fatalf("want fast failure while open, got err=%v calls=%d", err, calls)
+	}
+
+	// Other models keep their own circuit.
+	if _, _, _, err := call(context.Background(), InferenceRequest{Prompt: "hi", Model: "other"}); errors.Is(err, ErrCircuitOpen) {
+		t.Fatal("unrelated model was rejected")
+	}
+
+	now = now.Add(10 * time.Second)
+	fail = false
+	if _, _, _, err := call(context.Background(), req); err != nil {
+		t.Fatalf("half-open probe: %v", err)
+	}
+	if _, _, _, err := call(context.Background(), req); err != nil {
+		t.Fatalf("closed after probe: %v", err)
+	}
+}
+
+func TestCircuitBreaker_IgnoresClientErrors(t *testing.T) {
+	cb := NewCircuitBreaker(BreakerConfig{FailureThreshold: 1, OpenFor: time.Minute})
+	call := cb.Wrap(func(ctx context.Context, req InferenceRequest) (string, string, int, error) {
+		return "", "fake", 0, &ProviderError{Provider: "fake", StatusCode: http.StatusBadRequest, Message: "bad"}
+	})
+	req := InferenceRequest{Prompt: "hi", Model: "m"}
+	for range 3 {
+		if _, _, _, err := call(context.Background(), req); errors.Is(err, ErrCircuitOpen) {
+			t.Fatal("4xx responses must not open the circuit")
+		}
+	}
+}
+
+func TestCircuitBreaker_CancelledCallsAreNeutral(t *testing.T) {
+	now := time.Unix(0, 0)
+	cb := NewCircuitBreaker(BreakerConfig{FailureThreshold: 2, OpenFor: 10 * time.Second})
+	cb.now = func() time.Time { return now }
+
+	var next error
+	call := cb.Wrap(func(ctx context.Context, req InferenceRequest) (string, string, int, error) {
+		return "", "fake", 0, next
+	})
+	req := InferenceRequest{Prompt: "hi", Model: "m"}
+	timeout := &ProviderError{Provider: "fake", StatusCode: http.StatusGatewayTimeout, Message: "slow"}
+
+	// Cancellations between failures do not reset the count.
+	for _, err := range []error{timeout, context.Canceled, timeout} {
+		next = err
+		_, _, _, _ = call(context.Background(), req)
+	}
+	next = nil
+	if _, _, _, err := call(context.Background(), req); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("err = %v, want the circuit open after two failures", err)
+	}
+
+	// A cancelled half-open probe frees its slot but leaves the circuit half-open.
+	now = now.Add(10 * time.Second)
+	next = context.Canceled
+	if _, _, _, err := call(context.Background(), req); !errors.Is(err, context.Canceled) {
+		t.Fatalf("probe err = %v", err)
+	}
+	key := breakerKey{model: "m"}
+	if c := cb.circuits[key]; c.state != stateHalfOpen || c.probes != 0 {
+		t.Fatalf("after cancelled probe: state=%d probes=%d, want half-open with a free slot", c.state, c.probes)
+	}
+	next = timeout
+	if _, _, _, err := call(context.Background(), req); errors.Is(err, ErrCircuitOpen) {
+		t.Fatal("next probe was not let through")
+	}
+	if c := cb.circuits[key]; c.state != stateOpen {
+		t.Fatalf("failed probe: state=%d, want open", c.state)
+	}
+}
@@ -0,0 +1,149 @@
+package dispatcher
+
+import (
+	"context"
+	"time"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/obs"
+)
+
+// WithCoalescing makes identical non-streamed requests that are queued or
+// running at the same time share one provider call; every caller gets the
+// same InferenceResult on its own ReplyCh.
+func WithCoalescing() Option {
+	return func(s *Server) { s.flights = map[string]*flight{} }
+}
+
+// flight is one shared provider call and the jobs waiting for it.
+type flight struct {
+	key     string
+	cancel  context.CancelFunc
+	waiters map[*waiter]struct{}
+	started bool
+	landed  bool
+}
+
+type waiter struct {
+	replyCh    chan InferenceResult
+	enqueuedAt time.Time
+	onStart    func()
+	settle     func(InferenceResult)
+	stop       func() bool // unregisters the cancellation hook
+}
+
+// flightKey also covers the cache mode: a CacheSkip request must not be
+// answered by a CacheForce call that may come from the cache.
+func flightKey(job InferenceJob) string {
+	return job.Priority.String() + ":" + job.Req.Cache + ":" + job.Req.Fingerprint()
+}
+
+// enqueueCoalesced attaches job to an identical queued or running request,
+// or enqueues a new shared flight for it.
+func (s *Server) enqueueCoalesced(job InferenceJob) (QueueStats, error) {
+	key := flightKey(job)
+
+	s.flightsMu.Lock()
+	defer s.flightsMu.Unlock()
+
+	if f, ok := s.flights[key]; ok {
+		s.addWaiter(f, job)
+		obs.DedupRequests.WithLabelValues("joined").Inc()
+		return s.queue.stats(), nil
+	}
+
+	// The shared call outlives any single caller: it has no deadline of its
+	// own, since later waiters may allow longer than the first, and is only
+	// cancelled once every waiter has gone away.
+	ctx, cancel := context.WithCancel(context.WithoutCancel(job.Ctx))
+	f := &flight{key: key, cancel: cancel, waiters: map[*waiter]struct{}{}}
+
+	leader := job
+	leader.Ctx = ctx
+	leader.ReplyCh = nil
+	leader.OnStart = nil
+	leader.settle = nil // each waiter settles its own reply
+	leader.flight = f
+	stats, err := s.queue.tryPush(leader)
+	if err != nil {
+		cancel()
+		return stats, err
+	}
+
+	s.flights[key] = f
+	s.addWaiter(f, job)
+	obs.DedupRequests.WithLabelValues("leader").Inc()
+	return stats, nil
+}
+
+// addWaiter registers job on f. A waiter whose context ends is answered with
+// its own error and dropped; the last one leaving cancels the shared call.
+// Callers hold flightsMu.
+func (s *Server) addWaiter(f *flight, job InferenceJob) {
+	w := &waiter{replyCh: job.ReplyCh, enqueuedAt: job.EnqueuedAt, onStart: job.OnStart, settle: job.settle}
+	f.waiters[w] = struct{}{}
+	if f.started && w.onStart != nil {
+		w.onStart()
+	}
+
+	jobCtx := job.Ctx
+	w.stop = context.AfterFunc(jobCtx, func() {
+		s.flightsMu.Lock()
+		defer s.flightsMu.Unlock()
+		if f.landed {
+			return
+		}
+		delete(f.waiters, w)
+		res := InferenceResult{Err: jobCtx.Err()}
+		if w.settle != nil {
+			w.settle(res)
+		}
+		select {
+		case w.replyCh <- res:
+		default:
+		}
+		if len(f.waiters) == 0 {
+			delete(s.flights, f.key)
+			f.cancel()
+		}
+	})
+}
+
+// flightStarted runs the OnStart hooks of everyone waiting on f.
+func (s *Server) flightStarted(f *flight) {
+	s.flightsMu.Lock()
+	defer s.flightsMu.Unlock()
+	f.started = true
+	for w := range f.waiters {
+		if w.onStart != nil {
+			w.onStart()
+		}
+	}
+}
+
+// land delivers res to every remaining waiter of f.
+func (s *Server) land(f *flight, res InferenceResult) {
+	s.flightsMu.Lock()
+	f.landed = true
+	if s.flights[f.key] == f {
+		delete(s.flights, f.key)
+	}
+	waiters := f.waiters
+	f.waiters = nil
+	s.flightsMu.Unlock()
+
+	f.cancel()
+	shared := false
+	for w := range waiters {
+		w.stop()
+		r := res
+		r.Shared = shared
+		shared = true
+		if !r.StartedAt.IsZero() {
+			r.QueueWait = max(0, r.StartedAt.Sub(w.enqueuedAt))
+		}
+		if w.settle != nil {
+			w.settle(r)
+		}
+		w.replyCh <- r
+	}
+}
@@ -0,0 +1,194 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalescing_SharesOneCall(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	provider := func(ctx context.Context, req InferenceRequest) (string, string, int, error) {
+		calls.Add(1)
+		select {
+		case <-release:
+			return "shared", "fake", 3, nil
+		case <-ctx.Done():
+			return "", "fake", 0, ctx.Err()
+		}
+	}
+	s := New(10, 4, provider, WithCoalescing())
+	defer s.Shutdown(context.Background())
+
+	req := InferenceRequest{Prompt: "demo", Model: "m"}
+	cancelled, cancel := context.WithCancel(context.Background())
+	ctxs := []context.Context{context.Background(), cancelled, context.Background()}
+	replies := make([]chan InferenceResult, len(ctxs))
+	for i, ctx := range ctxs {
+		replies[i] = make(chan InferenceResult, 1)
+		if _, err := s.TryEnqueue(InferenceJob{Req: req, Ctx: ctx, ReplyCh: replies[i], EnqueuedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// One waiter leaving must not cancel the shared call for the others.
+	cancel()
+	if res := <-replies[1]; !errors.Is(res.Err, context.Canceled) {
+		t.Fatalf("cancelled waiter got %+v", res)
+	}
+	close(release)
+
+	for _, i := range []int{0, 2} {
+		res := <-replies[i]
+		if res.Err != nil || res.Text != "shared" {
+			t.Fatalf("waiter %d got %+v", i, res)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("provider called %d times, want 1", n)
+	}
+
+	// The flight is gone once it lands; a new request makes a new call.
+	ch := make(chan InferenceResult, 1)
+	if _, err := s.TryEnqueue(InferenceJob{Req: req, Ctx: context.Background(), ReplyCh: ch, EnqueuedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	<-ch
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("provider called %d times after landing, want 2", n)
+	}
+}
+
+func TestCoalescing_LastWaiterLeavingCancelsCall(t *testing.T) {
+	started := make(chan struct{})
+	stopped := make(chan error, 1)
+	provider := func(ctx context.Context, req InferenceRequest) (string, string, int, error) {
+		close(started)
+		<-ctx.Done()
+		stopped <- ctx.Err()
+		return "", "fake", 0, ctx.Err()
+	}
+	s := New(10, 1, provider, WithCoalescing())
+	defer s.Shutdown(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan InferenceResult, 1)
+	if _, err := s.TryEnqueue(InferenceJob{Req: InferenceRequest{Prompt: "x", Model: "m"}, Ctx: ctx, ReplyCh: ch}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	cancel()
+
+	select {
+	case err := <-stopped:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("provider ctx err = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("shared call kept running with no waiters left")
+	}
+}
+
+func TestCoalescing_FlightOutlivesFirstDeadline(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	provider := func(ctx context.Context, req InferenceRequest) (string, string, int, error) {
+		calls.Add(1)
+		select {
+		case <-release:
+			return "shared", "fake", 3, nil
+		case <-ctx.Done():
+			return "", "fake", 0, ctx.Err()
+		}
+	}
+	s := New(10, 2, provider, WithCoalescing())
+	defer s.Shutdown(context.Background())
+
+	req := InferenceRequest{Prompt: "demo", Model: "m"}
+	short, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	first, second := make(chan InferenceResult, 1), make(chan InferenceResult, 1)
+	for _, j := range []struct {
+		ctx context.Context
+		ch  chan InferenceResult
+	}{{short, first}, {context.Background(), second}} {
+		if _, err := s.TryEnqueue(InferenceJob{Req: req, Ctx: j.ctx, ReplyCh: j.ch, EnqueuedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if res := <-first; !errors.Is(res.Err, context.DeadlineExceeded) {
+		t.Fatalf("short waiter got %+v", res)
+	}
+	close(release)
+	if res := <-second; res.Err != nil || res.Text != "shared" {
+		t.Fatalf("later waiter got %+v, want the shared result after the first deadline", res)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("provider called %d times, want 1", n)
+	}
+}
+
+func TestCoalescing_KeysOnCacheMode(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	provider := func(ctx context.Context, req InferenceRequest) (string, string, int, error) {
+		calls.Add(1)
+		<-release
+		return req.Cache, "fake", 1, nil
+	}
+	s := New(10, 2, provider, WithCoalescing())
+	defer s.Shutdown(context.Background())
+
+	var replies []chan InferenceResult
+	for _, mode := range []string{CacheForce, CacheSkip} {
+		ch := make(chan InferenceResult, 1)
+		req := InferenceRequest{Prompt: "demo", Model: "m", Cache: mode}
+		if _, err := s.TryEnqueue(InferenceJob{Req: req, Ctx: context.Background(), ReplyCh: ch, EnqueuedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		replies = append(replies, ch)
+	}
+	close(release)
+	if res := <-replies[1]; res.Text != CacheSkip {
+		t.Fatalf("skip request got %+v, want its own call", res)
+	}
+	<-replies[0]
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("provider called %d times, want 2", n)
+	}
+}
+
+func TestCoalescing_OneWaiterIsCharged(t *testing.T) {
+	release := make(chan struct{})
+	provider := func(ctx context.Context, req InferenceRequest) (string, string, int, error) {
+		<-release
+		return "shared", "fake", 3, nil
+	}
+	settled := make(chan bool, 3)
+	gate := func(job InferenceJob) (func(InferenceResult), error) {
+		return func(r InferenceResult) { settled <- r.Shared }, nil
+	}
+	s := New(10, 2, provider, WithCoalescing(), WithGate(gate))
+	defer s.Shutdown(context.Background())
+
+	for range 3 {
+		ch := make(chan InferenceResult, 1)
+		if _, err := s.TryEnqueue(InferenceJob{Req: InferenceRequest{Prompt: "demo", Model: "m"}, Ctx: context.Background(), ReplyCh: ch, EnqueuedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(release)
+	charged := 0
+	for range 3 {
+		if !<-settled {
+			charged++
+		}
+	}
+	if charged != 1 {
+		t.Fatalf("%d waiters settled an unshared result, want 1", charged)
+	}
+}
@@ -0,0 +1,74 @@
+package dispatcher
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ConcurrencyLimits caps in-flight provider calls per model. A key is either
+// an exact model ID or a prefix ending in "/" (e.g. "gemini/"), which caps a
+// whole provider; all models matching a prefix share its slots.
+type ConcurrencyLimits map[string]int
+
+// rule returns the key whose semaphore a model uses and its limit, or
+// ("", 0) when the model is unlimited. Exact IDs win over the longest prefix.
+func (l ConcurrencyLimits) rule(model string) (string, int) {
+	if n, ok := l[model]; ok && n > 0 {
+		return model, n
+	}
+	best := ""
+	for k, n := range l {
+		if n > 0 && strings.HasSuffix(k, "/") && strings.HasPrefix(model, k) && len(k) > len(best) {
+			best = k
+		}
+	}
+	if best == "" {
+		return "", 0
+	}
+	return best, l[best]
+}
+
+// ParseConcurrencyLimits parses "openrouter-model:free=2,gemini/=8".
+func ParseConcurrencyLimits(s string) (ConcurrencyLimits, error) {
+	out := ConcurrencyLimits{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i := strings.LastIndex(part, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("bad concurrency limit %q (want model=n)", part)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(part[i+1:]))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("bad concurrency limit %q (want a positive integer)", part)
+		}
+		out[strings.TrimSpace(part[:i])] = n
+	}
+	return out, nil
+}
+
+// Merge returns l overlaid with other; other wins on conflicts.
+func (l ConcurrencyLimits) Merge(other ConcurrencyLimits) ConcurrencyLimits {
+	out := make(ConcurrencyLimits, len(l)+len(other))
+	for k, n := range l {
+		out[k] = n
+	}
+	for k, n := range other {
+		out[k] = n
+	}
+	return out
+}
+
+// WithConcurrencyLimits sets the initial per-model limits.
+func WithConcurrencyLimits(l ConcurrencyLimits) Option {
+	return func(s *Server) { s.limits = l }
+}
+
+// SetConcurrencyLimits swaps the per-model limits at runtime, e.g. after the
+// model catalog is reloaded. Jobs already running are not interrupted.
+func (s *Server) SetConcurrencyLimits(l ConcurrencyLimits) {
+	s.queue.setLimits(l)
+}
@@ -0,0 +1,74 @@
+package dispatcher
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimits_SaturatedModelDoesNotBlockOthers(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan string, 4)
+	provider := func(ctx context.Context, req InferenceRequest) (string, string, int, error) {
+		started <- req.Model
+		if req.Model == "slow" {
+			<-release
+		}
+		return "ok", "fake", 0, nil
+	}
+	s := New(10, 2, provider, WithConcurrencyLimits(ConcurrencyLimits{"slow": 1}))
+	defer s.Shutdown(context.Background())
+
+	enqueue := func(model string) chan InferenceResult {
+		ch := make(chan InferenceResult, 1)
+		if _, err := s.TryEnqueue(InferenceJob{Req: InferenceRequest{Prompt: "hi", Model: model}, Ctx: context.Background(), ReplyCh: ch}); err != nil {
+			t.Fatal(err)
+		}
+		return ch
+	}
+
+	slow1 := enqueue("slow")
+	if m := <-started; m != "slow" {
+		t.Fatalf("first started %q", m)
+	}
+	slow2 := enqueue("slow")
+	fast := enqueue("fast")
+
+	select {
+	case <-fast:
+	case <-time.After(time.Second):
+		t.Fatal("fast model was blocked behind the saturated one")
+	}
+	select {
+	case m := <-started:
+		if m != "fast" {
+			t.Fatalf("second slow job started while the first held the only slot")
+		}
+	default:
+	}
+
+	close(release)
+	<-slow1
+	<-slow2
+}
+
+func TestConcurrencyLimits_Rule(t *testing.T) {
+	l, err := ParseConcurrencyLimits("gemini/=8, gemini/gemini-2.5-pro=2, x:free=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"gemini/gemini-2.5-pro":   "gemini/gemini-2.5-pro",
+		"gemini/gemini-2.5-flash": "gemini/",
+		"x:free":                  "x:free",
+		"other":                   "",
+	}
+	for model, want := range cases {
+		if got, _ := l.rule(model); got != want {
+			t.Errorf("rule(%q) = %q, want %q", model, got, want)
+		}
+	}
+	if _, err := ParseConcurrencyLimits("m=0"); err == nil {
+		t.Fatal("expected error for zero limit")
+	}
+}
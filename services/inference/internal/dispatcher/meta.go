@@ -0,0 +1,61 @@
+package dispatcher
+
+import "context"
+
+// ResultMeta holds optional per-call details a provider can report beyond the
+// ProviderFunc return values. The worker installs one in the call context;
+// providers fill it through MetaFromContext.
+type ResultMeta struct {
+	PromptTokens     int     `json:"prompt_tokens,omitempty"`
+	CompletionTokens int     `json:"completion_tokens,omitempty"`
+	FinishReason     string  `json:"finish_reason,omitempty"` // provider's own vocabulary, e.g. "end_turn"
+	Cached           bool    `json:"cached,omitempty"`        // served from the response cache
+	Safety           *Safety `json:"safety,omitempty"`        // nil unless the provider reports one
+
+	// Guardrails lists the pre-inference checks that flagged, rewrote or
+	// refused the request, in the order they ran.
+	Guardrails []GuardrailDecision `json:"guardrails,omitempty"`
+}
+
+// Safety is a provider's safety verdict on one call, kept for audits of
+// refusal behaviour. Names are the provider's own, e.g. Gemini's
+// "HARM_CATEGORY_HARASSMENT" / "NEGLIGIBLE".
+type Safety struct {
+	PromptBlockReason string         `json:"prompt_block_reason,omitempty"` // set when the prompt was refused outright
+	PromptRatings     []SafetyRating `json:"prompt_ratings,omitempty"`
+	ResponseRatings   []SafetyRating `json:"response_ratings,omitempty"`
+}
+
+// SafetyRating is one harm category's classification.
+type SafetyRating struct {
+	Category    string `json:"category"`
+	Probability string `json:"probability,omitempty"`
+	Severity    string `json:"severity,omitempty"`
+	Blocked     bool   `json:"blocked,omitempty"` // content was withheld because of this rating
+}
+
+// GuardrailDecision is one guardrail's verdict on a request, kept for audits.
+// Detail never repeats redacted content.
+type GuardrailDecision struct {
+	Guardrail string `json:"guardrail"`
+	Action    string `json:"action"` // allow, modify or reject
+	Reason    string `json:"reason,omitempty"`
+	Detail    string `json:"detail,omitempty"` // e.g. "email=1 card=2"
+}
+
+type metaKey struct{}
+
+// WithResultMeta returns a context carrying a fresh ResultMeta.
+func WithResultMeta(ctx context.Context) (context.Context, *ResultMeta) {
+	m := &ResultMeta{}
+	return context.WithValue(ctx, metaKey{}, m), m
+}
+
+// MetaFromContext returns the ResultMeta installed by the worker, or a
+// throwaway one so providers can write to it unconditionally.
+func MetaFromContext(ctx context.Context) *ResultMeta {
+	if m, ok := ctx.Value(metaKey{}).(*ResultMeta); ok {
+		return m
+	}
+	return &ResultMeta{}
+}
@@ -3,15 +3,28 @@ package dispatcher
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/obs"
 )
 
 type InferenceRequest struct {
-	Prompt string `json:"prompt"`
-	Model  string `json:"model"`
+	Prompt   string    `json:"prompt,omitempty"`   // shorthand for a single user turn
+	Messages []Message `json:"messages,omitempty"` // ordered system/user/assistant turns
+	Model    string    `json:"model"`
+	Provider string    `json:"provider,omitempty"` // explicit backend; overrides model-prefix routing
+
+	Params GenerationParams `json:"params,omitzero"`
+
+	// Cache overrides the response cache policy: "force" caches even
+	// non-deterministic requests, "skip" neither reads nor writes the cache.
+	Cache string `json:"cache,omitempty"`
 }
 
 type InferenceResult struct {
@@ -25,6 +38,20 @@ type InferenceResult struct {
 
 	QueueWait time.Duration
 	ExecTime  time.Duration
+
+	// FirstTokenAt is set for streamed jobs when the first delta was delivered.
+	FirstTokenAt time.Time
+
+	Meta ResultMeta // optional provider-reported details
+
+	// Model is the model that produced the result; it differs from the
+	// requested one when a fallback answered.
+	Model    string
+	Attempts []Attempt // every provider call made, in order
+
+	// Shared marks the copies of a coalesced result that every waiter but
+	// one receives; the provider call is accounted to that one.
+	Shared bool
 }
 
 type InferenceJob struct {
@@ -32,107 +59,506 @@ type InferenceJob struct {
 	Ctx        context.Context
 	ReplyCh    chan InferenceResult
 	EnqueuedAt time.Time
+
+	// DeltaCh, when non-nil, turns this into a streamed job: the worker sends
+	// each text delta here before the final result is sent on ReplyCh.
+	// Use an unbuffered channel so every delta is received before the reply.
+	DeltaCh chan string
+
+	// Key identifies the client for fair queueing; jobs with an empty key
+	// share one lane. Every new key gets its own lane, so it must come from
+	// something the client cannot vary per request (a verified identity or
+	// the connecting address), not from an unverified header.
+	Key      string
+	Priority Priority
+
+	// BudgetKey identifies the caller for per-user budgets. Like Key it
+	// must not be something the client can pick freely, such as a header;
+	// jobs without one are only held to provider budgets.
+	BudgetKey string
+
+	// RequestID ties the job to the caller's logs and usage ledger entry.
+	RequestID string
+
+	// OnStart, if set, is called when a worker picks the job up. It runs on
+	// the worker goroutine and must return quickly.
+	OnStart func()
+
+	slot    string                // concurrency limit key taken when the job was dequeued
+	flight  *flight               // set when the job runs on behalf of coalesced callers
+	settle  func(InferenceResult) // from the Gate; called with the job's reply
+	seq     uint64                // queue position, to find it again when it expires
+	unwatch func() bool           // stops the expiry hook once the job leaves the queue
 }
 
 // ProviderFunc lets you swap real providers / stubs / test doubles.
 type ProviderFunc func(ctx context.Context, req InferenceRequest) (text, provider string, tokenUsage int, err error)
 
+// Middleware wraps a ProviderFunc, e.g. with a cache or guardrails.
+type Middleware func(next ProviderFunc) ProviderFunc
+
+// Gate admits or rejects a job in TryEnqueue, before it is queued; its error
+// is returned from TryEnqueue as is. An admitted job's settle func (if not
+// nil) is called exactly once with the result the caller receives, which
+// includes queue-full and cancellation errors. settle must not block.
+type Gate func(job InferenceJob) (settle func(InferenceResult), err error)
+
+// StreamProviderFunc is the streaming variant of ProviderFunc. It calls onDelta
+// for every chunk of generated text; returning an error from onDelta aborts the call.
+type StreamProviderFunc func(ctx context.Context, req InferenceRequest, onDelta func(delta string) error) (provider string, tokenUsage int, err error)
+
+// StreamMiddleware is Middleware for the stream provider.
+type StreamMiddleware func(next StreamProviderFunc) StreamProviderFunc
+
 type Server struct {
 	// Concurrency / lifecycle
-	jobQueue chan InferenceJob
+	queue    *fairQueue
+	queueCfg QueueConfig
+	limits   ConcurrencyLimits
 	wg       sync.WaitGroup
+	stopCtx  context.Context // cancelled when Shutdown gives up draining
+	stop     context.CancelFunc
+
+	// Pool size; see autoscale.go
+	scale     *AutoscaleConfig // nil = fixed pool
+	scaleMu   sync.Mutex
+	live      int // running workers
+	target    int // live minus pending retirements
+	nextID    int
+	stopping  bool
+	idleSince time.Time // owned by resize
+	busy      atomic.Int64
+	waitsMu   sync.Mutex
+	waits     []time.Duration // queue waits since the last resize
 
 	// Transport
 	client *http.Client
 
 	// Request behavior
 	provider ProviderFunc
+	streamer StreamProviderFunc // optional; streamed jobs fall back to provider
+	retry    RetryPolicy
+	breaker  *CircuitBreaker // optional
+	mw       []Middleware
+	streamMW []StreamMiddleware
+	onResult func(InferenceJob, InferenceResult) // optional
+	gate     Gate                                // optional
+	admit    *execStats                          // nil unless admission control is on
+
+	flightsMu sync.Mutex
+	flights   map[string]*flight // nil unless coalescing is enabled
+}
+
+type Option func(*Server)
+
+// WithStreamProvider sets the provider used for jobs that carry a DeltaCh.
+func WithStreamProvider(sp StreamProviderFunc) Option {
+	return func(s *Server) { s.streamer = sp }
+}
+
+// WithMiddleware wraps the provider with mws, the first being outermost.
+// Middleware runs outside the circuit breaker and inside the retry loop;
+// streamed jobs served by a stream provider do not pass through it.
+func WithMiddleware(mws ...Middleware) Option {
+	return func(s *Server) { s.mw = append(s.mw, mws...) }
+}
+
+// WithStreamMiddleware wraps the stream provider with mws, the first being
+// outermost. Like WithMiddleware it runs outside the circuit breaker; it
+// has no effect without WithStreamProvider.
+func WithStreamMiddleware(mws ...StreamMiddleware) Option {
+	return func(s *Server) { s.streamMW = append(s.streamMW, mws...) }
+}
+
+// WithResultHook calls fn with every job the workers ran and its result,
+// before the reply is sent. fn runs on the worker goroutine and must not
+// block. Coalesced callers share one job, so fn sees it once.
+func WithResultHook(fn func(InferenceJob, InferenceResult)) Option {
+	return func(s *Server) { s.onResult = fn }
+}
+
+// WithGate runs g on every job TryEnqueue accepts, e.g. to enforce budgets.
+func WithGate(g Gate) Option {
+	return func(s *Server) { s.gate = g }
+}
+
+// WithRetryPolicy enables retries and fallback models for failed provider calls.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(s *Server) { s.retry = p }
 }
 
 type QueueStats struct {
 	Len int
 	Cap int
+
+	ByClass map[string]int // queued jobs per priority class
 }
 
 func (s *Server) QueueStats() QueueStats {
-	return QueueStats{Len: len(s.jobQueue), Cap: cap(s.jobQueue)}
+	return s.queue.stats()
 }
 
 var ErrQueueFull = errors.New("queue full")
 
+// ErrShuttingDown is returned by TryEnqueue once Shutdown has begun; the API
+// maps it to 503. Jobs Shutdown cancels fail with errShutdownCancelled,
+// which matches it and context.Canceled.
+var ErrShuttingDown = errors.New("dispatcher shutting down")
+
+var errShutdownCancelled = fmt.Errorf("%w: %w", ErrShuttingDown, context.Canceled)
+
+// ErrInvalidRequest is wrapped by providers for requests they cannot serve
+// (e.g. an unknown provider); the API maps it to 400.
+var ErrInvalidRequest = errors.New("invalid request")
+
 // TryEnqueue enforces backpressure and returns queue stats for observability.
+// It fails with ErrQueueFull when the queue, or the job's key, is at capacity,
+// with ErrShuttingDown once Shutdown has been called, and with an
+// *AdmissionError when admission control expects the job to miss its deadline.
+// A job whose context ends while it is queued is answered with ctx.Err().
 func (s *Server) TryEnqueue(job InferenceJob) (QueueStats, error) {
-	select {
-	case s.jobQueue <- job:
-		return s.QueueStats(), nil
-	default:
-		return s.QueueStats(), ErrQueueFull
+	job.settle = nil
+	if err := s.admitJob(job); err != nil {
+		return s.queue.stats(), err
+	}
+	if s.gate != nil {
+		settle, err := s.gate(job)
+		if err != nil {
+			return s.queue.stats(), err
+		}
+		job.settle = settle
+	}
+
+	var (
+		stats QueueStats
+		err   error
+	)
+	if s.flights != nil && job.DeltaCh == nil {
+		stats, err = s.enqueueCoalesced(job)
+	} else {
+		stats, err = s.queue.tryPush(job)
 	}
+	if err != nil && job.settle != nil {
+		job.settle(InferenceResult{Err: err})
+	}
+	return stats, err
 }
 
-func New(queueSize, workers int, provider ProviderFunc) *Server {
+func New(queueSize, workers int, provider ProviderFunc, opts ...Option) *Server {
 	if provider == nil {
 		panic("provider must not be nil")
 	}
 
 	s := &Server{
-		jobQueue: make(chan InferenceJob, queueSize),
 		client: &http.Client{
 			Timeout: 60 * time.Second, // upper bound; prefer per-request ctx too
 		},
 		provider: provider,
 	}
+	s.stopCtx, s.stop = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.queue = newFairQueue(queueSize, s.queueCfg, s.limits)
+	s.queue.onExpire = s.expired
+	if s.breaker != nil && s.breaker.cfg.FailureThreshold > 0 {
+		s.provider = s.breaker.Wrap(s.provider)
+		if s.streamer != nil {
+			s.streamer = s.breaker.WrapStream(s.streamer)
+		}
+	}
+	for i := len(s.mw) - 1; i >= 0; i-- {
+		s.provider = s.mw[i](s.provider)
+	}
+	for i := len(s.streamMW) - 1; s.streamer != nil && i >= 0; i-- {
+		s.streamer = s.streamMW[i](s.streamer)
+	}
 
 	// Start workers
-	for i := 0; i < workers; i++ {
-		s.wg.Add(1)
-		go s.worker(i)
+	if s.scale != nil {
+		if s.scale.MinWorkers <= 0 {
+			s.scale.MinWorkers = max(1, workers)
+		}
+		if s.scale.MaxWorkers <= s.scale.MinWorkers {
+			workers, s.scale = s.scale.MinWorkers, nil
+		} else {
+			workers = s.scale.MinWorkers
+		}
+	}
+	s.scaleMu.Lock()
+	s.target = workers
+	s.spawnLocked(workers)
+	s.scaleMu.Unlock()
+	obs.DispatcherWorkerTarget.Set(float64(workers))
+
+	if s.scale != nil {
+		if s.scale.QueueWaitP95 <= 0 {
+			s.scale.QueueWaitP95 = 250 * time.Millisecond
+		}
+		if s.scale.IdleAfter <= 0 {
+			s.scale.IdleAfter = 30 * time.Second
+		}
+		if s.scale.Interval <= 0 {
+			s.scale.Interval = time.Second
+		}
+		go s.autoscale()
 	}
 	return s
 }
 
 func (s *Server) worker(id int) {
 	defer s.wg.Done()
+	defer s.workerExited()
 
-	for job := range s.jobQueue {
+	for {
+		job, ok := s.queue.pop()
+		if !ok {
+			return
+		}
+		s.busy.Add(1)
 		startedAt := time.Now()
 		queueWait := startedAt.Sub(job.EnqueuedAt)
+		s.observeWait(queueWait)
+
+		// Shutdown cancels the job if it is still running when draining ends.
+		callerCtx := job.Ctx
+		jobCtx, cancel := context.WithCancel(callerCtx)
+		unhook := context.AfterFunc(s.stopCtx, cancel)
+		job.Ctx = jobCtx
 
 		// Respect cancellation before starting work
 		select {
 		case <-job.Ctx.Done():
-			job.ReplyCh <- InferenceResult{Err: job.Ctx.Err()}
+			unhook()
+			cancel()
+			s.queue.done(job)
+			s.reply(job, InferenceResult{Err: s.cancelErr(callerCtx, job.Ctx.Err())})
+			s.busy.Add(-1)
 			continue
 		default:
 		}
 
-		// Provider call (stubbed here)
-		text, provider, tokenUsage, err := s.provider(job.Ctx, job.Req)
-
+		s.started(job)
+		out := s.run(id, job)
+		unhook()
+		cancel()
 		finishedAt := time.Now()
-
-		if err != nil {
-			// Note: reqID currently lives in handler; easiest is to include it in the job.
-			// Minimal version: just log without reqID:
-			log.Printf(`msg="provider call failed" worker=%d model=%q err=%q`, id, job.Req.Model, err.Error())
+		s.queue.done(job) // free the model slot before replying
+		if out.err != nil {
+			out.err = s.cancelErr(callerCtx, out.err)
+		}
+		if s.admit != nil && !errors.Is(out.err, context.Canceled) {
+			s.admit.observe(job.Req.Model, finishedAt.Sub(startedAt))
+		}
+		if len(out.meta.Guardrails) > 0 {
+			log.Printf(`req_id=%s msg="guardrails" worker=%d model=%q decisions=%q`, job.RequestID, id, job.Req.Model, guardrailSummary(out.meta.Guardrails))
 		}
 
-		job.ReplyCh <- InferenceResult{
-			Text:       text,
-			Provider:   provider,
-			TokenUsage: tokenUsage,
-			Err:        err,
+		res := InferenceResult{
+			Text:       out.text,
+			Provider:   out.provider,
+			TokenUsage: out.tokenUsage,
+			Err:        out.err,
+			Model:      out.model,
+			Attempts:   out.attempts,
 
 			StartedAt:  startedAt,
 			FinishedAt: finishedAt,
 
 			QueueWait: queueWait,
 			ExecTime:  finishedAt.Sub(startedAt),
+
+			FirstTokenAt: out.firstTokenAt,
+			Meta:         out.meta,
 		}
+		if s.onResult != nil {
+			s.onResult(job, res)
+		}
+		s.reply(job, res)
+		s.busy.Add(-1)
+	}
+}
+
+// guardrailSummary renders decisions for the audit log, e.g.
+// "pii:modify(email=1) injection:allow(reveal_prompt)".
+func guardrailSummary(ds []GuardrailDecision) string {
+	parts := make([]string, len(ds))
+	for i, d := range ds {
+		parts[i] = d.Guardrail + ":" + d.Action
+		if d.Detail != "" {
+			parts[i] += "(" + d.Detail + ")"
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// expired answers a job dropped from the queue because its context ended.
+func (s *Server) expired(job InferenceJob) {
+	s.reply(job, InferenceResult{Err: job.Ctx.Err(), QueueWait: time.Since(job.EnqueuedAt)})
+}
+
+// cancelErr reports err as errShutdownCancelled when the job was cut short
+// by Shutdown rather than by its caller.
+func (s *Server) cancelErr(callerCtx context.Context, err error) error {
+	if s.stopCtx.Err() != nil && callerCtx.Err() == nil {
+		return errShutdownCancelled
+	}
+	return err
+}
+
+func (s *Server) started(job InferenceJob) {
+	if job.flight != nil {
+		s.flightStarted(job.flight)
+		return
+	}
+	if job.OnStart != nil {
+		job.OnStart()
 	}
 }
 
-func (s *Server) Shutdown() {
-	close(s.jobQueue) // stop workers
-	s.wg.Wait()
+func (s *Server) reply(job InferenceJob, res InferenceResult) {
+	if job.flight != nil {
+		s.land(job.flight, res)
+		return
+	}
+	if job.settle != nil {
+		job.settle(res)
+	}
+	job.ReplyCh <- res
+}
+
+// outcome is the result of running a job, across all its attempts.
+type outcome struct {
+	text         string
+	provider     string
+	model        string
+	tokenUsage   int
+	firstTokenAt time.Time
+	meta         ResultMeta
+	attempts     []Attempt
+	err          error
+}
+
+// run calls the provider for job, retrying retryable failures with backoff
+// and then walking the fallback models. Streamed jobs are only retried while
+// nothing has been sent to the client yet.
+func (s *Server) run(id int, job InferenceJob) outcome {
+	var out outcome
+	models := append([]string{job.Req.Model}, s.retry.Fallbacks[job.Req.Model]...)
+	maxAttempts := max(1, s.retry.MaxAttempts)
+
+	for i, model := range models {
+		req := job.Req
+		req.Model = model
+
+		for n := 1; n <= maxAttempts; n++ {
+			if n > 1 {
+				if !sleepCtx(job.Ctx, s.retry.backoff(n-1, out.err)) {
+					return out // deadline too close for another attempt
+				}
+				obs.Retries.WithLabelValues(out.provider, model, "retry").Inc()
+			}
+
+			callCtx, meta := WithResultMeta(job.Ctx)
+			t0 := time.Now()
+			if job.DeltaCh != nil {
+				j := job
+				j.Req = req
+				out.text, out.provider, out.tokenUsage, out.firstTokenAt, out.err = s.stream(callCtx, j)
+			} else {
+				out.text, out.provider, out.tokenUsage, out.err = s.provider(callCtx, req)
+			}
+			out.model = model
+			out.meta = *meta
+			if i > 0 && n == 1 {
+				// Counted after the call: only then is the provider the
+				// fallback model routes to known.
+				obs.Retries.WithLabelValues(out.provider, model, "fallback").Inc()
+			}
+
+			a := Attempt{Model: model, Provider: out.provider, Latency: time.Since(t0)}
+			if out.err != nil {
+				a.Error = out.err.Error()
+			}
+			out.attempts = append(out.attempts, a)
+
+			if out.err == nil {
+				return out
+			}
+			log.Printf(`req_id=%s msg="provider call failed" worker=%d model=%q attempt=%d err=%q`, job.RequestID, id, model, len(out.attempts), out.err.Error())
+
+			if errors.Is(out.err, ErrCircuitOpen) && out.firstTokenAt.IsZero() {
+				break // no point retrying an open circuit; try the next fallback
+			}
+			if !retryableFor(job.Ctx, out.err) || !out.firstTokenAt.IsZero() {
+				return out
+			}
+		}
+	}
+	return out
+}
+
+// stream runs a streamed job, forwarding deltas to job.DeltaCh. Without a
+// stream provider the full completion is forwarded as a single delta.
+func (s *Server) stream(ctx context.Context, job InferenceJob) (text, provider string, tokenUsage int, firstTokenAt time.Time, err error) {
+	var sb strings.Builder
+	send := func(delta string) error {
+		if delta == "" {
+			return nil
+		}
+		select {
+		case job.DeltaCh <- delta:
+		case <-job.Ctx.Done():
+			return job.Ctx.Err()
+		}
+		if firstTokenAt.IsZero() {
+			firstTokenAt = time.Now()
+		}
+		sb.WriteString(delta)
+		return nil
+	}
+
+	if s.streamer == nil {
+		text, provider, tokenUsage, err = s.provider(ctx, job.Req)
+		if err == nil {
+			err = send(text)
+		}
+		return text, provider, tokenUsage, firstTokenAt, err
+	}
+
+	provider, tokenUsage, err = s.streamer(ctx, job.Req, send)
+	return sb.String(), provider, tokenUsage, firstTokenAt, err
+}
+
+// Shutdown stops accepting jobs (TryEnqueue returns ErrShuttingDown) and
+// lets the queued and running ones finish. If ctx ends first, running
+// provider calls are cancelled, jobs still queued are answered with an error
+// matching ErrShuttingDown, and ctx's error is returned without waiting for
+// providers that ignore cancellation. Shutdown may be called more than once.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.scaleMu.Lock()
+	s.stopping = true // no new workers once wg.Wait may be running
+	s.scaleMu.Unlock()
+	s.queue.close() // stop workers once the queue drains
+
+	drained := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(drained)
+	}()
+	defer s.stop()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.stop()
+	queued := s.queue.drain()
+	for _, job := range queued {
+		s.reply(job, InferenceResult{Err: errShutdownCancelled})
+	}
+	log.Printf(`msg="dispatcher drain deadline reached" cancelled_queued=%d`, len(queued))
+	return ctx.Err()
 }
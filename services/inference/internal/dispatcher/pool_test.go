@@ -1 +1,226 @@
 package dispatcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestResultHook_SeesJobAndResultBeforeReply(t *testing.T) {
+	provider := func(ctx context.Context, req InferenceRequest) (string, string, int, error) {
+		MetaFromContext(ctx).PromptTokens = 4
+		return "ok", "fake", 6, nil
+	}
+	hooked := make(chan InferenceResult, 1)
+	var hookedJob InferenceJob
+	s := New(10, 1, provider, WithResultHook(func(job InferenceJob, res InferenceResult) {
+		hookedJob = job
+		hooked <- res
+	}))
+	defer s.Shutdown(context.Background())
+
+	replyCh := make(chan InferenceResult, 1)
+	if _, err := s.TryEnqueue(InferenceJob{
+		Req:        InferenceRequest{Prompt: "hi", Model: "m"},
+		Ctx:        context.Background(),
+		ReplyCh:    replyCh,
+		EnqueuedAt: time.Now(),
+		RequestID:  "req-1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-replyCh
+	select {
+	case h := <-hooked:
+		if h.TokenUsage != 6 || h.Meta.PromptTokens != 4 || h.Model != "m" || h.Text != res.Text {
+			t.Fatalf("hook saw %+v", h)
+		}
+	default:
+		t.Fatal("hook did not run before the reply")
+	}
+	if hookedJob.RequestID != "req-1" {
+		t.Fatalf("hook job RequestID = %q", hookedJob.RequestID)
+	}
+}
+
+func TestGate_RejectsOrSettlesOnce(t *testing.T) {
+	provider := func(ctx context.Context, req InferenceRequest) (string, string, int, error) {
+		return "ok", "fake", 3, nil
+	}
+	errOver := errors.New("over budget")
+	settled := make(chan InferenceResult, 2)
+	s := New(10, 1, provider, WithGate(func(job InferenceJob) (func(InferenceResult), error) {
+		if job.Key == "broke" {
+			return nil, errOver
+		}
+		return func(res InferenceResult) { settled <- res }, nil
+	}))
+	defer s.Shutdown(context.Background())
+
+	job := func(key string) InferenceJob {
+		return InferenceJob{
+			Req:        InferenceRequest{Prompt: "hi", Model: "m"},
+			Ctx:        context.Background(),
+			ReplyCh:    make(chan InferenceResult, 1),
+			EnqueuedAt: time.Now(),
+			Key:        key,
+		}
+	}
+
+	if _, err := s.TryEnqueue(job("broke")); !errors.Is(err, errOver) {
+		t.Fatalf("gate error = %v", err)
+	}
+
+	ok := job("alice")
+	if _, err := s.TryEnqueue(ok); err != nil {
+		t.Fatal(err)
+	}
+	<-ok.ReplyCh
+	if res := <-settled; res.TokenUsage != 3 {
+		t.Fatalf("settled with %+v", res)
+	}
+	select {
+	case res := <-settled:
+		t.Fatalf("settled twice: %+v", res)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestGate_SettlesWhenQueueIsFull(t *testing.T) {
+	provider := func(ctx context.Context, req InferenceRequest) (string, string, int, error) {
+		return "unused", "fake", 0, nil
+	}
+	settled := make(chan InferenceResult, 2)
+	s := New(1, 0, provider, WithGate(func(InferenceJob) (func(InferenceResult), error) {
+		return func(res InferenceResult) { settled <- res }, nil
+	}))
+	defer s.Shutdown(context.Background())
+
+	for range 2 {
+		_, _ = s.TryEnqueue(InferenceJob{
+			Req:        InferenceRequest{Prompt: "hi", Model: "m"},
+			Ctx:        context.Background(),
+			ReplyCh:    make(chan InferenceResult, 1),
+			EnqueuedAt: time.Now(),
+		})
+	}
+	select {
+	case res := <-settled:
+		if !errors.Is(res.Err, ErrQueueFull) {
+			t.Fatalf("settled with %+v", res)
+		}
+	default:
+		t.Fatal("rejected job was not settled")
+	}
+}
+
+func TestShutdown_DrainsThenCancels(t *testing.T) {
+	release := make(chan struct{})
+	provider := func(ctx context.Context, req InferenceRequest) (string, string, int, error) {
+		if req.Model == "fast" {
+			return "ok", "fake", 1, nil
+		}
+		select {
+		case <-release:
+			return "late", "fake", 1, nil
+		case <-ctx.Done():
+			return "", "fake", 0, ctx.Err()
+		}
+	}
+	enqueue := func(s *Server, model string) chan InferenceResult {
+		t.Helper()
+		replyCh := make(chan InferenceResult, 1)
+		if _, err := s.TryEnqueue(InferenceJob{Req: InferenceRequest{Prompt: "hi", Model: model}, Ctx: context.Background(), ReplyCh: replyCh, EnqueuedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		return replyCh
+	}
+
+	// Within the deadline, queued and running jobs finish normally.
+	s := New(10, 1, provider)
+	fast := enqueue(s, "fast")
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown = %v", err)
+	}
+	if res := <-fast; res.Err != nil || res.Text != "ok" {
+		t.Fatalf("drained job = %+v", res)
+	}
+	if _, err := s.TryEnqueue(InferenceJob{Ctx: context.Background(), ReplyCh: make(chan InferenceResult, 1)}); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("TryEnqueue after Shutdown = %v, want ErrShuttingDown", err)
+	}
+
+	// Past the deadline, the running job is cancelled and the queued one answered.
+	s = New(10, 1, provider)
+	running := enqueue(s, "slow")
+	for s.QueueStats().Len > 0 {
+		time.Sleep(time.Millisecond) // wait for the worker to take it
+	}
+	queued := enqueue(s, "slow")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown = %v, want DeadlineExceeded", err)
+	}
+	for name, ch := range map[string]chan InferenceResult{"running": running, "queued": queued} {
+		select {
+		case res := <-ch:
+			if !errors.Is(res.Err, ErrShuttingDown) || !errors.Is(res.Err, context.Canceled) {
+				t.Fatalf("%s job err = %v", name, res.Err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s job got no reply", name)
+		}
+	}
+	close(release)
+}
+
+func TestStreamMiddleware_RunsOutsideBreaker(t *testing.T) {
+	streamer := func(ctx context.Context, req InferenceRequest, onDelta func(string) error) (string, int, error) {
+		return "fake", 0, &ProviderError{Provider: "fake", StatusCode: http.StatusServiceUnavailable, Message: "down"}
+	}
+	reject := func(next StreamProviderFunc) StreamProviderFunc {
+		return func(ctx context.Context, req InferenceRequest, onDelta func(string) error) (string, int, error) {
+			if req.Prompt == "bad" {
+				return "guardrails", 0, fmt.Errorf("%w: blocked", ErrInvalidRequest)
+			}
+			return next(ctx, req, onDelta)
+		}
+	}
+	cb := NewCircuitBreaker(BreakerConfig{FailureThreshold: 1, OpenFor: time.Minute})
+	s := New(10, 1, func(ctx context.Context, req InferenceRequest) (string, string, int, error) {
+		return "ok", "fake", 1, nil
+	}, WithStreamProvider(streamer), WithStreamMiddleware(reject), WithCircuitBreaker(cb),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+	defer s.Shutdown(context.Background())
+
+	stream := func(prompt string) error {
+		replyCh := make(chan InferenceResult, 1)
+		if _, err := s.TryEnqueue(InferenceJob{
+			Req:        InferenceRequest{Prompt: prompt, Model: "m"},
+			Ctx:        context.Background(),
+			ReplyCh:    replyCh,
+			DeltaCh:    make(chan string),
+			EnqueuedAt: time.Now(),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return (<-replyCh).Err
+	}
+
+	if err := stream("hi"); errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("first call err = %v", err)
+	}
+	// A rejection while the circuit is open is still a rejection...
+	if err := stream("bad"); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("rejected call err = %v, want ErrInvalidRequest", err)
+	}
+	// ...and leaves the circuit as it was.
+	c := cb.circuits[breakerKey{model: "m"}]
+	if c.state != stateOpen || c.label != "fake" {
+		t.Fatalf("circuit after rejection: state=%d label=%q, want open and labelled fake", c.state, c.label)
+	}
+}
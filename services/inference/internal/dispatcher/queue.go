@@ -0,0 +1,381 @@
+package dispatcher
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/obs"
+)
+
+// Priority classes a job can be queued under.
+type Priority int
+
+const (
+	PriorityInteractive Priority = iota // default; user-facing requests
+	PriorityBatch                       // offline/bulk work
+	numPriorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityInteractive:
+		return "interactive"
+	case PriorityBatch:
+		return "batch"
+	default:
+		return "unknown"
+	}
+}
+
+// ParsePriority maps a class name to a Priority; anything unknown is interactive.
+func ParsePriority(s string) Priority {
+	if s == "batch" {
+		return PriorityBatch
+	}
+	return PriorityInteractive
+}
+
+// QueueConfig tunes the fair scheduler.
+type QueueConfig struct {
+	// ClassWeights is the share of dequeues each priority class gets while
+	// several classes have work. Zero weights default to interactive 4, batch 1.
+	ClassWeights [numPriorities]int
+
+	// MaxPerKey caps the jobs one key may have queued at once (0 = no cap),
+	// so a single heavy client cannot take every slot.
+	MaxPerKey int
+}
+
+// WithQueueConfig configures the fair scheduler.
+func WithQueueConfig(c QueueConfig) Option {
+	return func(s *Server) { s.queueCfg = c }
+}
+
+// classQueue round-robins between the keys that have queued jobs, so each
+// key gets one job per turn regardless of how many it submitted.
+type classQueue struct {
+	pending map[string][]InferenceJob
+	ring    []string // keys with pending jobs, in service order
+	len     int
+}
+
+func (c *classQueue) push(job InferenceJob) {
+	if len(c.pending[job.Key]) == 0 {
+		c.ring = append(c.ring, job.Key)
+	}
+	c.pending[job.Key] = append(c.pending[job.Key], job)
+	c.len++
+}
+
+// pop removes the next job that ok accepts, visiting keys in round-robin
+// order and each key's jobs in FIFO order. Skipped jobs keep their place.
+func (c *classQueue) pop(ok func(InferenceJob) bool) (InferenceJob, bool) {
+	for r, key := range c.ring {
+		q := c.pending[key]
+		for i, job := range q {
+			if !ok(job) {
+				continue
+			}
+			q = append(q[:i:i], q[i+1:]...)
+			ring := append(c.ring[:r:r], c.ring[r+1:]...)
+			if len(q) == 0 {
+				delete(c.pending, key)
+			} else {
+				c.pending[key] = q
+				ring = append(ring, key) // back of the line
+			}
+			c.ring = ring
+			c.len--
+			return job, true
+		}
+	}
+	return InferenceJob{}, false
+}
+
+// remove takes out key's job seq, if it is still queued.
+func (c *classQueue) remove(key string, seq uint64) (InferenceJob, bool) {
+	q := c.pending[key]
+	for i, job := range q {
+		if job.seq != seq {
+			continue
+		}
+		q = append(q[:i:i], q[i+1:]...)
+		if len(q) == 0 {
+			delete(c.pending, key)
+			for r, k := range c.ring {
+				if k == key {
+					c.ring = append(c.ring[:r:r], c.ring[r+1:]...)
+					break
+				}
+			}
+		} else {
+			c.pending[key] = q
+		}
+		c.len--
+		return job, true
+	}
+	return InferenceJob{}, false
+}
+
+func (c *classQueue) has(ok func(InferenceJob) bool) bool {
+	for _, key := range c.ring {
+		for _, job := range c.pending[key] {
+			if ok(job) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fairQueue is a bounded multi-class queue. Classes are served by smooth
+// weighted round-robin and keys within a class by plain round-robin. Jobs
+// whose model is at its concurrency limit stay queued, without holding up
+// jobs for other models, until a slot frees up (see done).
+type fairQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	cap    int
+	cfg    QueueConfig
+	len    int
+	closed bool
+
+	classes [numPriorities]classQueue
+	current [numPriorities]int // smooth WRR state
+	perKey  map[string]int
+
+	limits   ConcurrencyLimits
+	inflight map[string]int // by limit rule key
+
+	retiring int // idle workers still to be let go (see retire)
+
+	seq      uint64
+	onExpire func(InferenceJob) // answers a job whose context ended while queued
+}
+
+func newFairQueue(capacity int, cfg QueueConfig, limits ConcurrencyLimits) *fairQueue {
+	if cfg.ClassWeights == ([numPriorities]int{}) {
+		cfg.ClassWeights = [numPriorities]int{PriorityInteractive: 4, PriorityBatch: 1}
+	}
+	for i, w := range cfg.ClassWeights {
+		if w < 1 {
+			cfg.ClassWeights[i] = 1
+		}
+	}
+	q := &fairQueue{cap: capacity, cfg: cfg, perKey: map[string]int{}, limits: limits, inflight: map[string]int{}}
+	q.cond = sync.NewCond(&q.mu)
+	for i := range q.classes {
+		q.classes[i].pending = map[string][]InferenceJob{}
+	}
+	return q
+}
+
+// tryPush adds job unless the queue is closed (ErrShuttingDown) or it, or
+// the job's key, is at capacity (ErrQueueFull).
+func (q *fairQueue) tryPush(job InferenceJob) (QueueStats, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return q.statsLocked(), ErrShuttingDown
+	}
+	if q.len >= q.cap || (q.cfg.MaxPerKey > 0 && q.perKey[job.Key] >= q.cfg.MaxPerKey) {
+		return q.statsLocked(), ErrQueueFull
+	}
+	if job.Priority < 0 || job.Priority >= numPriorities {
+		job.Priority = PriorityInteractive
+	}
+	q.seq++
+	job.seq = q.seq
+	if job.Ctx != nil && q.onExpire != nil {
+		prio, key, seq := job.Priority, job.Key, job.seq
+		job.unwatch = context.AfterFunc(job.Ctx, func() { q.expire(prio, key, seq) })
+	}
+	q.classes[job.Priority].push(job)
+	q.perKey[job.Key]++
+	q.len++
+	q.cond.Signal()
+	return q.statsLocked(), nil
+}
+
+// pop blocks until a job whose model has a free slot is available and
+// takes that slot; release it with done. pop returns false once the queue
+// is closed and drained, or when the calling worker is retired.
+func (q *fairQueue) pop() (InferenceJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.len == 0 && q.closed {
+			return InferenceJob{}, false
+		}
+		if job, ok := q.popLocked(); ok {
+			return job, true
+		}
+		if q.retiring > 0 {
+			q.retiring--
+			return InferenceJob{}, false
+		}
+		q.cond.Wait()
+	}
+}
+
+// retire makes the next n workers that find nothing to run exit.
+func (q *fairQueue) retire(n int) {
+	q.mu.Lock()
+	q.retiring += n
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// unretire withdraws up to n pending retirements and returns how many.
+func (q *fairQueue) unretire(n int) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n = min(n, q.retiring)
+	q.retiring -= n
+	return n
+}
+
+func (q *fairQueue) popLocked() (InferenceJob, bool) {
+	// Smooth weighted round-robin over the classes with a runnable job.
+	best, total := -1, 0
+	for i := range q.classes {
+		if q.classes[i].len == 0 || !q.classes[i].has(q.runnable) {
+			continue
+		}
+		q.current[i] += q.cfg.ClassWeights[i]
+		total += q.cfg.ClassWeights[i]
+		if best < 0 || q.current[i] > q.current[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return InferenceJob{}, false
+	}
+	q.current[best] -= total
+
+	job, _ := q.classes[best].pop(q.runnable)
+	if q.classes[best].len == 0 {
+		q.current[best] = 0 // an idle class does not bank credit
+	}
+	q.dequeuedLocked(job)
+
+	if key, _ := q.limits.rule(job.Req.Model); key != "" {
+		q.inflight[key]++
+		job.slot = key
+	}
+	obs.ModelInFlight.WithLabelValues(modelLabel(job.Req.Model)).Inc()
+	return job, true
+}
+
+// dequeuedLocked updates the counts for a job leaving the queue.
+func (q *fairQueue) dequeuedLocked(job InferenceJob) {
+	if job.unwatch != nil {
+		job.unwatch()
+	}
+	if q.perKey[job.Key]--; q.perKey[job.Key] == 0 {
+		delete(q.perKey, job.Key)
+	}
+	q.len--
+}
+
+// expire drops a queued job whose context ended, so it neither waits for a
+// worker nor counts against the queue's capacity, and answers it.
+func (q *fairQueue) expire(prio Priority, key string, seq uint64) {
+	q.mu.Lock()
+	job, ok := q.classes[prio].remove(key, seq)
+	if ok {
+		q.dequeuedLocked(job)
+		if q.classes[prio].len == 0 {
+			q.current[prio] = 0
+		}
+	}
+	q.mu.Unlock()
+	if ok {
+		obs.QueueExpired.WithLabelValues(modelLabel(job.Req.Model)).Inc()
+		q.onExpire(job)
+	}
+}
+
+// runnable reports whether job's model has a free concurrency slot.
+func (q *fairQueue) runnable(job InferenceJob) bool {
+	key, limit := q.limits.rule(job.Req.Model)
+	return key == "" || q.inflight[key] < limit
+}
+
+// done releases the slot taken by pop for job.
+func (q *fairQueue) done(job InferenceJob) {
+	q.mu.Lock()
+	if job.slot != "" {
+		if q.inflight[job.slot]--; q.inflight[job.slot] <= 0 {
+			delete(q.inflight, job.slot)
+		}
+	}
+	q.mu.Unlock()
+	obs.ModelInFlight.WithLabelValues(modelLabel(job.Req.Model)).Dec()
+	q.cond.Broadcast()
+}
+
+// setLimits replaces the limits. Running jobs release the slot they took
+// under the old limits.
+func (q *fairQueue) setLimits(l ConcurrencyLimits) {
+	q.mu.Lock()
+	q.limits = l
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+func modelLabel(model string) string {
+	if model == "" {
+		return "unknown"
+	}
+	return model
+}
+
+// close wakes all waiting workers; queued jobs are still handed out.
+func (q *fairQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// drain removes and returns every queued job, in no particular order.
+func (q *fairQueue) drain() []InferenceJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := make([]InferenceJob, 0, q.len)
+	for i := range q.classes {
+		c := &q.classes[i]
+		for _, key := range c.ring {
+			for _, job := range c.pending[key] {
+				if job.unwatch != nil {
+					job.unwatch()
+				}
+				jobs = append(jobs, job)
+			}
+		}
+		*c = classQueue{pending: map[string][]InferenceJob{}}
+		q.current[i] = 0
+	}
+	q.perKey = map[string]int{}
+	q.len = 0
+	q.cond.Broadcast()
+	return jobs
+}
+
+func (q *fairQueue) stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.statsLocked()
+}
+
+func (q *fairQueue) statsLocked() QueueStats {
+	st := QueueStats{Len: q.len, Cap: q.cap, ByClass: make(map[string]int, numPriorities)}
+	for i := range q.classes {
+		st.ByClass[Priority(i).String()] = q.classes[i].len
+	}
+	return st
+}
@@ -0,0 +1,73 @@
+package dispatcher
+
+import (
+	"errors"
+	"testing"
+)
+
+func popKeys(t *testing.T, q *fairQueue, n int) []string {
+	t.Helper()
+	var keys []string
+	for range n {
+		job, ok := q.pop()
+		if !ok {
+			t.Fatal("queue closed early")
+		}
+		keys = append(keys, job.Key+"/"+job.Priority.String())
+	}
+	return keys
+}
+
+func TestFairQueue_RoundRobinsKeys(t *testing.T) {
+	q := newFairQueue(10, QueueConfig{}, nil)
+	for _, k := range []string{"heavy", "heavy", "heavy", "light"} {
+		q.tryPush(InferenceJob{Key: k})
+	}
+
+	got := popKeys(t, q, 4)
+	want := []string{"heavy/interactive", "light/interactive", "heavy/interactive", "heavy/interactive"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("order = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestFairQueue_ClassWeights(t *testing.T) {
+	q := newFairQueue(20, QueueConfig{ClassWeights: [numPriorities]int{PriorityInteractive: 2, PriorityBatch: 1}}, nil)
+	for range 6 {
+		q.tryPush(InferenceJob{Key: "b", Priority: PriorityBatch})
+		q.tryPush(InferenceJob{Key: "i"})
+	}
+
+	st := q.stats()
+	if st.ByClass["batch"] != 6 || st.ByClass["interactive"] != 6 || st.Len != 12 {
+		t.Fatalf("stats = %+v", st)
+	}
+
+	batch := 0
+	for _, k := range popKeys(t, q, 6) {
+		if k == "b/batch" {
+			batch++
+		}
+	}
+	if batch != 2 {
+		t.Fatalf("batch got %d of the first 6 dequeues, want 2", batch)
+	}
+}
+
+func TestTryEnqueue_MaxPerKey(t *testing.T) {
+	s := &Server{queue: newFairQueue(10, QueueConfig{MaxPerKey: 2}, nil)}
+
+	for range 2 {
+		if _, err := s.TryEnqueue(InferenceJob{Key: "a"}); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+	if _, err := s.TryEnqueue(InferenceJob{Key: "a"}); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("third job for key a: err = %v, want ErrQueueFull", err)
+	}
+	if _, err := s.TryEnqueue(InferenceJob{Key: "b"}); err != nil {
+		t.Fatalf("other key rejected: %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package dispatcher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Chat roles accepted in InferenceRequest.Messages.
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+// Values of InferenceRequest.Cache.
+const (
+	CacheForce = "force"
+	CacheSkip  = "skip"
+)
+
+// Message is one turn of a chat conversation.
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Conversation returns the ordered turns of the request. A bare Prompt is
+// shorthand for a single user turn.
+func (r InferenceRequest) Conversation() []Message {
+	if len(r.Messages) > 0 {
+		return r.Messages
+	}
+	if r.Prompt == "" {
+		return nil
+	}
+	return []Message{{Role: RoleUser, Content: r.Prompt}}
+}
+
+// Fingerprint hashes everything that determines the completion: the explicit
+// provider, the model, the conversation and the generation params. Requests
+// with equal fingerprints are interchangeable.
+func (r InferenceRequest) Fingerprint() string {
+	b, _ := json.Marshal(struct {
+		Provider string           `json:"provider"`
+		Model    string           `json:"model"`
+		Messages []Message        `json:"messages"`
+		Params   GenerationParams `json:"params"`
+	}{r.Provider, r.Model, r.Conversation(), r.Params})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// LastUserContent returns the content of the final user turn, or "".
+func (r InferenceRequest) LastUserContent() string {
+	msgs := r.Conversation()
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Role == RoleUser {
+			return msgs[i].Content
+		}
+	}
+	return ""
+}
+
+// Validate checks the shape of the conversation. System turns may only lead
+// the conversation, and at least one user turn is required.
+func (r InferenceRequest) Validate() error {
+	if r.Prompt != "" && len(r.Messages) > 0 {
+		return errors.New("set either prompt or messages, not both")
+	}
+	msgs := r.Conversation()
+	if len(msgs) == 0 {
+		return errors.New("prompt or messages is required")
+	}
+
+	sawUser := false
+	leading := true
+	for i, m := range msgs {
+		switch m.Role {
+		case RoleSystem:
+			if !leading {
+				return fmt.Errorf("messages[%d]: system messages must come before other turns", i)
+			}
+		case RoleUser:
+			leading = false
+			sawUser = true
+		case RoleAssistant:
+			leading = false
+		default:
+			return fmt.Errorf("messages[%d]: unknown role %q", i, m.Role)
+		}
+		if m.Content == "" {
+			return fmt.Errorf("messages[%d]: content is required", i)
+		}
+	}
+	if !sawUser {
+		return errors.New("messages must include at least one user turn")
+	}
+	switch r.Cache {
+	case "", CacheForce, CacheSkip:
+	default:
+		return fmt.Errorf("cache must be %q or %q", CacheForce, CacheSkip)
+	}
+	return r.Params.Validate(ParamLimits{})
+}
+
+// GenerationParams are the sampling settings forwarded to the provider. Nil /
+// empty fields mean "provider default" and are omitted upstream.
+type GenerationParams struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	Seed        *int64   `json:"seed,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+// ParamLimits are per-model bounds (eligible_models); zero means no extra limit.
+type ParamLimits struct {
+	MaxOutputTokens int
+	MaxTemperature  float64
+}
+
+const maxStopSequences = 4
+
+// Validate checks params against provider-agnostic ranges and the model limits.
+func (p GenerationParams) Validate(lim ParamLimits) error {
+	if t := p.Temperature; t != nil {
+		maxTemp := 2.0
+		if lim.MaxTemperature > 0 && lim.MaxTemperature < maxTemp {
+			maxTemp = lim.MaxTemperature
+		}
+		if *t < 0 || *t > maxTemp {
+			return fmt.Errorf("params.temperature must be between 0 and %g", maxTemp)
+		}
+	}
+	if n := p.MaxTokens; n != nil {
+		if *n < 1 {
+			return errors.New("params.max_tokens must be positive")
+		}
+		if lim.MaxOutputTokens > 0 && *n > lim.MaxOutputTokens {
+			return fmt.Errorf("params.max_tokens must be at most %d for this model", lim.MaxOutputTokens)
+		}
+	}
+	if tp := p.TopP; tp != nil && (*tp <= 0 || *tp > 1) {
+		return errors.New("params.top_p must be in (0, 1]")
+	}
+	// Gemini takes an int32 seed; keep the range portable across providers.
+	if s := p.Seed; s != nil && (*s < math.MinInt32 || *s > math.MaxInt32) {
+		return errors.New("params.seed must fit in a 32-bit integer")
+	}
+	if len(p.Stop) > maxStopSequences {
+		return fmt.Errorf("params.stop accepts at most %d sequences", maxStopSequences)
+	}
+	for i, s := range p.Stop {
+		if s == "" {
+			return fmt.Errorf("params.stop[%d] must not be empty", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProviderError is returned by providers for non-2xx upstream responses so the
+// dispatcher can tell transient failures from permanent ones.
+type ProviderError struct {
+	Provider   string
+	StatusCode int
+	Message    string
+	RetryAfter time.Duration // from the Retry-After header, when present
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("%s error: %s", e.Provider, e.Message)
+}
+
+// ParseRetryAfter reads a Retry-After header given in seconds.
+func ParseRetryAfter(h http.Header) time.Duration {
+	if n, err := strconv.Atoi(strings.TrimSpace(h.Get("Retry-After"))); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return 0
+}
+
+// Retryable reports whether err is worth another attempt: upstream 429/5xx
+// and transport timeouts. Cancellation of the job itself never is; nor is a
+// deadline error, which without the job's context may be the job's own (see
+// retryableFor).
+func Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var pe *ProviderError
+	if errors.As(err, &pe) {
+		return pe.StatusCode == http.StatusTooManyRequests || pe.StatusCode >= 500
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// retryableFor is Retryable for a call made for a job with context jobCtx. A
+// deadline error while jobCtx is still live came from a per-call timeout
+// (http.Client.Timeout errors match context.DeadlineExceeded) and is retried.
+func retryableFor(jobCtx context.Context, err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) && jobCtx.Err() == nil {
+		return true
+	}
+	return Retryable(err)
+}
+
+// RetryPolicy configures retries of failed provider calls. The zero value
+// disables retries and fallbacks.
+type RetryPolicy struct {
+	MaxAttempts int           // attempts per model, including the first
+	BaseDelay   time.Duration // backoff before the first retry; doubles per retry
+	MaxDelay    time.Duration // cap on a single backoff
+
+	// Fallbacks maps a model to the models tried, in order, once its own
+	// attempts are exhausted by retryable errors.
+	Fallbacks map[string][]string
+}
+
+// Attempt records one provider call made for a job.
+type Attempt struct {
+	Model    string
+	Provider string
+	Error    string // empty on success
+	Latency  time.Duration
+}
+
+// backoff returns the jittered delay before retry n (1-based): a random value
+// in [d/2, d] where d = BaseDelay * 2^(n-1), capped at MaxDelay.
+func (p RetryPolicy) backoff(n int, err error) time.Duration {
+	d := p.BaseDelay << (n - 1)
+	if p.MaxDelay > 0 && (d > p.MaxDelay || d <= 0) {
+		d = p.MaxDelay
+	}
+	if d > 0 {
+		d = d/2 + rand.N(d/2+1)
+	}
+	var pe *ProviderError
+	if errors.As(err, &pe) && pe.RetryAfter > d {
+		d = pe.RetryAfter
+	}
+	return d
+}
+
+// ParseFallbacks parses "modelA=modelB|modelC,modelD=modelE".
+func ParseFallbacks(s string) (map[string][]string, error) {
+	out := map[string][]string{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		model, chain, ok := strings.Cut(part, "=")
+		model = strings.TrimSpace(model)
+		if !ok || model == "" || strings.TrimSpace(chain) == "" {
+			return nil, fmt.Errorf("bad fallback %q (want model=fallback1|fallback2)", part)
+		}
+		for _, fb := range strings.Split(chain, "|") {
+			if fb = strings.TrimSpace(fb); fb != "" {
+				out[model] = append(out[model], fb)
+			}
+		}
+	}
+	return out, nil
+}
+
+// sleepCtx waits for d unless ctx ends first or its deadline would pass
+// during the wait, in which case it returns false without waiting.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= d {
+		return false
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,185 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/obs"
+)
+
+// scripted returns the errors in order for each model, then succeeds.
+type scripted struct {
+	mu    sync.Mutex
+	errs  map[string][]error
+	calls []string
+}
+
+func (p *scripted) call(ctx context.Context, req InferenceRequest) (string, string, int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = append(p.calls, req.Model)
+	if q := p.errs[req.Model]; len(q) > 0 {
+		p.errs[req.Model] = q[1:]
+		return "", "fake", 0, q[0]
+	}
+	return "ok from " + req.Model, "fake", 1, nil
+}
+
+func runJob(t *testing.T, s *Server, ctx context.Context, model string) InferenceResult {
+	t.Helper()
+	replyCh := make(chan InferenceResult, 1)
+	if _, err := s.TryEnqueue(InferenceJob{
+		Req:        InferenceRequest{Prompt: "hi", Model: model},
+		Ctx:        ctx,
+		ReplyCh:    replyCh,
+		EnqueuedAt: time.Now(),
+	}); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	return <-replyCh
+}
+
+func unavailable() error {
+	return &ProviderError{Provider: "fake", StatusCode: http.StatusServiceUnavailable, Message: "overloaded"}
+}
+
+func TestRetry_TransientThenSuccess(t *testing.T) {
+	p := &scripted{errs: map[string][]error{"m": {unavailable(), unavailable()}}}
+	s := New(1, 1, p.call, WithRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}))
+	defer s.Shutdown(context.Background())
+
+	res := runJob(t, s, context.Background(), "m")
+	if res.Err != nil {
+		t.Fatalf("unexpected err: %v", res.Err)
+	}
+	if len(res.Attempts) != 3 || res.Attempts[0].Error == "" || res.Attempts[2].Error != "" {
+		t.Fatalf("attempts = %+v", res.Attempts)
+	}
+}
+
+func TestRetry_NonRetryableStopsImmediately(t *testing.T) {
+	bad := &ProviderError{Provider: "fake", StatusCode: http.StatusBadRequest, Message: "nope"}
+	p := &scripted{errs: map[string][]error{"m": {bad}}}
+	s := New(1, 1, p.call, WithRetryPolicy(RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+		Fallbacks:   map[string][]string{"m": {"fb"}},
+	}))
+	defer s.Shutdown(context.Background())
+
+	res := runJob(t, s, context.Background(), "m")
+	if !errors.Is(res.Err, bad) || len(p.calls) != 1 {
+		t.Fatalf("err=%v calls=%v", res.Err, p.calls)
+	}
+}
+
+func TestRetry_FallbackModel(t *testing.T) {
+	p := &scripted{errs: map[string][]error{"m": {unavailable(), unavailable()}}}
+	s := New(1, 1, p.call, WithRetryPolicy(RetryPolicy{
+		MaxAttempts: 2,
+		BaseDelay:   time.Millisecond,
+		Fallbacks:   map[string][]string{"m": {"fb"}},
+	}))
+	defer s.Shutdown(context.Background())
+
+	res := runJob(t, s, context.Background(), "m")
+	if res.Err != nil || res.Model != "fb" || res.Text != "ok from fb" {
+		t.Fatalf("res = %+v", res)
+	}
+	if len(res.Attempts) != 3 {
+		t.Fatalf("attempts = %+v", res.Attempts)
+	}
+}
+
+func TestRetry_FallbackMetricNamesFallbackProvider(t *testing.T) {
+	provider := func(ctx context.Context, req InferenceRequest) (string, string, int, error) {
+		if req.Model == "metric-m" {
+			return "", "primary", 0, unavailable()
+		}
+		return "ok", "secondary", 1, nil
+	}
+	s := New(1, 1, provider, WithRetryPolicy(RetryPolicy{
+		MaxAttempts: 1,
+		Fallbacks:   map[string][]string{"metric-m": {"metric-fb"}},
+	}))
+	defer s.Shutdown(context.Background())
+
+	if res := runJob(t, s, context.Background(), "metric-m"); res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	if got := testutil.ToFloat64(obs.Retries.WithLabelValues("secondary", "metric-fb", "fallback")); got != 1 {
+		t.Fatalf("fallback retries for the fallback's provider = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(obs.Retries.WithLabelValues("primary", "metric-fb", "fallback")); got != 0 {
+		t.Fatalf("fallback retries labelled with the failed provider = %v, want 0", got)
+	}
+}
+
+func TestRetry_PerCallTimeoutIsRetried(t *testing.T) {
+	// What an http.Client.Timeout error looks like to errors.Is.
+	timeout := fmt.Errorf("Post \"https://provider.example\": %w", context.DeadlineExceeded)
+	p := &scripted{errs: map[string][]error{"m": {timeout}}}
+	s := New(1, 1, p.call, WithRetryPolicy(RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}))
+	defer s.Shutdown(context.Background())
+
+	res := runJob(t, s, context.Background(), "m")
+	if res.Err != nil || len(res.Attempts) != 2 {
+		t.Fatalf("err=%v attempts=%+v, want the timed-out call retried", res.Err, res.Attempts)
+	}
+}
+
+func TestRetry_StopsBeforeDeadline(t *testing.T) {
+	p := &scripted{errs: map[string][]error{"m": {unavailable(), unavailable()}}}
+	s := New(1, 1, p.call, WithRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Second}))
+	defer s.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	res := runJob(t, s, ctx, "m")
+	if res.Err == nil || len(res.Attempts) != 1 {
+		t.Fatalf("err=%v attempts=%+v", res.Err, res.Attempts)
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatalf("waited for a backoff that could not fit the deadline")
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&ProviderError{StatusCode: 429}, true},
+		{&ProviderError{StatusCode: 502}, true},
+		{&ProviderError{StatusCode: 401}, false},
+		{context.DeadlineExceeded, false},
+		{ErrInvalidRequest, false},
+	}
+	for _, c := range cases {
+		if got := Retryable(c.err); got != c.want {
+			t.Errorf("Retryable(%v) = %t, want %t", c.err, got, c.want)
+		}
+	}
+}
+
+func TestParseFallbacks(t *testing.T) {
+	got, err := ParseFallbacks("a=b|c, d=e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got["a"]) != 2 || got["a"][1] != "c" || got["d"][0] != "e" {
+		t.Fatalf("got %v", got)
+	}
+	if _, err := ParseFallbacks("a"); err == nil {
+		t.Fatal("expected error for missing chain")
+	}
+}
@@ -0,0 +1,214 @@
+package guardrails
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+)
+
+// Blocklist refuses requests that mention any of terms (case-insensitive,
+// whole words where a term starts or ends with a letter or digit). Blank
+// terms are ignored.
+func Blocklist(terms []string) Guardrail {
+	var alts []string
+	for _, t := range terms {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		p := regexp.QuoteMeta(t)
+		if r, _ := utf8.DecodeRuneInString(t); isWord(r) {
+			p = `\b` + p
+		}
+		if r, _ := utf8.DecodeLastRuneInString(t); isWord(r) {
+			p += `\b`
+		}
+		alts = append(alts, p)
+	}
+	re := regexp.MustCompile(`(?i)(?:` + strings.Join(alts, "|") + `)`) // quoted terms always compile
+
+	return Guardrail{Name: "blocklist", Check: func(ctx context.Context, req dispatcher.InferenceRequest) (dispatcher.InferenceRequest, dispatcher.GuardrailDecision) {
+		for _, m := range req.Conversation() {
+			if len(alts) == 0 {
+				break
+			}
+			if hit := re.FindString(m.Content); hit != "" {
+				return req, dispatcher.GuardrailDecision{Action: Reject, Reason: "blocked term", Detail: fmt.Sprintf("term=%q", strings.ToLower(hit))}
+			}
+		}
+		return req, dispatcher.GuardrailDecision{Action: Allow}
+	}}
+}
+
+func isWord(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// PromptLength refuses requests whose estimated prompt plus max_tokens
+// exceeds the model's context window, instead of paying for a provider
+// error. Models with an unknown window (0) pass.
+func PromptLength(window func(model string) int) Guardrail {
+	return Guardrail{Name: "length", Check: func(ctx context.Context, req dispatcher.InferenceRequest) (dispatcher.InferenceRequest, dispatcher.GuardrailDecision) {
+		w := window(req.Model)
+		if w <= 0 {
+			return req, dispatcher.GuardrailDecision{Action: Allow}
+		}
+		prompt := estimateTokens(req)
+		out := 0
+		if req.Params.MaxTokens != nil {
+			out = *req.Params.MaxTokens
+		}
+		if prompt+out <= w {
+			return req, dispatcher.GuardrailDecision{Action: Allow}
+		}
+		return req, dispatcher.GuardrailDecision{
+			Action: Reject,
+			Reason: fmt.Sprintf("prompt of about %d tokens plus max_tokens %d exceeds the %d-token context window of %s", prompt, out, w, req.Model),
+			Detail: fmt.Sprintf("prompt_tokens~%d max_tokens=%d context_window=%d", prompt, out, w),
+		}
+	}}
+}
+
+// estimateTokens approximates the prompt's tokens as four characters each,
+// plus a few per turn for the chat template.
+func estimateTokens(req dispatcher.InferenceRequest) int {
+	n := 0
+	for _, m := range req.Conversation() {
+		n += utf8.RuneCountInString(m.Content)/4 + 4
+	}
+	return n
+}
+
+var (
+	emailRe = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	cardRe  = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+
+	// Phone numbers need a phone's shape, so dates, times and plain figures
+	// pass: a "+" and country code followed by digit groups, or a
+	// North American style (555) 123-4567 / 555-123-4567 / 555.123.4567.
+	phoneRe = regexp.MustCompile(`\+\d{1,3}(?:[ .-]?\(\d{1,4}\))?(?:[ .-]?\d{1,4}){2,5}\b|(?:\(\d{3}\) ?|\b\d{3}[ .-])\d{3}[ .-]\d{4}\b`)
+)
+
+// PII finds email addresses, card numbers (13-19 digits passing the Luhn
+// check) and phone numbers (see phoneRe; 8-15 digits) in every turn, and
+// replaces them with [EMAIL], [CARD] and [PHONE], or refuses the request
+// when reject is set.
+func PII(reject bool) Guardrail {
+	return Guardrail{Name: "pii", Check: func(ctx context.Context, req dispatcher.InferenceRequest) (dispatcher.InferenceRequest, dispatcher.GuardrailDecision) {
+		out, emails, phones, cards := redactPII(req)
+		if emails+cards+phones == 0 {
+			return req, dispatcher.GuardrailDecision{Action: Allow}
+		}
+
+		var found []string
+		for _, c := range []struct {
+			kind string
+			n    int
+		}{{"email", emails}, {"phone", phones}, {"card", cards}} {
+			if c.n > 0 {
+				found = append(found, fmt.Sprintf("%s=%d", c.kind, c.n))
+			}
+		}
+		detail := strings.Join(found, " ")
+		if reject {
+			return req, dispatcher.GuardrailDecision{Action: Reject, Reason: "personal data in prompt", Detail: detail}
+		}
+		return out, dispatcher.GuardrailDecision{Action: Modify, Reason: "personal data redacted", Detail: detail}
+	}}
+}
+
+// redactPII masks the personal data in every turn of req and counts it.
+func redactPII(req dispatcher.InferenceRequest) (out dispatcher.InferenceRequest, emails, phones, cards int) {
+	out = rewrite(req, nil, func(s string) string {
+		s = emailRe.ReplaceAllStringFunc(s, func(string) string {
+			emails++
+			return "[EMAIL]"
+		})
+		// Phones first: an international number can pass the Luhn check.
+		s = phoneRe.ReplaceAllStringFunc(s, func(m string) string {
+			if n := len(digits(m)); n < 8 || n > 15 {
+				return m
+			}
+			phones++
+			return "[PHONE]"
+		})
+		return cardRe.ReplaceAllStringFunc(s, func(m string) string {
+			if !luhn(digits(m)) {
+				return m
+			}
+			cards++
+			return "[CARD]"
+		})
+	})
+	return out, emails, phones, cards
+}
+
+func digits(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if '0' <= r && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// luhn reports whether a 13-19 digit number has a valid Luhn check digit.
+func luhn(num string) bool {
+	if len(num) < 13 || len(num) > 19 {
+		return false
+	}
+	sum := 0
+	for i := range len(num) {
+		d := int(num[len(num)-1-i] - '0')
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// injectionSignals are independent hints that a user turn tries to override
+// the model's instructions.
+var injectionSignals = []struct {
+	name string
+	re   *regexp.Regexp
+}{
+	{"ignore_instructions", regexp.MustCompile(`(?i)\b(?:ignore|disregard|forget|override)\b[^.\n]{0,40}\b(?:previous|prior|above|earlier|all|your|system)\b[^.\n]{0,20}\b(?:instructions?|prompts?|rules|directions|guidelines)\b`)},
+	{"reveal_prompt", regexp.MustCompile(`(?i)\b(?:reveal|show|print|repeat|output|leak)\b[^.\n]{0,30}\b(?:system|hidden|initial|original)\s+(?:prompt|instructions?|message)`)},
+	{"persona_override", regexp.MustCompile(`(?i)\byou are now\b|\bact as an? (?:unfiltered|unrestricted|jailbroken)\b|\b(?:developer|god|DAN) mode\b|\bjailbreak`)},
+	{"role_tags", regexp.MustCompile(`(?im)<\|?(?:im_start|im_end|system|endoftext)\|?>|^\s*#{2,}\s*(?:system|instructions?)\b|\[/?(?:INST|SYS)\]`)},
+}
+
+// Injection looks for prompt-injection signals in user turns. A request with
+// at least rejectAt distinct signals is refused; one with fewer is passed on
+// and recorded. rejectAt 0 never refuses.
+func Injection(rejectAt int) Guardrail {
+	return Guardrail{Name: "injection", Check: func(ctx context.Context, req dispatcher.InferenceRequest) (dispatcher.InferenceRequest, dispatcher.GuardrailDecision) {
+		var hits []string
+		for _, sig := range injectionSignals {
+			for _, m := range req.Conversation() {
+				if m.Role == dispatcher.RoleUser && sig.re.MatchString(m.Content) {
+					hits = append(hits, sig.name)
+					break
+				}
+			}
+		}
+		switch {
+		case len(hits) == 0:
+			return req, dispatcher.GuardrailDecision{Action: Allow}
+		case rejectAt > 0 && len(hits) >= rejectAt:
+			return req, dispatcher.GuardrailDecision{Action: Reject, Reason: "likely prompt injection", Detail: strings.Join(hits, ",")}
+		default:
+			return req, dispatcher.GuardrailDecision{Action: Allow, Reason: "possible prompt injection", Detail: strings.Join(hits, ",")}
+		}
+	}}
+}
@@ -0,0 +1,206 @@
+// Package guardrails checks requests before they reach a provider: blocked
+// terms, prompts that cannot fit the model's context window, personal data
+// and prompt injection. Each guardrail can allow, rewrite or refuse a
+// request, and its decisions travel with the result in
+// dispatcher.ResultMeta.Guardrails.
+package guardrails
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/obs"
+)
+
+// Actions a guardrail can take.
+const (
+	Allow  = "allow"  // pass the request on unchanged; recorded only with a Reason
+	Modify = "modify" // pass on the rewritten request
+	Reject = "reject" // refuse the request
+)
+
+// ErrRejected is matched by *RejectedError.
+var ErrRejected = errors.New("rejected by guardrail")
+
+// RejectedError is the error of a request a guardrail refused. It also
+// matches dispatcher.ErrInvalidRequest, so it is not retried and the API
+// answers 400.
+type RejectedError struct {
+	Guardrail string
+	Reason    string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("rejected by guardrail %s: %s", e.Guardrail, e.Reason)
+}
+
+func (e *RejectedError) Unwrap() []error { return []error{ErrRejected, dispatcher.ErrInvalidRequest} }
+
+// Guardrail is one named check. Check returns the request to pass on (only
+// read for Modify) and its decision; the Guardrail field is filled in.
+type Guardrail struct {
+	Name  string
+	Check func(ctx context.Context, req dispatcher.InferenceRequest) (dispatcher.InferenceRequest, dispatcher.GuardrailDecision)
+}
+
+// Pipeline runs guardrails in order; the first rejection stops it.
+type Pipeline struct {
+	guards []Guardrail
+}
+
+func New(guards ...Guardrail) *Pipeline {
+	return &Pipeline{guards: guards}
+}
+
+// Len returns the number of guardrails.
+func (p *Pipeline) Len() int { return len(p.guards) }
+
+// Apply runs the guardrails on req, records their decisions on ctx's
+// ResultMeta and returns the request to send, or a *RejectedError.
+func (p *Pipeline) Apply(ctx context.Context, req dispatcher.InferenceRequest) (dispatcher.InferenceRequest, error) {
+	meta := dispatcher.MetaFromContext(ctx)
+	for _, g := range p.guards {
+		out, d := g.Check(ctx, req)
+		d.Guardrail = g.Name
+		switch d.Action {
+		case Modify:
+			req = out
+		case Reject:
+		default:
+			if d.Reason == "" {
+				continue
+			}
+			d.Action = Allow
+		}
+		meta.Guardrails = append(meta.Guardrails, d)
+		obs.GuardrailDecisions.WithLabelValues(g.Name, d.Action).Inc()
+		if d.Action == Reject {
+			return req, &RejectedError{Guardrail: g.Name, Reason: d.Reason}
+		}
+	}
+	return req, nil
+}
+
+// Redact masks personal data in req the way the pii guardrail does, for
+// callers that store requests before dispatching them; it records nothing.
+// Without a pii guardrail req is returned unchanged.
+func (p *Pipeline) Redact(req dispatcher.InferenceRequest) dispatcher.InferenceRequest {
+	for _, g := range p.guards {
+		if g.Name == "pii" {
+			out, _, _, _ := redactPII(req)
+			return out
+		}
+	}
+	return req
+}
+
+// Middleware guards a dispatcher.ProviderFunc; add it with
+// dispatcher.WithMiddleware ahead of the cache so redacted prompts are what
+// gets cached.
+func (p *Pipeline) Middleware(next dispatcher.ProviderFunc) dispatcher.ProviderFunc {
+	return func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		req, err := p.Apply(ctx, req)
+		if err != nil {
+			return "", "guardrails", 0, err
+		}
+		return next(ctx, req)
+	}
+}
+
+// Stream guards a stream provider, which dispatcher middleware does not
+// reach; install it with dispatcher.WithStreamMiddleware so a rejection
+// never counts against the circuit breaker.
+func (p *Pipeline) Stream(next dispatcher.StreamProviderFunc) dispatcher.StreamProviderFunc {
+	return func(ctx context.Context, req dispatcher.InferenceRequest, onDelta func(string) error) (string, int, error) {
+		req, err := p.Apply(ctx, req)
+		if err != nil {
+			return "guardrails", 0, err
+		}
+		return next(ctx, req, onDelta)
+	}
+}
+
+// Names of the built-in guardrails, in the order Build runs them.
+var Names = []string{"blocklist", "length", "pii", "injection"}
+
+// Config selects and tunes the built-in guardrails.
+type Config struct {
+	Enabled []string // from Names; see ParseNames
+
+	Blocklist []string // terms refused anywhere in the conversation; blocklist is skipped when empty
+
+	// ContextWindow returns a model's context window in tokens, 0 if
+	// unknown (e.g. a models.Catalog lookup); length is skipped when nil.
+	ContextWindow func(model string) int
+
+	RejectPII bool // refuse requests with personal data instead of redacting it
+
+	// InjectionRejectAt is how many distinct injection signals refuse a
+	// request; fewer are only recorded. 0 only records.
+	InjectionRejectAt int
+}
+
+// ParseNames parses "blocklist,pii"; "none" enables nothing.
+func ParseNames(s string) ([]string, error) {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		name := strings.TrimSpace(part)
+		switch {
+		case name == "" || name == "none":
+			continue
+		case !slices.Contains(Names, name):
+			return nil, fmt.Errorf("unknown guardrail %q (want %s)", name, strings.Join(Names, ", "))
+		}
+		out = append(out, name)
+	}
+	return out, nil
+}
+
+// Build returns the pipeline c describes.
+func Build(c Config) *Pipeline {
+	var guards []Guardrail
+	for _, name := range Names {
+		if !slices.Contains(c.Enabled, name) {
+			continue
+		}
+		switch name {
+		case "blocklist":
+			if len(c.Blocklist) > 0 {
+				guards = append(guards, Blocklist(c.Blocklist))
+			}
+		case "length":
+			if c.ContextWindow != nil {
+				guards = append(guards, PromptLength(c.ContextWindow))
+			}
+		case "pii":
+			guards = append(guards, PII(c.RejectPII))
+		case "injection":
+			guards = append(guards, Injection(c.InjectionRejectAt))
+		}
+	}
+	return New(guards...)
+}
+
+// rewrite returns req with f applied to the content of every turn whose role
+// passes roles (nil = all).
+func rewrite(req dispatcher.InferenceRequest, roles func(string) bool, f func(string) string) dispatcher.InferenceRequest {
+	if len(req.Messages) == 0 {
+		if roles == nil || roles(dispatcher.RoleUser) {
+			req.Prompt = f(req.Prompt)
+		}
+		return req
+	}
+	msgs := make([]dispatcher.Message, len(req.Messages))
+	for i, m := range req.Messages {
+		if roles == nil || roles(m.Role) {
+			m.Content = f(m.Content)
+		}
+		msgs[i] = m
+	}
+	req.Messages = msgs
+	return req
+}
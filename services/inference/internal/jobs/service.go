@@ -0,0 +1,369 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+)
+
+var (
+	ErrNotFound = errors.New("job not found")
+	ErrFinished = errors.New("job already finished")
+)
+
+const (
+	// heartbeatEvery is how often a process refreshes heartbeat_at on the
+	// jobs it is running; an unfinished job whose heartbeat is older than
+	// staleAfter lost its process and is failed by Run.
+	heartbeatEvery = 15 * time.Second
+	staleAfter     = 4 * heartbeatEvery
+)
+
+type Status string
+
+const (
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+)
+
+// Job is one asynchronous inference request as stored in inference_jobs.
+type Job struct {
+	ID         string                      `json:"id"`
+	Status     Status                      `json:"status"`
+	Model      string                      `json:"model"`
+	Request    dispatcher.InferenceRequest `json:"request"`
+	Result     *Result                     `json:"result,omitempty"`
+	Error      string                      `json:"error,omitempty"`
+	CreatedAt  time.Time                   `json:"created_at"`
+	StartedAt  *time.Time                  `json:"started_at,omitempty"`
+	FinishedAt *time.Time                  `json:"finished_at,omitempty"`
+}
+
+type Result struct {
+	Text             string             `json:"text"`
+	Provider         string             `json:"provider"`
+	Model            string             `json:"model"`
+	TokenUsage       int                `json:"token_usage"`
+	PromptTokens     int                `json:"prompt_tokens"`
+	CompletionTokens int                `json:"completion_tokens"`
+	FinishReason     string             `json:"finish_reason,omitempty"`
+	Safety           *dispatcher.Safety `json:"safety,omitempty"`
+}
+
+// Service runs inference jobs on the dispatcher and keeps their state in
+// Postgres so clients can poll instead of holding a connection open.
+type Service struct {
+	db      *pgxpool.Pool
+	disp    *dispatcher.Server
+	timeout time.Duration // per job, queue wait included
+
+	// redact masks what is stored (and returned by Get); the dispatcher
+	// still gets the request as submitted. Optional.
+	redact func(dispatcher.InferenceRequest) dispatcher.InferenceRequest
+
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc // jobs running in this process
+}
+
+type Option func(*Service)
+
+// WithRedactor masks personal data in requests before they are stored.
+func WithRedactor(f func(dispatcher.InferenceRequest) dispatcher.InferenceRequest) Option {
+	return func(s *Service) { s.redact = f }
+}
+
+func NewService(db *pgxpool.Pool, disp *dispatcher.Server, timeout time.Duration, opts ...Option) *Service {
+	s := &Service{db: db, disp: disp, timeout: timeout, cancels: map[string]context.CancelFunc{}}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Submit stores a queued job and hands it to the dispatcher; key and
+// budgetKey are the dispatcher.InferenceJob fields. The job belongs to
+// budgetKey: Get and Cancel find it only for the same owner. It returns
+// dispatcher.ErrQueueFull (and stores nothing) when the queue is full.
+func (s *Service) Submit(ctx context.Context, req dispatcher.InferenceRequest, key, budgetKey string, prio dispatcher.Priority) (Job, dispatcher.QueueStats, error) {
+	stored := req
+	if s.redact != nil {
+		stored = s.redact(req)
+	}
+	body, err := json.Marshal(stored)
+	if err != nil {
+		return Job{}, dispatcher.QueueStats{}, err
+	}
+
+	job := Job{Status: StatusQueued, Model: req.Model, Request: stored}
+	err = s.db.QueryRow(ctx, `
+insert into inference_jobs (request, model, owner_key, heartbeat_at)
+values ($1, $2, $3, now())
+returning id::text, created_at
+`, body, req.Model, budgetKey).Scan(&job.ID, &job.CreatedAt)
+	if err != nil {
+		return Job{}, dispatcher.QueueStats{}, err
+	}
+
+	jobCtx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	replyCh := make(chan dispatcher.InferenceResult, 1)
+	id := job.ID
+	stats, err := s.disp.TryEnqueue(dispatcher.InferenceJob{
+		Req:        req,
+		Ctx:        jobCtx,
+		ReplyCh:    replyCh,
+		EnqueuedAt: time.Now(),
+		Key:        key,
+		BudgetKey:  budgetKey,
+		Priority:   prio,
+		RequestID:  "job:" + id,
+		OnStart:    func() { go s.markRunning(id) },
+	})
+	if err != nil {
+		cancel()
+		if _, delErr := s.db.Exec(context.WithoutCancel(ctx), `delete from inference_jobs where id = $1`, id); delErr != nil {
+			log.Printf(`msg="job cleanup failed" job_id=%s err=%q`, id, delErr.Error())
+		}
+		return Job{}, stats, err
+	}
+
+	s.mu.Lock()
+	s.cancels[id] = cancel
+	s.mu.Unlock()
+
+	go s.await(id, cancel, replyCh)
+	return job, stats, nil
+}
+
+// await records the dispatcher's reply for job id.
+func (s *Service) await(id string, cancel context.CancelFunc, replyCh <-chan dispatcher.InferenceResult) {
+	res := <-replyCh
+	cancel()
+
+	s.mu.Lock()
+	delete(s.cancels, id)
+	s.mu.Unlock()
+
+	ctx, done := context.WithTimeout(context.Background(), 5*time.Second)
+	defer done()
+
+	var err error
+	if res.Err != nil {
+		// A job cancelled via DELETE is already final; the guard keeps it so.
+		_, err = s.db.Exec(ctx, `
+update inference_jobs
+set status = 'failed', error = $2, provider = nullif($3, ''), finished_at = now()
+where id = $1 and status in ('queued', 'running')
+`, id, res.Err.Error(), res.Provider)
+	} else {
+		_, err = s.db.Exec(ctx, `
+update inference_jobs
+set status = 'succeeded', provider = $2, answered_model = coalesce(nullif($3, ''), model), result_text = $4,
+    token_usage = $5, prompt_tokens = $6, completion_tokens = $7,
+    finish_reason = nullif($8, ''), safety = $9, finished_at = now()
+where id = $1 and status in ('queued', 'running')
+`, id, res.Provider, res.Model, res.Text, res.TokenUsage, res.Meta.PromptTokens, res.Meta.CompletionTokens, res.Meta.FinishReason, res.Meta.Safety)
+	}
+	if err != nil {
+		log.Printf(`msg="job result not saved" job_id=%s err=%q`, id, err.Error())
+	}
+}
+
+func (s *Service) markRunning(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.db.Exec(ctx, `
+update inference_jobs
+set status = 'running', started_at = now()
+where id = $1 and status = 'queued'
+`, id); err != nil {
+		log.Printf(`msg="job start not saved" job_id=%s err=%q`, id, err.Error())
+	}
+}
+
+// Run keeps the heartbeat of this process's jobs fresh and fails jobs, from
+// any process, whose heartbeat went stale, every heartbeatEvery until ctx
+// ends. A failed job is not retried: its client may have given up, and a
+// re-run would bill it twice.
+func (s *Service) Run(ctx context.Context) error {
+	t := time.NewTicker(heartbeatEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+		s.beat(ctx)
+		if err := s.sweep(ctx); err != nil && ctx.Err() == nil {
+			log.Printf(`msg="job sweep failed" err=%q`, err.Error())
+		}
+	}
+}
+
+// beat refreshes heartbeat_at on the jobs running in this process.
+func (s *Service) beat(ctx context.Context) {
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.cancels))
+	for id := range s.cancels {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+	if _, err := s.db.Exec(ctx, `
+update inference_jobs
+set heartbeat_at = now()
+where id = any($1::uuid[]) and status in ('queued', 'running')
+`, ids); err != nil && ctx.Err() == nil {
+		log.Printf(`msg="job heartbeat failed" jobs=%d err=%q`, len(ids), err.Error())
+	}
+}
+
+// sweep fails unfinished jobs whose process stopped heartbeating.
+func (s *Service) sweep(ctx context.Context) error {
+	tag, err := s.db.Exec(ctx, `
+update inference_jobs
+set status = 'failed', error = 'job lost: the process running it stopped', finished_at = now()
+where status in ('queued', 'running')
+  and coalesce(heartbeat_at, created_at) < now() - make_interval(secs => $1)
+`, staleAfter.Seconds())
+	if err != nil {
+		return err
+	}
+	if n := tag.RowsAffected(); n > 0 {
+		log.Printf(`msg="stale jobs failed" count=%d`, n)
+	}
+	return nil
+}
+
+// Get returns owner's job by ID.
+func (s *Service) Get(ctx context.Context, id, owner string) (Job, error) {
+	if !validID(id) {
+		return Job{}, ErrNotFound
+	}
+
+	var (
+		j                     Job
+		reqJSON               []byte
+		provider, model, text *string
+		errMsg, finishReason  *string
+		tokens, prompt, compl *int32
+		safety                *dispatcher.Safety
+	)
+	err := s.db.QueryRow(ctx, `
+select id::text, status, model, request, provider, answered_model, result_text, error,
+       token_usage, prompt_tokens, completion_tokens, finish_reason, safety,
+       created_at, started_at, finished_at
+from inference_jobs
+where id = $1 and owner_key = $2
+`, id, owner).Scan(&j.ID, &j.Status, &j.Model, &reqJSON, &provider, &model, &text, &errMsg,
+		&tokens, &prompt, &compl, &finishReason, &safety,
+		&j.CreatedAt, &j.StartedAt, &j.FinishedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Job{}, ErrNotFound
+		}
+		return Job{}, err
+	}
+	if err := json.Unmarshal(reqJSON, &j.Request); err != nil {
+		return Job{}, err
+	}
+	if errMsg != nil {
+		j.Error = *errMsg
+	}
+	if j.Status == StatusSucceeded {
+		j.Result = &Result{
+			Text:             deref(text),
+			Provider:         deref(provider),
+			Model:            deref(model),
+			TokenUsage:       int(derefInt(tokens)),
+			PromptTokens:     int(derefInt(prompt)),
+			CompletionTokens: int(derefInt(compl)),
+			FinishReason:     deref(finishReason),
+			Safety:           safety,
+		}
+	}
+	return j, nil
+}
+
+// Cancel stops owner's queued or running job. It returns ErrFinished for
+// jobs that already have an outcome.
+func (s *Service) Cancel(ctx context.Context, id, owner string) (Job, error) {
+	if !validID(id) {
+		return Job{}, ErrNotFound
+	}
+
+	tag, err := s.db.Exec(ctx, `
+update inference_jobs
+set status = 'cancelled', error = 'cancelled', finished_at = now()
+where id = $1 and owner_key = $2 and status in ('queued', 'running')
+`, id, owner)
+	if err != nil {
+		return Job{}, err
+	}
+
+	// The job may be running in another instance; it will find its row
+	// already final when it finishes.
+	if tag.RowsAffected() > 0 {
+		s.mu.Lock()
+		if cancel, ok := s.cancels[id]; ok {
+			cancel()
+		}
+		s.mu.Unlock()
+	}
+
+	j, err := s.Get(ctx, id, owner)
+	if err != nil {
+		return Job{}, err
+	}
+	if tag.RowsAffected() == 0 {
+		return j, ErrFinished
+	}
+	return j, nil
+}
+
+// validID reports whether id looks like a UUID, so malformed IDs are a 404
+// instead of a Postgres cast error.
+func validID(id string) bool {
+	if len(id) != 36 {
+		return false
+	}
+	for i, c := range id {
+		switch {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if c != '-' {
+				return false
+			}
+		case '0' <= c && c <= '9', 'a' <= c && c <= 'f', 'A' <= c && c <= 'F':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func derefInt(n *int32) int32 {
+	if n == nil {
+		return 0
+	}
+	return *n
+}
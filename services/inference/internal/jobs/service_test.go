@@ -0,0 +1,197 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+)
+
+func TestValidID(t *testing.T) {
+	cases := map[string]bool{
+		"3f1c2a9e-5b7d-4c1e-9a2b-0d4e6f8a1b2c": true,
+		"3F1C2A9E-5B7D-4C1E-9A2B-0D4E6F8A1B2C": true,
+		"3f1c2a9e5b7d4c1e9a2b0d4e6f8a1b2c":     false,
+		"3f1c2a9e-5b7d-4c1e-9a2b-0d4e6f8a1b2g": false,
+		"1":                                    false,
+		"":                                     false,
+	}
+	for id, want := range cases {
+		if got := validID(id); got != want {
+			t.Errorf("validID(%q) = %t, want %t", id, got, want)
+		}
+	}
+}
+
+// testDB connects to the migrated Postgres in TEST_PG_URL, with a temporary
+// copy of inference_jobs so the real one is not modified.
+func testDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("TEST_PG_URL")
+	if url == "" {
+		t.Skip("TEST_PG_URL not set")
+	}
+	cfg, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.MaxConns = 1 // the temp table lives on one connection
+	db, err := pgxpool.NewWithConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	if _, err := db.Exec(context.Background(),
+		`create temp table inference_jobs (like public.inference_jobs including defaults)`); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// waitFor polls owner's job until it reaches want.
+func waitFor(t *testing.T, s *Service, id, owner string, want Status) Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		j, err := s.Get(context.Background(), id, owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.Status == want {
+			return j
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is %s, want %s", id, j.Status, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+const testOwner = "ip:203.0.113.7"
+
+func TestService_SubmitThenGet(t *testing.T) {
+	ctx := context.Background()
+	sent := make(chan string, 1)
+	disp := dispatcher.New(10, 1, func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		sent <- req.Prompt
+		return "hi there", "fake", 3, nil
+	})
+	defer disp.Shutdown(ctx)
+	mask := func(req dispatcher.InferenceRequest) dispatcher.InferenceRequest {
+		req.Prompt = strings.ReplaceAll(req.Prompt, "a@b.example", "[email]")
+		return req
+	}
+	s := NewService(testDB(t), disp, time.Minute, WithRedactor(mask))
+
+	job, _, err := s.Submit(ctx, dispatcher.InferenceRequest{Prompt: "mail a@b.example", Model: "m"}, "lane", testOwner, dispatcher.PriorityInteractive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := waitFor(t, s, job.ID, testOwner, StatusSucceeded)
+	if got.Result == nil || got.Result.Text != "hi there" || got.Result.Provider != "fake" || got.Result.TokenUsage != 3 {
+		t.Fatalf("result = %+v", got.Result)
+	}
+	if seen := <-sent; got.Request.Prompt != "mail [email]" || seen != "mail a@b.example" {
+		t.Fatalf("stored %q, provider saw %q; want only the stored copy masked", got.Request.Prompt, seen)
+	}
+}
+
+func TestService_ScopesJobsToTheirOwner(t *testing.T) {
+	ctx := context.Background()
+	disp := dispatcher.New(10, 1, func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		return "ok", "fake", 1, nil
+	})
+	defer disp.Shutdown(ctx)
+	s := NewService(testDB(t), disp, time.Minute)
+
+	job, _, err := s.Submit(ctx, dispatcher.InferenceRequest{Prompt: "hi", Model: "m"}, "", testOwner, dispatcher.PriorityInteractive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, s, job.ID, testOwner, StatusSucceeded)
+
+	const foreign = "ip:198.51.100.9"
+	if _, err := s.Get(ctx, job.ID, foreign); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get by another caller: err = %v, want ErrNotFound", err)
+	}
+	if _, err := s.Cancel(ctx, job.ID, foreign); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Cancel by another caller: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestService_CancelStopsTheProviderCall(t *testing.T) {
+	ctx := context.Background()
+	started := make(chan struct{}, 1)
+	stopped := make(chan error, 1)
+	disp := dispatcher.New(10, 1, func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		stopped <- ctx.Err()
+		return "", "fake", 0, ctx.Err()
+	}, dispatcher.WithRetryPolicy(dispatcher.RetryPolicy{MaxAttempts: 1}))
+	defer disp.Shutdown(ctx)
+	s := NewService(testDB(t), disp, time.Minute)
+
+	job, _, err := s.Submit(ctx, dispatcher.InferenceRequest{Prompt: "hi", Model: "m"}, "", testOwner, dispatcher.PriorityInteractive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	got, err := s.Cancel(ctx, job.ID, testOwner)
+	if err != nil || got.Status != StatusCancelled {
+		t.Fatalf("Cancel = %+v, %v", got, err)
+	}
+	select {
+	case err := <-stopped:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("provider ctx err = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("provider call was not cancelled")
+	}
+	if _, err := s.Cancel(ctx, job.ID, testOwner); !errors.Is(err, ErrFinished) {
+		t.Fatalf("second Cancel: err = %v, want ErrFinished", err)
+	}
+	// The failed call's reply must not overwrite the cancellation.
+	time.Sleep(50 * time.Millisecond)
+	if got, err := s.Get(ctx, job.ID, testOwner); err != nil || got.Status != StatusCancelled || got.Error != "cancelled" {
+		t.Fatalf("after the reply: %+v, %v", got, err)
+	}
+}
+
+func TestService_SweepFailsJobsWithStaleHeartbeats(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	s := NewService(db, nil, time.Minute)
+
+	var stale, fresh string
+	for _, row := range []struct {
+		id  *string
+		age time.Duration
+	}{{&stale, 2 * staleAfter}, {&fresh, heartbeatEvery}} {
+		if err := db.QueryRow(ctx, `
+insert into inference_jobs (status, request, model, owner_key, heartbeat_at)
+values ('running', '{}', 'm', $1, now() - make_interval(secs => $2))
+returning id::text
+`, testOwner, row.age.Seconds()).Scan(row.id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.sweep(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Get(ctx, stale, testOwner); err != nil || got.Status != StatusFailed || got.FinishedAt == nil || !strings.Contains(got.Error, "job lost") {
+		t.Fatalf("stale job = %+v, %v; want it failed as lost", got, err)
+	}
+	if got, err := s.Get(ctx, fresh, testOwner); err != nil || got.Status != StatusRunning {
+		t.Fatalf("fresh job = %+v, %v; want it left running", got, err)
+	}
+}
@@ -0,0 +1,164 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+)
+
+// DefaultRefresh is how often a Catalog re-reads eligible_models.
+const DefaultRefresh = time.Minute
+
+// Model is an active eligible_models row.
+type Model struct {
+	ID                 string     `json:"id"`
+	DisplayName        string     `json:"display_name"`
+	Category           string     `json:"category,omitempty"`
+	MaxOutputTokens    int        `json:"max_output_tokens,omitempty"`
+	MaxTemperature     float64    `json:"max_temperature,omitempty"`
+	ContextWindow      int        `json:"context_window,omitempty"`
+	Modality           string     `json:"modality,omitempty"`
+	InputPricePerMTok  *float64   `json:"input_price_per_mtok,omitempty"`
+	OutputPricePerMTok *float64   `json:"output_price_per_mtok,omitempty"`
+	DeprecatedAt       *time.Time `json:"deprecated_at,omitempty"` // scheduled retirement
+}
+
+// Limits returns the model's generation limits.
+func (m Model) Limits() dispatcher.ParamLimits {
+	return dispatcher.ParamLimits{MaxOutputTokens: m.MaxOutputTokens, MaxTemperature: m.MaxTemperature}
+}
+
+// UnknownModelError rejects a request for a model that is not in the
+// catalog, or no longer active. It matches ErrNotFound.
+type UnknownModelError struct {
+	Model string
+	Valid []string // active model IDs
+}
+
+func (e *UnknownModelError) Error() string {
+	if e.Model == "" {
+		return "model is required"
+	}
+	return fmt.Sprintf("unknown or inactive model %q", e.Model)
+}
+
+func (e *UnknownModelError) Unwrap() error { return ErrNotFound }
+
+// Catalog is an in-memory copy of the active models, refreshed in the
+// background so requests can be validated without a database round trip.
+// Until the first successful load it admits every model.
+type Catalog struct {
+	load  func(ctx context.Context) ([]Model, error)
+	every time.Duration
+
+	mu     sync.RWMutex
+	loaded bool
+	list   []Model // sorted by ID
+	byID   map[string]Model
+}
+
+// NewCatalog returns an empty catalog; load is usually Service.Active.
+// every <= 0 means DefaultRefresh.
+func NewCatalog(load func(ctx context.Context) ([]Model, error), every time.Duration) *Catalog {
+	if every <= 0 {
+		every = DefaultRefresh
+	}
+	return &Catalog{load: load, every: every}
+}
+
+// Refresh reloads the catalog now. On error the previous models are kept.
+func (c *Catalog) Refresh(ctx context.Context) error {
+	list, err := c.load(ctx)
+	if err != nil {
+		return err
+	}
+	c.Set(list)
+	return nil
+}
+
+// Set replaces the catalog's models.
+func (c *Catalog) Set(list []Model) {
+	list = slices.Clone(list)
+	slices.SortFunc(list, func(a, b Model) int { return strings.Compare(a.ID, b.ID) })
+	byID := make(map[string]Model, len(list))
+	for _, m := range list {
+		byID[m.ID] = m
+	}
+
+	c.mu.Lock()
+	c.loaded = true
+	c.list = list
+	c.byID = byID
+	c.mu.Unlock()
+}
+
+// Run refreshes the catalog every interval until ctx ends. Call Refresh
+// first if requests should be validated from the start.
+func (c *Catalog) Run(ctx context.Context) error {
+	t := time.NewTicker(c.every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			if err := c.Refresh(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("model catalog refresh error: %v (keeping the previous models)", err)
+			}
+		}
+	}
+}
+
+// Get returns the active model id.
+func (c *Catalog) Get(id string) (Model, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	m, ok := c.byID[id]
+	return m, ok
+}
+
+// ContextWindow returns the model's context window in tokens, 0 if the model
+// or its window is unknown.
+func (c *Catalog) ContextWindow(id string) int {
+	m, _ := c.Get(id)
+	return m.ContextWindow
+}
+
+// List returns the active models, sorted by ID; a non-empty category keeps
+// only the models in it (case-insensitive).
+func (c *Catalog) List(category string) []Model {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	out := make([]Model, 0, len(c.list))
+	for _, m := range c.list {
+		if category == "" || strings.EqualFold(m.Category, category) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// Check returns the model's limits, or an *UnknownModelError when id is not
+// an active model. ok is false while the catalog has not loaded yet.
+func (c *Catalog) Check(id string) (lim dispatcher.ParamLimits, ok bool, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.loaded {
+		return dispatcher.ParamLimits{}, false, nil
+	}
+	m, found := c.byID[id]
+	if !found {
+		valid := make([]string, len(c.list))
+		for i, m := range c.list {
+			valid[i] = m.ID
+		}
+		return dispatcher.ParamLimits{}, true, &UnknownModelError{Model: id, Valid: valid}
+	}
+	return m.Limits(), true, nil
+}
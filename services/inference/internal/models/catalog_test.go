@@ -0,0 +1,45 @@
+package models
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestCatalog_Check(t *testing.T) {
+	c := NewCatalog(nil, 0)
+	if _, ok, err := c.Check("anything"); ok || err != nil {
+		t.Fatalf("before load: ok=%v err=%v", ok, err)
+	}
+
+	c.Set([]Model{{ID: "b", MaxOutputTokens: 256}, {ID: "a"}})
+	lim, ok, err := c.Check("b")
+	if !ok || err != nil || lim.MaxOutputTokens != 256 {
+		t.Fatalf("b: lim=%+v ok=%v err=%v", lim, ok, err)
+	}
+
+	_, _, err = c.Check("gone")
+	var ume *UnknownModelError
+	if !errors.As(err, &ume) || !errors.Is(err, ErrNotFound) {
+		t.Fatalf("gone: err = %v", err)
+	}
+	if !slices.Equal(ume.Valid, []string{"a", "b"}) {
+		t.Fatalf("valid = %v", ume.Valid)
+	}
+}
+
+func TestCatalog_ListByCategory(t *testing.T) {
+	c := NewCatalog(nil, 0)
+	c.Set([]Model{{ID: "r1", Category: "reasoning"}, {ID: "f1", Category: "fast"}, {ID: "r2", Category: "Reasoning"}})
+
+	var ids []string
+	for _, m := range c.List("reasoning") {
+		ids = append(ids, m.ID)
+	}
+	if !slices.Equal(ids, []string{"r1", "r2"}) {
+		t.Fatalf("reasoning = %v", ids)
+	}
+	if n := len(c.List("")); n != 3 {
+		t.Fatalf("all = %d models", n)
+	}
+}
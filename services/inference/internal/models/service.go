@@ -0,0 +1,156 @@
+package models
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/usage"
+)
+
+var ErrNotFound = errors.New("model not found")
+
+// Service reads the eligible_models catalog.
+type Service struct {
+	db *pgxpool.Pool
+}
+
+func NewService(db *pgxpool.Pool) *Service {
+	return &Service{db: db}
+}
+
+// Limits returns the per-model generation limits for an active model.
+func (s *Service) Limits(ctx context.Context, id string) (dispatcher.ParamLimits, error) {
+	var (
+		maxTokens *int32
+		maxTemp   *float64
+	)
+	err := s.db.QueryRow(ctx, `
+select max_output_tokens, max_temperature
+from eligible_models
+where id = $1 and is_active
+`, id).Scan(&maxTokens, &maxTemp)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return dispatcher.ParamLimits{}, ErrNotFound
+		}
+		return dispatcher.ParamLimits{}, err
+	}
+
+	var lim dispatcher.ParamLimits
+	if maxTokens != nil {
+		lim.MaxOutputTokens = int(*maxTokens)
+	}
+	if maxTemp != nil {
+		lim.MaxTemperature = *maxTemp
+	}
+	return lim, nil
+}
+
+// Active returns every active model; see Catalog.
+func (s *Service) Active(ctx context.Context) ([]Model, error) {
+	rows, err := s.db.Query(ctx, `
+select id, display_name, coalesce(category, ''), coalesce(max_output_tokens, 0), coalesce(max_temperature, 0),
+       coalesce(context_window, 0), coalesce(modality, ''),
+       input_price_per_mtok::float8, output_price_per_mtok::float8, deprecated_at
+from eligible_models
+where is_active
+order by id
+`)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Model, error) {
+		var m Model
+		err := row.Scan(&m.ID, &m.DisplayName, &m.Category, &m.MaxOutputTokens, &m.MaxTemperature,
+			&m.ContextWindow, &m.Modality, &m.InputPricePerMTok, &m.OutputPricePerMTok, &m.DeprecatedAt)
+		return m, err
+	})
+}
+
+// RandomActive picks n distinct active models at random.
+func (s *Service) RandomActive(ctx context.Context, n int) ([]string, error) {
+	rows, err := s.db.Query(ctx, `
+select id
+from eligible_models
+where is_active
+order by random()
+limit $1
+`, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0, n)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) < n {
+		return nil, ErrNotFound
+	}
+	return ids, nil
+}
+
+// ConcurrencyLimits returns max_concurrency for the active models that set one.
+func (s *Service) ConcurrencyLimits(ctx context.Context) (dispatcher.ConcurrencyLimits, error) {
+	rows, err := s.db.Query(ctx, `
+select id, max_concurrency
+from eligible_models
+where is_active and max_concurrency is not null
+`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := dispatcher.ConcurrencyLimits{}
+	for rows.Next() {
+		var (
+			id string
+			n  int32
+		)
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		out[id] = int(n)
+	}
+	return out, rows.Err()
+}
+
+// Prices returns the price table for every model that has a price, active
+// or not, so calls answered by a retired fallback are still costed.
+func (s *Service) Prices(ctx context.Context) (usage.PriceTable, error) {
+	rows, err := s.db.Query(ctx, `
+select id, coalesce(input_price_per_mtok, 0)::float8, coalesce(output_price_per_mtok, 0)::float8
+from eligible_models
+where input_price_per_mtok is not null or output_price_per_mtok is not null
+`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := usage.PriceTable{}
+	for rows.Next() {
+		var (
+			id string
+			p  usage.Price
+		)
+		if err := rows.Scan(&id, &p.InputPerMTok, &p.OutputPerMTok); err != nil {
+			return nil, err
+		}
+		out[id] = p
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,178 @@
+package modelsync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Listed is one model from a provider listing.
+type Listed struct {
+	ID                 string
+	Name               string
+	ContextWindow      int      // 0 = unknown
+	InputPricePerMTok  *float64 // nil = unknown or variable
+	OutputPricePerMTok *float64
+	Modality           string
+	DeprecatedAt       *time.Time
+}
+
+// Free reports whether both prices are known to be zero.
+func (m Listed) Free() bool {
+	return m.InputPricePerMTok != nil && *m.InputPricePerMTok == 0 &&
+		m.OutputPricePerMTok != nil && *m.OutputPricePerMTok == 0
+}
+
+// Filter selects which listed models are synced. The zero value keeps all.
+type Filter struct {
+	Include  *regexp.Regexp // on the model ID
+	FreeOnly bool
+	Modality string // exact, e.g. "text->text"
+}
+
+// Apply returns the models f keeps.
+func (f Filter) Apply(in []Listed) []Listed {
+	out := make([]Listed, 0, len(in))
+	for _, m := range in {
+		if f.Include != nil && !f.Include.MatchString(m.ID) {
+			continue
+		}
+		if f.FreeOnly && !m.Free() {
+			continue
+		}
+		if f.Modality != "" && m.Modality != f.Modality {
+			continue
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// DefaultOpenRouterURL is OpenRouter's model listing.
+const DefaultOpenRouterURL = "https://openrouter.ai/api/v1/models"
+
+// Load reads a listing from an http(s) URL or a local JSON file in the same
+// format, for offline runs (e.g. a saved copy of the OpenRouter response).
+func Load(ctx context.Context, client *http.Client, source, apiKey string) ([]Listed, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return ParseOpenRouter(f)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("GET %s: %s: %s", source, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return ParseOpenRouter(resp.Body)
+}
+
+type openRouterModel struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	ContextLength int    `json:"context_length"`
+	Architecture  struct {
+		Modality string `json:"modality"`
+	} `json:"architecture"`
+	Pricing struct {
+		Prompt     string `json:"prompt"`
+		Completion string `json:"completion"`
+	} `json:"pricing"`
+	TopProvider struct {
+		ContextLength int `json:"context_length"`
+	} `json:"top_provider"`
+	ExpirationDate string `json:"expiration_date"`
+}
+
+// ParseOpenRouter parses a /models response ({"data": [...]}) or a bare
+// array of the same objects.
+func ParseOpenRouter(r io.Reader) ([]Listed, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var models []openRouterModel
+	if trimmed := strings.TrimSpace(string(raw)); strings.HasPrefix(trimmed, "[") {
+		err = json.Unmarshal(raw, &models)
+	} else {
+		var env struct {
+			Data []openRouterModel `json:"data"`
+		}
+		err = json.Unmarshal(raw, &env)
+		models = env.Data
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse listing: %w", err)
+	}
+
+	out := make([]Listed, 0, len(models))
+	for _, m := range models {
+		if m.ID == "" {
+			return nil, errors.New("parse listing: model without id")
+		}
+		l := Listed{
+			ID:                 m.ID,
+			Name:               m.Name,
+			ContextWindow:      m.ContextLength,
+			Modality:           m.Architecture.Modality,
+			InputPricePerMTok:  perMTok(m.Pricing.Prompt),
+			OutputPricePerMTok: perMTok(m.Pricing.Completion),
+		}
+		if l.Name == "" {
+			l.Name = m.ID
+		}
+		if l.ContextWindow == 0 {
+			l.ContextWindow = m.TopProvider.ContextLength
+		}
+		if m.ExpirationDate != "" {
+			t, err := parseDate(m.ExpirationDate)
+			if err != nil {
+				return nil, fmt.Errorf("parse listing: %s: expiration_date: %w", m.ID, err)
+			}
+			l.DeprecatedAt = &t
+		}
+		out = append(out, l)
+	}
+	return out, nil
+}
+
+// perMTok converts a USD-per-token price string. Negative prices mark
+// variable pricing (e.g. openrouter/auto) and are treated as unknown.
+func perMTok(s string) *float64 {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return nil
+	}
+	v *= 1e6
+	return &v
+}
+
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
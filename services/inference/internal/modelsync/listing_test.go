@@ -0,0 +1,64 @@
+package modelsync
+
+import (
+	"os"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestParseOpenRouter(t *testing.T) {
+	f, err := os.Open("testdata/openrouter_models.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	listed, err := ParseOpenRouter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 4 {
+		t.Fatalf("got %d models", len(listed))
+	}
+
+	flash := listed[1]
+	if flash.ContextWindow != 1048576 || flash.Modality != "text+image->text" {
+		t.Fatalf("flash = %+v", flash)
+	}
+	if *flash.InputPricePerMTok != 0.3 || *flash.OutputPricePerMTok != 2.5 {
+		t.Fatalf("flash prices = %v / %v", *flash.InputPricePerMTok, *flash.OutputPricePerMTok)
+	}
+
+	devstral := listed[2]
+	if devstral.ContextWindow != 262144 { // from top_provider
+		t.Fatalf("devstral context window = %d", devstral.ContextWindow)
+	}
+	if devstral.DeprecatedAt == nil || !devstral.DeprecatedAt.Equal(time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("devstral deprecated_at = %v", devstral.DeprecatedAt)
+	}
+
+	if auto := listed[3]; auto.InputPricePerMTok != nil || auto.Free() {
+		t.Fatalf("variable pricing should be unknown: %+v", auto)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	f, err := os.Open("testdata/openrouter_models.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	listed, err := ParseOpenRouter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept := Filter{FreeOnly: true, Modality: "text->text", Include: regexp.MustCompile(`^openai/`)}.Apply(listed)
+	if len(kept) != 1 || kept[0].ID != "openai/gpt-oss-20b:free" {
+		t.Fatalf("kept = %+v", kept)
+	}
+	if n := len((Filter{}).Apply(listed)); n != 4 {
+		t.Fatalf("zero filter kept %d", n)
+	}
+}
@@ -0,0 +1,135 @@
+// Package modelsync keeps eligible_models in step with a provider's model
+// listing; see cmd/model-sync.
+package modelsync
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrEmptyListing keeps a broken or over-filtered listing from deactivating
+// every model of its source.
+var ErrEmptyListing = errors.New("listing has no models; refusing to deactivate everything")
+
+// Result summarises a sync.
+type Result struct {
+	Upserted    int      `json:"upserted"`
+	Added       []string `json:"added,omitempty"`
+	Deactivated []string `json:"deactivated,omitempty"`
+	Skipped     []string `json:"skipped,omitempty"` // listed, but curated by hand or owned by another source
+}
+
+// Sync upserts models as rows of source and deactivates the source's rows
+// that are not among them, in one transaction. Listed models are active
+// unless their deprecation date has passed, so the sync owns is_active for
+// its source's rows; hand-curated columns (category, generation and
+// concurrency limits) are left alone. Rows without a source, or with
+// another one, are never touched, even when listed. With dryRun
+// the changes are computed and rolled back.
+func Sync(ctx context.Context, db *pgxpool.Pool, source string, models []Listed, dryRun bool) (Result, error) {
+	var res Result
+	if len(models) == 0 {
+		return res, ErrEmptyListing
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback(context.WithoutCancel(ctx))
+
+	now := time.Now()
+	ids := make([]string, len(models))
+	batch := &pgx.Batch{}
+	for i, m := range models {
+		ids[i] = m.ID
+		var ctxWindow *int
+		if m.ContextWindow > 0 {
+			ctxWindow = &m.ContextWindow
+		}
+		var modality *string
+		if m.Modality != "" {
+			modality = &m.Modality
+		}
+		batch.Queue(`
+insert into eligible_models
+  (id, display_name, is_active, context_window, input_price_per_mtok, output_price_per_mtok,
+   modality, deprecated_at, source, synced_at)
+values ($1, $2, $7::timestamptz is null or $7 > $9, $3, $4, $5, $6, $7, $8, $9)
+on conflict (id) do update set
+  display_name = excluded.display_name,
+  is_active = excluded.is_active,
+  context_window = excluded.context_window,
+  input_price_per_mtok = excluded.input_price_per_mtok,
+  output_price_per_mtok = excluded.output_price_per_mtok,
+  modality = excluded.modality,
+  deprecated_at = excluded.deprecated_at,
+  source = excluded.source,
+  synced_at = excluded.synced_at
+where eligible_models.source is not distinct from excluded.source
+returning (xmax = 0)
+`, m.ID, m.Name, ctxWindow, m.InputPricePerMTok, m.OutputPricePerMTok, modality, m.DeprecatedAt, source, now).
+			QueryRow(func(row pgx.Row) error {
+				var inserted bool
+				if err := row.Scan(&inserted); err != nil {
+					if errors.Is(err, pgx.ErrNoRows) { // the where clause kept someone else's row
+						res.Skipped = append(res.Skipped, m.ID)
+						return nil
+					}
+					return err
+				}
+				res.Upserted++
+				if inserted {
+					res.Added = append(res.Added, m.ID)
+				}
+				return nil
+			})
+	}
+	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+		return res, err
+	}
+
+	rows, err := tx.Query(ctx, `
+update eligible_models
+set is_active = false, deprecated_at = coalesce(deprecated_at, $3), synced_at = $3
+where source = $1 and is_active and not (id = any($2))
+returning id
+`, source, ids, now)
+	if err != nil {
+		return res, err
+	}
+	if res.Deactivated, err = pgx.CollectRows(rows, pgx.RowTo[string]); err != nil {
+		return res, err
+	}
+
+	if dryRun {
+		return res, nil
+	}
+	return res, tx.Commit(ctx)
+}
+
+// Options configure Run.
+type Options struct {
+	Listing string // URL or local file; see Load
+	Source  string // eligible_models.source, e.g. "openrouter"
+	APIKey  string // optional bearer token for the listing
+	Filter  Filter
+	DryRun  bool
+}
+
+// Run loads the listing, filters it and syncs it.
+func Run(ctx context.Context, db *pgxpool.Pool, client *http.Client, o Options) (Result, error) {
+	listed, err := Load(ctx, client, o.Listing, o.APIKey)
+	if err != nil {
+		return Result{}, err
+	}
+	kept := o.Filter.Apply(listed)
+	log.Printf("model-sync: %s lists %d models, %d pass the filter", o.Listing, len(listed), len(kept))
+	return Sync(ctx, db, o.Source, kept, o.DryRun)
+}
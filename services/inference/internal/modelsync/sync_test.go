@@ -0,0 +1,65 @@
+package modelsync
+
+import (
+	"context"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// TestSync_LeavesCuratedRowsAlone needs a migrated Postgres in TEST_PG_URL.
+// It syncs into a temporary copy of eligible_models, so the real table is
+// not modified.
+func TestSync_LeavesCuratedRowsAlone(t *testing.T) {
+	url := os.Getenv("TEST_PG_URL")
+	if url == "" {
+		t.Skip("TEST_PG_URL not set")
+	}
+	ctx := context.Background()
+	cfg, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.MaxConns = 1 // the temp table lives on one connection
+	db, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(ctx, `
+create temp table eligible_models (like public.eligible_models including defaults);
+insert into eligible_models (id, display_name, is_active, source) values
+  ('curated/model', 'Curated', false, null),
+  ('other/model', 'Other', true, 'elsewhere'),
+  ('listed/model', 'Listed', true, 'openrouter');
+`); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := Sync(ctx, db, "openrouter", []Listed{
+		{ID: "curated/model", Name: "From the listing"},
+		{ID: "other/model", Name: "From the listing"},
+		{ID: "listed/model", Name: "Listed v2"},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Upserted != 1 || !slices.Equal(res.Skipped, []string{"curated/model", "other/model"}) || len(res.Deactivated) != 0 {
+		t.Fatalf("result = %+v", res)
+	}
+
+	var (
+		name   string
+		active bool
+		source *string
+	)
+	if err := db.QueryRow(ctx, `select display_name, is_active, source from eligible_models where id = 'curated/model'`).Scan(&name, &active, &source); err != nil {
+		t.Fatal(err)
+	}
+	if name != "Curated" || active || source != nil {
+		t.Fatalf("curated row = %q active=%t source=%v, want it untouched", name, active, source)
+	}
+}
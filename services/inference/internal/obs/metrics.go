@@ -37,8 +37,144 @@ var (
 		},
 		[]string{"provider", "model"},
 	)
+
+	StreamTTFT = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "inference_stream_ttft_seconds",
+			Help:    "Time from enqueue to the first streamed token (/infer/stream)",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"provider", "model"},
+	)
+
+	StreamTotalTime = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "inference_stream_total_seconds",
+			Help:    "Total end-to-end time of a streamed generation (queue_wait + exec)",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"provider", "model"},
+	)
+
+	Retries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "inference_retries_total",
+			Help: "Provider calls repeated after a retryable failure (kind=retry) or moved to a fallback model (kind=fallback)",
+		},
+		[]string{"provider", "model", "kind"},
+	)
+
+	CircuitState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "inference_circuit_state",
+			Help: "Circuit breaker state per provider/model (0=closed, 1=half-open, 2=open)",
+		},
+		[]string{"provider", "model"},
+	)
+
+	ModelInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "inference_model_inflight",
+			Help: "Jobs currently executing per requested model",
+		},
+		[]string{"model"},
+	)
+
+	CacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "inference_cache_requests_total",
+			Help: "Response cache lookups by result (hit, miss, bypass)",
+		},
+		[]string{"result"},
+	)
+
+	DedupRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "inference_dedup_requests_total",
+			Help: "Coalescable requests by role: leader (made the provider call) or joined (shared an in-flight call)",
+		},
+		[]string{"role"},
+	)
+
+	BatchItems = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "inference_batch_items_total",
+			Help: "Batch run generations by result (succeeded, failed)",
+		},
+		[]string{"result"},
+	)
+
+	Tokens = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "inference_tokens_total",
+			Help: "Tokens billed by providers, by kind (prompt, completion); cache hits excluded",
+		},
+		[]string{"provider", "model", "kind"},
+	)
+
+	CostUSD = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "inference_cost_usd_total",
+			Help: "Estimated provider spend in USD from the eligible_models price table",
+		},
+		[]string{"provider", "model"},
+	)
+
+	AdmissionRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "inference_admission_rejections_total",
+			Help: "Jobs refused at enqueue because their deadline could not be met",
+		},
+		[]string{"model"},
+	)
+
+	QueueExpired = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "inference_queue_expired_total",
+			Help: "Jobs dropped from the queue because their deadline passed or the caller went away",
+		},
+		[]string{"model"},
+	)
+
+	DispatcherWorkers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "inference_dispatcher_workers",
+			Help: "Dispatcher worker goroutines currently running",
+		},
+	)
+
+	DispatcherWorkerTarget = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "inference_dispatcher_worker_target",
+			Help: "Worker count the autoscaler is converging on",
+		},
+	)
+
+	DispatcherScaleEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "inference_dispatcher_scale_events_total",
+			Help: "Worker pool resizes by direction (up, down) and reason (queue_wait, queue_depth, idle)",
+		},
+		[]string{"direction", "reason"},
+	)
+
+	BudgetRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "inference_budget_rejections_total",
+			Help: "Requests rejected by a daily budget, by scope (user, provider) and unit (tokens, usd)",
+		},
+		[]string{"scope", "unit"},
+	)
+
+	GuardrailDecisions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "inference_guardrail_decisions_total",
+			Help: "Recorded guardrail decisions by guardrail and action (allow, modify, reject)",
+		},
+		[]string{"guardrail", "action"},
+	)
 )
 
 func MustRegister(reg prometheus.Registerer) {
-	reg.MustRegister(InferRequests, QueueWait, ExecTime, TotalTime)
+	reg.MustRegister(InferRequests, QueueWait, ExecTime, TotalTime, StreamTTFT, StreamTotalTime, Retries, CircuitState, ModelInFlight, CacheRequests, DedupRequests, BatchItems, Tokens, CostUSD, BudgetRejections, AdmissionRejections, QueueExpired, DispatcherWorkers, DispatcherWorkerTarget, DispatcherScaleEvents, GuardrailDecisions)
 }
@@ -0,0 +1,153 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+)
+
+const (
+	anthropicVersion          = "2023-06-01"
+	anthropicDefaultMaxTokens = 1024 // max_tokens is mandatory in the Messages API
+	anthropicDefaultModel     = "claude-sonnet-4-5"
+)
+
+type anthropicReq struct {
+	Model     string         `json:"model"`
+	System    string         `json:"system,omitempty"`
+	Messages  []anthropicMsg `json:"messages"`
+	MaxTokens int            `json:"max_tokens"`
+
+	Temperature   *float64 `json:"temperature,omitempty"`
+	TopP          *float64 `json:"top_p,omitempty"`
+	StopSequences []string `json:"stop_sequences,omitempty"`
+}
+
+type anthropicMsg struct {
+	Role    string `json:"role"` // "user" | "assistant"
+	Content string `json:"content"`
+}
+
+type anthropicResp struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	StopReason string `json:"stop_reason"`
+	Usage      struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// AnthropicProvider calls the Anthropic Messages API. baseURL is the API root
+// without the version path (https://api.anthropic.com in production).
+func AnthropicProvider(httpClient *http.Client, baseURL, apiKey string) dispatcher.ProviderFunc {
+	baseURL = strings.TrimRight(baseURL, "/")
+
+	return func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		payload, err := anthropicPayload(req)
+		if err != nil {
+			return "", "anthropic", 0, err
+		}
+
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return "", "anthropic", 0, err
+		}
+
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"/v1/messages", bytes.NewReader(b))
+		if err != nil {
+			return "", "anthropic", 0, err
+		}
+		httpReq.Header.Set("x-api-key", apiKey)
+		httpReq.Header.Set("anthropic-version", anthropicVersion)
+		httpReq.Header.Set("Content-Type", "application/json")
+
+		resp, err := httpClient.Do(httpReq)
+		if err != nil {
+			return "", "anthropic", 0, err
+		}
+		defer resp.Body.Close()
+
+		var out anthropicResp
+		decodeErr := json.NewDecoder(resp.Body).Decode(&out)
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			msg := resp.Status
+			if decodeErr == nil && out.Error != nil && out.Error.Message != "" {
+				msg = out.Error.Type + ": " + out.Error.Message
+			}
+			return "", "anthropic", 0, &dispatcher.ProviderError{
+				Provider:   "anthropic",
+				StatusCode: resp.StatusCode,
+				Message:    msg,
+				RetryAfter: dispatcher.ParseRetryAfter(resp.Header),
+			}
+		}
+		if decodeErr != nil {
+			return "", "anthropic", 0, fmt.Errorf("decode response: %w", decodeErr)
+		}
+
+		var sb strings.Builder
+		for _, block := range out.Content {
+			if block.Type == "text" {
+				sb.WriteString(block.Text)
+			}
+		}
+
+		meta := dispatcher.MetaFromContext(ctx)
+		meta.PromptTokens = out.Usage.InputTokens
+		meta.CompletionTokens = out.Usage.OutputTokens
+		meta.FinishReason = out.StopReason
+
+		return sb.String(), "anthropic", out.Usage.InputTokens + out.Usage.OutputTokens, nil
+	}
+}
+
+// anthropicPayload maps the conversation: leading system turns become the
+// top-level system prompt, the rest map 1:1 onto user/assistant messages.
+func anthropicPayload(req dispatcher.InferenceRequest) (anthropicReq, error) {
+	p := req.Params
+	if p.Seed != nil {
+		return anthropicReq{}, fmt.Errorf("%w: params.seed is not supported by anthropic", dispatcher.ErrInvalidRequest)
+	}
+	if p.Temperature != nil && *p.Temperature > 1 {
+		return anthropicReq{}, fmt.Errorf("%w: anthropic accepts params.temperature up to 1", dispatcher.ErrInvalidRequest)
+	}
+
+	model := req.Model
+	if model == "" {
+		model = anthropicDefaultModel
+	}
+	out := anthropicReq{
+		Model:         model,
+		MaxTokens:     anthropicDefaultMaxTokens,
+		Temperature:   p.Temperature,
+		TopP:          p.TopP,
+		StopSequences: p.Stop,
+	}
+	if p.MaxTokens != nil {
+		out.MaxTokens = *p.MaxTokens
+	}
+
+	var system []string
+	for _, m := range req.Conversation() {
+		if m.Role == dispatcher.RoleSystem {
+			system = append(system, m.Content)
+			continue
+		}
+		out.Messages = append(out.Messages, anthropicMsg{Role: m.Role, Content: m.Content})
+	}
+	out.System = strings.Join(system, "\n\n")
+	return out, nil
+}
@@ -0,0 +1,88 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+)
+
+func TestAnthropicProvider(t *testing.T) {
+	var got anthropicReq
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" {
+			t.Errorf("unexpected path %q", r.URL.Path)
+		}
+		if r.Header.Get("x-api-key") != "test-key" || r.Header.Get("anthropic-version") == "" {
+			t.Errorf("missing auth/version headers: %v", r.Header)
+		}
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{
+			"content":[{"type":"text","text":"Hello"},{"type":"text","text":" there"}],
+			"stop_reason":"max_tokens",
+			"usage":{"input_tokens":12,"output_tokens":5}
+		}`)
+	}))
+	defer srv.Close()
+
+	call := AnthropicProvider(srv.Client(), srv.URL, "test-key")
+	maxTokens := 5
+	ctx, meta := dispatcher.WithResultMeta(context.Background())
+	text, provider, tokens, err := call(ctx, dispatcher.InferenceRequest{
+		Model: "claude-sonnet-4-5",
+		Messages: []dispatcher.Message{
+			{Role: "system", Content: "be terse"},
+			{Role: "user", Content: "hi"},
+			{Role: "assistant", Content: "hey"},
+			{Role: "user", Content: "again"},
+		},
+		Params: dispatcher.GenerationParams{MaxTokens: &maxTokens, Stop: []string{"END"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "Hello there" || provider != "anthropic" || tokens != 17 {
+		t.Fatalf("got text=%q provider=%q tokens=%d", text, provider, tokens)
+	}
+	if meta.PromptTokens != 12 || meta.CompletionTokens != 5 || meta.FinishReason != "max_tokens" {
+		t.Fatalf("unexpected meta %+v", *meta)
+	}
+	if got.System != "be terse" || len(got.Messages) != 3 || got.Messages[1].Role != "assistant" {
+		t.Fatalf("conversation not mapped: %+v", got)
+	}
+	if got.MaxTokens != 5 || len(got.StopSequences) != 1 {
+		t.Fatalf("params not mapped: %+v", got)
+	}
+}
+
+func TestAnthropicProvider_DefaultMaxTokensAndErrors(t *testing.T) {
+	var got anthropicReq
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"type":"error","error":{"type":"rate_limit_error","message":"slow down"}}`)
+	}))
+	defer srv.Close()
+
+	call := AnthropicProvider(srv.Client(), srv.URL, "k")
+	_, _, _, err := call(context.Background(), dispatcher.InferenceRequest{Prompt: "hi"})
+	if err == nil || !strings.Contains(err.Error(), "rate_limit_error") {
+		t.Fatalf("expected upstream error, got %v", err)
+	}
+	if got.MaxTokens != anthropicDefaultMaxTokens {
+		t.Fatalf("expected default max_tokens, got %d", got.MaxTokens)
+	}
+
+	seed := int64(1)
+	_, _, _, err = call(context.Background(), dispatcher.InferenceRequest{Prompt: "hi", Params: dispatcher.GenerationParams{Seed: &seed}})
+	if !errors.Is(err, dispatcher.ErrInvalidRequest) {
+		t.Fatalf("expected ErrInvalidRequest for seed, got %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package providers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -32,19 +33,125 @@ func GeminiProvider(client *genai.Client, defaultModel string) dispatcher.Provid
 			model = defaultModel
 		}
 
+		contents, config := geminiContents(req)
+
 		// Use the request context (ctx) so your timeouts/cancellation apply.
 		result, err := client.Models.GenerateContent(
 			ctx,
 			model,
-			genai.Text(req.Prompt),
-			nil,
+			contents,
+			config,
 		)
 		if err != nil {
-			return "", "gemini", 0, err
+			return "", "gemini", 0, geminiError(err)
 		}
 
-		// Token usage: depends on which fields you have on the response.
-		// Start with 0; later you can extract from usage metadata if available.
-		return result.Text(), "gemini", 0, nil
+		geminiOutcome(ctx, result)
+		return result.Text(), "gemini", geminiUsage(ctx, result.UsageMetadata), nil
+	}
+}
+
+// geminiOutcome records the finish reason and the safety ratings of the
+// prompt and the first candidate. A blocked prompt has no candidates; its
+// block reason is kept instead.
+func geminiOutcome(ctx context.Context, res *genai.GenerateContentResponse) {
+	meta := dispatcher.MetaFromContext(ctx)
+	var safety dispatcher.Safety
+	if fb := res.PromptFeedback; fb != nil {
+		safety.PromptBlockReason = string(fb.BlockReason)
+		safety.PromptRatings = geminiRatings(fb.SafetyRatings)
+	}
+	if len(res.Candidates) > 0 && res.Candidates[0] != nil {
+		c := res.Candidates[0]
+		meta.FinishReason = string(c.FinishReason)
+		safety.ResponseRatings = geminiRatings(c.SafetyRatings)
+	}
+	if safety.PromptBlockReason != "" || len(safety.PromptRatings) > 0 || len(safety.ResponseRatings) > 0 {
+		meta.Safety = &safety
+	}
+}
+
+func geminiRatings(in []*genai.SafetyRating) []dispatcher.SafetyRating {
+	var out []dispatcher.SafetyRating
+	for _, r := range in {
+		if r == nil {
+			continue
+		}
+		out = append(out, dispatcher.SafetyRating{
+			Category:    string(r.Category),
+			Probability: string(r.Probability),
+			Severity:    string(r.Severity),
+			Blocked:     r.Blocked,
+		})
+	}
+	return out
+}
+
+// geminiUsage copies token counts into the result meta and returns the
+// total. Thinking tokens are billed as output, so they count as completion.
+func geminiUsage(ctx context.Context, u *genai.GenerateContentResponseUsageMetadata) int {
+	if u == nil {
+		return 0
+	}
+	meta := dispatcher.MetaFromContext(ctx)
+	meta.PromptTokens = int(u.PromptTokenCount + u.ToolUsePromptTokenCount)
+	meta.CompletionTokens = int(u.CandidatesTokenCount + u.ThoughtsTokenCount)
+	if u.TotalTokenCount > 0 {
+		return int(u.TotalTokenCount)
+	}
+	return meta.PromptTokens + meta.CompletionTokens
+}
+
+// geminiContents maps the conversation onto Gemini's shape: leading system
+// turns become the SystemInstruction and "assistant" turns use the "model" role.
+// Generation params go into the config; a nil config means all defaults.
+func geminiContents(req dispatcher.InferenceRequest) ([]*genai.Content, *genai.GenerateContentConfig) {
+	var (
+		system   []*genai.Part
+		contents []*genai.Content
+	)
+	for _, m := range req.Conversation() {
+		switch m.Role {
+		case dispatcher.RoleSystem:
+			system = append(system, genai.NewPartFromText(m.Content))
+		case dispatcher.RoleAssistant:
+			contents = append(contents, genai.NewContentFromText(m.Content, genai.RoleModel))
+		default:
+			contents = append(contents, genai.NewContentFromText(m.Content, genai.RoleUser))
+		}
+	}
+
+	p := req.Params
+	if len(system) == 0 && p.Temperature == nil && p.MaxTokens == nil &&
+		p.TopP == nil && p.Seed == nil && len(p.Stop) == 0 {
+		return contents, nil
+	}
+
+	config := &genai.GenerateContentConfig{StopSequences: p.Stop}
+	if len(system) > 0 {
+		config.SystemInstruction = &genai.Content{Parts: system}
+	}
+	if p.Temperature != nil {
+		config.Temperature = genai.Ptr(float32(*p.Temperature))
+	}
+	if p.TopP != nil {
+		config.TopP = genai.Ptr(float32(*p.TopP))
+	}
+	if p.MaxTokens != nil {
+		config.MaxOutputTokens = int32(*p.MaxTokens)
+	}
+	if p.Seed != nil {
+		config.Seed = genai.Ptr(int32(*p.Seed)) // range checked in GenerationParams.Validate
+	}
+	return contents, config
+}
+
+// geminiError converts SDK API errors into dispatcher.ProviderError so the
+// dispatcher can classify them for retries.
+func geminiError(err error) error {
+	var apiErr genai.APIError
+	if errors.As(err, &apiErr) {
+		return &dispatcher.ProviderError{Provider: "gemini", StatusCode: apiErr.Code, Message: apiErr.Message}
 	}
+	return err
 }
@@ -0,0 +1,59 @@
+package providers
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/genai"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+)
+
+func TestGeminiUsage(t *testing.T) {
+	ctx, meta := dispatcher.WithResultMeta(context.Background())
+	total := geminiUsage(ctx, &genai.GenerateContentResponseUsageMetadata{
+		PromptTokenCount:     10,
+		CandidatesTokenCount: 5,
+		ThoughtsTokenCount:   7,
+		TotalTokenCount:      22,
+	})
+	if total != 22 || meta.PromptTokens != 10 || meta.CompletionTokens != 12 {
+		t.Fatalf("total=%d meta=%+v", total, *meta)
+	}
+	if geminiUsage(ctx, nil) != 0 {
+		t.Fatal("nil usage metadata should report 0")
+	}
+}
+
+func TestGeminiOutcome(t *testing.T) {
+	ctx, meta := dispatcher.WithResultMeta(context.Background())
+	geminiOutcome(ctx, &genai.GenerateContentResponse{
+		Candidates: []*genai.Candidate{{
+			FinishReason: genai.FinishReasonSafety,
+			SafetyRatings: []*genai.SafetyRating{
+				{Category: genai.HarmCategoryHarassment, Probability: genai.HarmProbabilityNegligible},
+				{Category: genai.HarmCategoryDangerousContent, Probability: genai.HarmProbabilityHigh, Blocked: true},
+			},
+		}},
+	})
+	if meta.FinishReason != "SAFETY" || meta.Safety == nil || len(meta.Safety.ResponseRatings) != 2 {
+		t.Fatalf("meta = %+v", *meta)
+	}
+	if r := meta.Safety.ResponseRatings[1]; r.Category != "HARM_CATEGORY_DANGEROUS_CONTENT" || r.Probability != "HIGH" || !r.Blocked {
+		t.Fatalf("rating = %+v", r)
+	}
+
+	ctx, meta = dispatcher.WithResultMeta(context.Background())
+	geminiOutcome(ctx, &genai.GenerateContentResponse{
+		PromptFeedback: &genai.GenerateContentResponsePromptFeedback{BlockReason: genai.BlockedReasonSafety},
+	})
+	if meta.FinishReason != "" || meta.Safety == nil || meta.Safety.PromptBlockReason != "SAFETY" {
+		t.Fatalf("blocked prompt meta = %+v", *meta)
+	}
+
+	ctx, meta = dispatcher.WithResultMeta(context.Background())
+	geminiOutcome(ctx, &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{FinishReason: genai.FinishReasonStop}}})
+	if meta.FinishReason != "STOP" || meta.Safety != nil {
+		t.Fatalf("plain meta = %+v", *meta)
+	}
+}
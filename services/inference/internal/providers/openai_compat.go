@@ -0,0 +1,281 @@
+package providers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+)
+
+// Wire types for the OpenAI-style /chat/completions API, shared by every
+// compatible backend (OpenRouter, vLLM, llama.cpp server, Ollama, ...).
+
+type chatCompletionReq struct {
+	Model         string             `json:"model"`
+	Messages      []chatMsg          `json:"messages"`
+	Stream        bool               `json:"stream,omitempty"`
+	StreamOptions *chatStreamOptions `json:"stream_options,omitempty"`
+
+	// Sampling params; nil fields fall back to the model defaults.
+	Temperature *float64 `json:"temperature,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	Seed        *int64   `json:"seed,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+type chatStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type chatMsg struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatCompletionResp struct {
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+	} `json:"usage,omitempty"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// chatStreamChunk is one `data:` event of a streamed chat completion.
+type chatStreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+	} `json:"usage,omitempty"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// chatClient talks to one OpenAI-compatible endpoint.
+type chatClient struct {
+	name         string // reported as the result provider
+	baseURL      string // up to and including the version, e.g. http://localhost:8000/v1
+	apiKey       string // optional; local servers often run without auth
+	headers      map[string]string
+	defaultModel string
+	http         *http.Client
+}
+
+// chatMessages maps the conversation 1:1; the API uses the same
+// system/user/assistant role names as dispatcher.Message.
+func chatMessages(req dispatcher.InferenceRequest) []chatMsg {
+	conv := req.Conversation()
+	msgs := make([]chatMsg, 0, len(conv))
+	for _, m := range conv {
+		msgs = append(msgs, chatMsg{Role: m.Role, Content: m.Content})
+	}
+	return msgs
+}
+
+func (c *chatClient) newRequest(ctx context.Context, req dispatcher.InferenceRequest, stream bool) (*http.Request, error) {
+	model := req.Model
+	if model == "" {
+		model = c.defaultModel
+	}
+
+	payload := chatCompletionReq{
+		Model:    model,
+		Messages: chatMessages(req),
+		Stream:   stream,
+
+		Temperature: req.Params.Temperature,
+		MaxTokens:   req.Params.MaxTokens,
+		TopP:        req.Params.TopP,
+		Seed:        req.Params.Seed,
+		Stop:        req.Params.Stop,
+	}
+	if stream {
+		payload.StreamOptions = &chatStreamOptions{IncludeUsage: true}
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(c.baseURL, "/")+"/chat/completions", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if c.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if stream {
+		httpReq.Header.Set("Accept", "text/event-stream")
+	}
+	for k, v := range c.headers {
+		httpReq.Header.Set(k, v)
+	}
+	return httpReq, nil
+}
+
+// statusError builds the error for a non-2xx response, preferring the
+// server's own message when the body is the usual {"error":{...}} JSON.
+func (c *chatClient) statusError(resp *http.Response) error {
+	msg := resp.Status
+	var out chatCompletionResp
+	if err := json.NewDecoder(resp.Body).Decode(&out); err == nil && out.Error != nil && out.Error.Message != "" {
+		msg = out.Error.Message
+	}
+	return &dispatcher.ProviderError{
+		Provider:   c.name,
+		StatusCode: resp.StatusCode,
+		Message:    msg,
+		RetryAfter: dispatcher.ParseRetryAfter(resp.Header),
+	}
+}
+
+func (c *chatClient) call(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+	httpReq, err := c.newRequest(ctx, req, false)
+	if err != nil {
+		return "", c.name, 0, err
+	}
+
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return "", c.name, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", c.name, 0, c.statusError(resp)
+	}
+
+	var out chatCompletionResp
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", c.name, 0, fmt.Errorf("decode response: %w", err)
+	}
+	if out.Error != nil && out.Error.Message != "" {
+		return "", c.name, 0, fmt.Errorf("%s error: %s", c.name, out.Error.Message)
+	}
+
+	if len(out.Choices) == 0 {
+		return "", c.name, 0, fmt.Errorf("%s: empty choices", c.name)
+	}
+
+	meta := dispatcher.MetaFromContext(ctx)
+	meta.FinishReason = out.Choices[0].FinishReason
+
+	tokens := 0
+	if out.Usage != nil {
+		tokens = out.Usage.TotalTokens
+		meta.PromptTokens = out.Usage.PromptTokens
+		meta.CompletionTokens = out.Usage.CompletionTokens
+	}
+
+	return out.Choices[0].Message.Content, c.name, tokens, nil
+}
+
+// stream reads the SSE response and hands each content delta to onDelta.
+func (c *chatClient) stream(ctx context.Context, req dispatcher.InferenceRequest, onDelta func(string) error) (string, int, error) {
+	httpReq, err := c.newRequest(ctx, req, true)
+	if err != nil {
+		return c.name, 0, err
+	}
+
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return c.name, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return c.name, 0, c.statusError(resp)
+	}
+
+	meta := dispatcher.MetaFromContext(ctx)
+	tokens := 0
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		// Blank lines separate events; ":" lines are keep-alive comments.
+		if line == "" || strings.HasPrefix(line, ":") {
+			continue
+		}
+		data, ok := strings.CutPrefix(line, "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk chatStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return c.name, tokens, fmt.Errorf("decode stream chunk: %w", err)
+		}
+		if chunk.Error != nil {
+			return c.name, tokens, fmt.Errorf("%s error: %s", c.name, chunk.Error.Message)
+		}
+		if chunk.Usage != nil {
+			tokens = chunk.Usage.TotalTokens
+			meta.PromptTokens = chunk.Usage.PromptTokens
+			meta.CompletionTokens = chunk.Usage.CompletionTokens
+		}
+		for _, ch := range chunk.Choices {
+			if ch.FinishReason != "" {
+				meta.FinishReason = ch.FinishReason
+			}
+			if err := onDelta(ch.Delta.Content); err != nil {
+				return c.name, tokens, err
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return c.name, tokens, fmt.Errorf("read stream: %w", err)
+	}
+
+	return c.name, tokens, nil
+}
+
+// OpenAICompatProvider calls any server that speaks /v1/chat/completions
+// (vLLM, llama.cpp server, Ollama, ...). baseURL includes the version path,
+// e.g. "http://localhost:11434/v1"; apiKey and headers are optional.
+func OpenAICompatProvider(baseURL, apiKey string, headers map[string]string) dispatcher.ProviderFunc {
+	return newOpenAICompatClient(baseURL, apiKey, headers).call
+}
+
+// OpenAICompatStreamProvider is the `stream: true` counterpart of OpenAICompatProvider.
+func OpenAICompatStreamProvider(baseURL, apiKey string, headers map[string]string) dispatcher.StreamProviderFunc {
+	return newOpenAICompatClient(baseURL, apiKey, headers).stream
+}
+
+func newOpenAICompatClient(baseURL, apiKey string, headers map[string]string) *chatClient {
+	return &chatClient{
+		name:    "openai-compat",
+		baseURL: baseURL,
+		apiKey:  apiKey,
+		headers: headers,
+		http:    DefaultHTTPClient(),
+	}
+}
@@ -0,0 +1,99 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+)
+
+func TestOpenAICompatProvider(t *testing.T) {
+	var got chatCompletionReq
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("unexpected path %q", r.URL.Path)
+		}
+		if h := r.Header.Get("X-Test"); h != "yes" {
+			t.Errorf("custom header not sent, got %q", h)
+		}
+		if a := r.Header.Get("Authorization"); a != "" {
+			t.Errorf("expected no Authorization without api key, got %q", a)
+		}
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[{"message":{"content":"pong"}}],"usage":{"total_tokens":9}}`)
+	}))
+	defer srv.Close()
+
+	call := OpenAICompatProvider(srv.URL+"/v1", "", map[string]string{"X-Test": "yes"})
+	temp := 0.0
+	text, provider, tokens, err := call(context.Background(), dispatcher.InferenceRequest{
+		Model: "llama3",
+		Messages: []dispatcher.Message{
+			{Role: "system", Content: "be terse"},
+			{Role: "user", Content: "ping"},
+		},
+		Params: dispatcher.GenerationParams{Temperature: &temp},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "pong" || provider != "openai-compat" || tokens != 9 {
+		t.Fatalf("got text=%q provider=%q tokens=%d", text, provider, tokens)
+	}
+	if got.Model != "llama3" || len(got.Messages) != 2 || got.Messages[0].Role != "system" {
+		t.Fatalf("unexpected upstream request %+v", got)
+	}
+	if got.Temperature == nil || *got.Temperature != 0 {
+		t.Fatalf("temperature=0 must be sent explicitly, got %v", got.Temperature)
+	}
+}
+
+func TestOpenAICompatProvider_ErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "model is loading")
+	}))
+	defer srv.Close()
+
+	call := OpenAICompatProvider(srv.URL+"/v1", "k", nil)
+	_, _, _, err := call(context.Background(), dispatcher.InferenceRequest{Prompt: "hi", Model: "m"})
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("expected status error, got %v", err)
+	}
+}
+
+func TestOpenAICompatStreamProvider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req chatCompletionReq
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if !req.Stream || req.StreamOptions == nil || !req.StreamOptions.IncludeUsage {
+			t.Errorf("expected stream request with usage, got %+v", req)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": keep-alive\n\n")
+		fmt.Fprint(w, `data: {"choices":[{"delta":{"content":"po"}}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"choices":[{"delta":{"content":"ng"}}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"choices":[],"usage":{"total_tokens":4}}`+"\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer srv.Close()
+
+	stream := OpenAICompatStreamProvider(srv.URL+"/v1", "", nil)
+	var sb strings.Builder
+	provider, tokens, err := stream(context.Background(), dispatcher.InferenceRequest{Prompt: "ping", Model: "m"}, func(d string) error {
+		sb.WriteString(d)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.String() != "pong" || provider != "openai-compat" || tokens != 4 {
+		t.Fatalf("got text=%q provider=%q tokens=%d", sb.String(), provider, tokens)
+	}
+}
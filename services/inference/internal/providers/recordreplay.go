@@ -0,0 +1,152 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+)
+
+// FixtureMode selects what RecordReplay does with its fixture directory.
+type FixtureMode string
+
+const (
+	FixtureRecord FixtureMode = "record" // call through and save every outcome
+	FixtureReplay FixtureMode = "replay" // serve saved outcomes; never call through
+)
+
+// ParseFixtureMode accepts "record" or "replay".
+func ParseFixtureMode(s string) (FixtureMode, error) {
+	switch m := FixtureMode(s); m {
+	case FixtureRecord, FixtureReplay:
+		return m, nil
+	default:
+		return "", fmt.Errorf("bad fixture mode %q (want record or replay)", s)
+	}
+}
+
+// ErrFixtureMissing means replay found no recording for a request.
+var ErrFixtureMissing = errors.New("no recorded fixture")
+
+// Fixture is one recorded provider call, stored as <dir>/<key>.json where
+// key is the request's Fingerprint.
+type Fixture struct {
+	Key        string                      `json:"key"`
+	Request    dispatcher.InferenceRequest `json:"request"` // for readers; replay matches on Key
+	Text       string                      `json:"text"`
+	Provider   string                      `json:"provider"`
+	TokenUsage int                         `json:"token_usage"`
+	Meta       dispatcher.ResultMeta       `json:"meta"`
+	Error      *FixtureError               `json:"error,omitempty"`
+	RecordedAt time.Time                   `json:"recorded_at"`
+}
+
+// FixtureError is a recorded *dispatcher.ProviderError, replayed as one so
+// retries, fallbacks and error mapping behave as they did live.
+type FixtureError struct {
+	StatusCode int    `json:"status_code"`
+	Message    string `json:"message"`
+}
+
+// RecordReplay wraps next so provider calls can be recorded once and replayed
+// offline, e.g. to regression-test the API, duels and batch runs without
+// network or API keys. In record mode every completed call (and every
+// *dispatcher.ProviderError) is written to dir, replacing older recordings;
+// cancellations and transport errors are passed through unrecorded. In
+// replay mode next is never called and may be nil; a request without a
+// recording fails with ErrFixtureMissing.
+func RecordReplay(next dispatcher.ProviderFunc, dir string, mode FixtureMode) dispatcher.ProviderFunc {
+	if mode == FixtureReplay {
+		return func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+			return replayFixture(ctx, dir, req)
+		}
+	}
+	if next == nil {
+		panic("providers: RecordReplay needs a provider to record")
+	}
+	return func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		text, provider, tokens, err := next(ctx, req)
+
+		var pe *dispatcher.ProviderError
+		if err != nil && !errors.As(err, &pe) {
+			return text, provider, tokens, err
+		}
+		f := Fixture{
+			Key:        req.Fingerprint(),
+			Request:    req,
+			Text:       text,
+			Provider:   provider,
+			TokenUsage: tokens,
+			Meta:       *dispatcher.MetaFromContext(ctx),
+			RecordedAt: time.Now().UTC(),
+		}
+		f.Meta.Cached = false
+		if pe != nil {
+			f.Error = &FixtureError{StatusCode: pe.StatusCode, Message: pe.Message}
+		}
+		if werr := writeFixture(dir, f); werr != nil {
+			log.Printf(`msg="fixture not recorded" key=%s model=%q err=%q`, f.Key, req.Model, werr.Error())
+		}
+		return text, provider, tokens, err
+	}
+}
+
+func replayFixture(ctx context.Context, dir string, req dispatcher.InferenceRequest) (string, string, int, error) {
+	key := req.Fingerprint()
+	path := fixturePath(dir, key)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf(`msg="fixture missing" key=%s model=%q path=%q`, key, req.Model, path)
+		return "", "replay", 0, fmt.Errorf("%w for model %q (%s); record it first", ErrFixtureMissing, req.Model, path)
+	}
+	if err != nil {
+		return "", "replay", 0, err
+	}
+	var f Fixture
+	if err := json.Unmarshal(b, &f); err != nil {
+		return "", "replay", 0, fmt.Errorf("fixture %s: %w", path, err)
+	}
+
+	meta := dispatcher.MetaFromContext(ctx)
+	meta.PromptTokens, meta.CompletionTokens = f.Meta.PromptTokens, f.Meta.CompletionTokens
+	meta.FinishReason, meta.Safety = f.Meta.FinishReason, f.Meta.Safety
+	if f.Error != nil {
+		return "", f.Provider, 0, &dispatcher.ProviderError{Provider: f.Provider, StatusCode: f.Error.StatusCode, Message: f.Error.Message}
+	}
+	return f.Text, f.Provider, f.TokenUsage, nil
+}
+
+// writeFixture writes f atomically, so concurrent recordings of the same
+// request never leave a torn file.
+func writeFixture(dir string, f Fixture) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, f.Key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fixturePath(dir, f.Key))
+}
+
+func fixturePath(dir, key string) string {
+	return filepath.Join(dir, key+".json")
+}
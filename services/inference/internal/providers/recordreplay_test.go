@@ -0,0 +1,77 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+)
+
+func TestRecordReplay_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	calls := 0
+	live := func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		calls++
+		if req.Model == "down" {
+			return "", "live", 0, &dispatcher.ProviderError{Provider: "live", StatusCode: http.StatusServiceUnavailable, Message: "overloaded"}
+		}
+		meta := dispatcher.MetaFromContext(ctx)
+		meta.PromptTokens, meta.CompletionTokens, meta.FinishReason = 3, 4, "STOP"
+		meta.Safety = &dispatcher.Safety{PromptBlockReason: "none"}
+		return "answer to " + req.Prompt, "live", 7, nil
+	}
+
+	ok := dispatcher.InferenceRequest{Prompt: "hi", Model: "m"}
+	down := dispatcher.InferenceRequest{Prompt: "hi", Model: "down"}
+
+	rec := RecordReplay(live, dir, FixtureRecord)
+	recCtx, _ := dispatcher.WithResultMeta(context.Background()) // as the worker does
+	if _, _, _, err := rec(recCtx, ok); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := rec(context.Background(), down); err == nil {
+		t.Fatal("expected the live error while recording")
+	}
+
+	play := RecordReplay(nil, dir, FixtureReplay)
+	ctx, meta := dispatcher.WithResultMeta(context.Background())
+	text, provider, tokens, err := play(ctx, ok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "answer to hi" || provider != "live" || tokens != 7 {
+		t.Fatalf("got %q %q %d", text, provider, tokens)
+	}
+	if meta.PromptTokens != 3 || meta.CompletionTokens != 4 || meta.FinishReason != "STOP" || meta.Safety == nil {
+		t.Fatalf("meta not replayed: %+v", meta)
+	}
+
+	var pe *dispatcher.ProviderError
+	if _, _, _, err := play(context.Background(), down); !errors.As(err, &pe) || pe.StatusCode != http.StatusServiceUnavailable || !dispatcher.Retryable(err) {
+		t.Fatalf("expected the recorded 503, got %v", err)
+	}
+
+	ok.Params.Stop = []string{"\n"}
+	if _, _, _, err := play(context.Background(), ok); !errors.Is(err, ErrFixtureMissing) {
+		t.Fatalf("expected ErrFixtureMissing for an unrecorded request, got %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("replay called the live provider: %d calls", calls)
+	}
+}
+
+func TestRecordReplay_SkipsCancellation(t *testing.T) {
+	dir := t.TempDir()
+	live := func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		return "", "live", 0, context.Canceled
+	}
+	req := dispatcher.InferenceRequest{Prompt: "hi", Model: "m"}
+	if _, _, _, err := RecordReplay(live, dir, FixtureRecord)(context.Background(), req); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v", err)
+	}
+	if _, _, _, err := RecordReplay(nil, dir, FixtureReplay)(context.Background(), req); !errors.Is(err, ErrFixtureMissing) {
+		t.Fatalf("a cancelled call was recorded: %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+)
+
+// Backend is one named provider the registry can route to.
+type Backend struct {
+	Call   dispatcher.ProviderFunc
+	Stream dispatcher.StreamProviderFunc // optional; falls back to Call
+}
+
+type route struct {
+	prefix  string
+	backend string
+}
+
+// Registry routes each request to a backend, either by the explicit
+// req.Provider or by the longest matching model ID prefix. The prefix is a
+// routing namespace and is stripped before the backend sees the model, so
+// "gemini/gemini-2.5-flash" reaches Gemini as "gemini-2.5-flash".
+// Registry.Call and Registry.Stream satisfy the dispatcher provider types.
+type Registry struct {
+	backends map[string]Backend
+	routes   []route // longest prefix first
+	fallback string
+}
+
+func NewRegistry(fallback string) *Registry {
+	return &Registry{
+		backends: map[string]Backend{},
+		fallback: fallback,
+	}
+}
+
+func (r *Registry) Register(name string, b Backend) {
+	if b.Call == nil {
+		panic("providers: backend " + name + " has no Call")
+	}
+	r.backends[name] = b
+}
+
+// Route sends models starting with prefix to the named backend.
+func (r *Registry) Route(prefix, backend string) {
+	r.routes = append(r.routes, route{prefix: prefix, backend: backend})
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return len(r.routes[i].prefix) > len(r.routes[j].prefix)
+	})
+}
+
+// resolve picks the backend and rewrites req.Model for it.
+func (r *Registry) resolve(req dispatcher.InferenceRequest) (Backend, dispatcher.InferenceRequest, error) {
+	name := req.Provider
+	if name == "" {
+		name = r.fallback
+		for _, rt := range r.routes {
+			if strings.HasPrefix(req.Model, rt.prefix) {
+				name = rt.backend
+				req.Model = strings.TrimPrefix(req.Model, rt.prefix)
+				break
+			}
+		}
+	}
+	b, ok := r.backends[name]
+	if !ok {
+		return Backend{}, req, fmt.Errorf("%w: unknown provider %q", dispatcher.ErrInvalidRequest, name)
+	}
+	return b, req, nil
+}
+
+// BackendName returns the backend req would be routed to, for per-provider
+// accounting before the call is made.
+func (r *Registry) BackendName(req dispatcher.InferenceRequest) string {
+	if req.Provider != "" {
+		return req.Provider
+	}
+	for _, rt := range r.routes {
+		if strings.HasPrefix(req.Model, rt.prefix) {
+			return rt.backend
+		}
+	}
+	return r.fallback
+}
+
+func (r *Registry) Call(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+	b, req, err := r.resolve(req)
+	if err != nil {
+		return "", req.Provider, 0, err
+	}
+	return b.Call(ctx, req)
+}
+
+func (r *Registry) Stream(ctx context.Context, req dispatcher.InferenceRequest, onDelta func(string) error) (string, int, error) {
+	b, req, err := r.resolve(req)
+	if err != nil {
+		return req.Provider, 0, err
+	}
+	if b.Stream != nil {
+		return b.Stream(ctx, req, onDelta)
+	}
+	text, provider, tokens, err := b.Call(ctx, req)
+	if err != nil {
+		return provider, tokens, err
+	}
+	return provider, tokens, onDelta(text)
+}
+
+// RegistryConfig selects which backends a deployment serves.
+type RegistryConfig struct {
+	Default string            // backend for unrouted models, e.g. "openrouter"
+	Routes  map[string]string // model prefix -> backend name
+
+	GeminiDefaultModel string
+	StubDelay          time.Duration
+
+	// Fixtures, when set, wraps every backend in RecordReplay with
+	// FixtureMode, one subdirectory per backend. Replay builds no real
+	// backends, so it needs no credentials; recording turns streaming into
+	// a single delta so streamed calls are captured too.
+	Fixtures    string
+	FixtureMode FixtureMode
+}
+
+// ParseRoutes parses "gemini/=gemini,stub/=stub" into a prefix -> backend map.
+func ParseRoutes(s string) (map[string]string, error) {
+	routes := map[string]string{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		prefix, backend, ok := strings.Cut(part, "=")
+		prefix, backend = strings.TrimSpace(prefix), strings.TrimSpace(backend)
+		if !ok || prefix == "" || backend == "" {
+			return nil, fmt.Errorf("bad provider route %q (want prefix=backend)", part)
+		}
+		routes[prefix] = backend
+	}
+	return routes, nil
+}
+
+// NewRegistryFromConfig builds only the backends that cfg references, so
+// credentials are required just for the providers actually in use.
+func NewRegistryFromConfig(ctx context.Context, cfg RegistryConfig) (*Registry, error) {
+	if cfg.Default == "" {
+		cfg.Default = "openrouter"
+	}
+	reg := NewRegistry(cfg.Default)
+
+	names := map[string]bool{cfg.Default: true}
+	for prefix, name := range cfg.Routes {
+		names[name] = true
+		reg.Route(prefix, name)
+	}
+
+	httpClient := DefaultHTTPClient()
+	for name := range names {
+		if cfg.Fixtures != "" && cfg.FixtureMode == FixtureReplay {
+			reg.Register(name, Backend{Call: RecordReplay(nil, filepath.Join(cfg.Fixtures, name), FixtureReplay)})
+			continue
+		}
+
+		var b Backend
+		switch name {
+		case "openrouter":
+			b = Backend{
+				Call:   OpenRouterProvider(httpClient),
+				Stream: OpenRouterStreamProvider(httpClient),
+			}
+		case "gemini":
+			client, err := NewGeminiClient(ctx)
+			if err != nil {
+				return nil, err
+			}
+			model := cfg.GeminiDefaultModel
+			if model == "" {
+				model = "gemini-2.5-flash"
+			}
+			b = Backend{Call: GeminiProvider(client, model)}
+		case "anthropic":
+			apiKey := os.Getenv("ANTHROPIC_API_KEY")
+			if apiKey == "" {
+				return nil, fmt.Errorf("ANTHROPIC_API_KEY is required for the anthropic backend")
+			}
+			baseURL := os.Getenv("ANTHROPIC_BASE_URL")
+			if baseURL == "" {
+				baseURL = "https://api.anthropic.com"
+			}
+			b = Backend{Call: AnthropicProvider(httpClient, baseURL, apiKey)}
+		case "openai-compat":
+			baseURL := os.Getenv("OPENAI_COMPAT_BASE_URL")
+			if baseURL == "" {
+				return nil, fmt.Errorf("OPENAI_COMPAT_BASE_URL is required for the openai-compat backend")
+			}
+			apiKey := os.Getenv("OPENAI_COMPAT_API_KEY")
+			b = Backend{
+				Call:   OpenAICompatProvider(baseURL, apiKey, nil),
+				Stream: OpenAICompatStreamProvider(baseURL, apiKey, nil),
+			}
+		case "stub":
+			b = Backend{
+				Call:   StubProvider(cfg.StubDelay),
+				Stream: StubStreamProvider(cfg.StubDelay),
+			}
+		default:
+			return nil, fmt.Errorf("unknown provider backend %q", name)
+		}
+		if cfg.Fixtures != "" {
+			b = Backend{Call: RecordReplay(b.Call, filepath.Join(cfg.Fixtures, name), cfg.FixtureMode)}
+		}
+		reg.Register(name, b)
+	}
+	return reg, nil
+}
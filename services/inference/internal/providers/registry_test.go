@@ -0,0 +1,65 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+)
+
+func echoBackend(name string) Backend {
+	return Backend{Call: func(ctx context.Context, req dispatcher.InferenceRequest) (string, string, int, error) {
+		return req.Model, name, 0, nil
+	}}
+}
+
+func TestRegistry_Routing(t *testing.T) {
+	reg := NewRegistry("openrouter")
+	reg.Register("openrouter", echoBackend("openrouter"))
+	reg.Register("gemini", echoBackend("gemini"))
+	reg.Register("stub", echoBackend("stub"))
+	reg.Register("stub-slow", echoBackend("stub-slow"))
+	reg.Route("gemini/", "gemini")
+	reg.Route("stub/", "stub")
+	reg.Route("stub/slow/", "stub-slow")
+
+	cases := []struct {
+		req          dispatcher.InferenceRequest
+		wantProvider string
+		wantModel    string
+	}{
+		{dispatcher.InferenceRequest{Model: "gemini/gemini-2.5-flash"}, "gemini", "gemini-2.5-flash"},
+		{dispatcher.InferenceRequest{Model: "stub/echo"}, "stub", "echo"},
+		{dispatcher.InferenceRequest{Model: "stub/slow/echo"}, "stub-slow", "echo"},
+		{dispatcher.InferenceRequest{Model: "google/gemma-3-4b-it:free"}, "openrouter", "google/gemma-3-4b-it:free"},
+		{dispatcher.InferenceRequest{Model: "gemini-2.5-flash", Provider: "gemini"}, "gemini", "gemini-2.5-flash"},
+	}
+	for _, c := range cases {
+		model, provider, _, err := reg.Call(context.Background(), c.req)
+		if err != nil {
+			t.Fatalf("%+v: unexpected error %v", c.req, err)
+		}
+		if provider != c.wantProvider || model != c.wantModel {
+			t.Fatalf("%+v: got provider=%q model=%q want %q %q", c.req, provider, model, c.wantProvider, c.wantModel)
+		}
+	}
+
+	_, _, _, err := reg.Call(context.Background(), dispatcher.InferenceRequest{Model: "x", Provider: "nope"})
+	if !errors.Is(err, dispatcher.ErrInvalidRequest) {
+		t.Fatalf("expected ErrInvalidRequest for unknown provider, got %v", err)
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := ParseRoutes(" gemini/=gemini, stub/=stub ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 || routes["gemini/"] != "gemini" || routes["stub/"] != "stub" {
+		t.Fatalf("unexpected routes %#v", routes)
+	}
+	if _, err := ParseRoutes("gemini/"); err == nil {
+		t.Fatal("expected error for route without backend")
+	}
+}
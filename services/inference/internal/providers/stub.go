@@ -2,6 +2,7 @@ package providers
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
@@ -13,9 +14,57 @@ func StubProvider(delay time.Duration) dispatcher.ProviderFunc {
 		// The important part: use ctx in the request and handle errors/timeouts.
 		select {
 		case <-time.After(delay):
-			return "stub response for: " + req.Prompt, "stub", 123, nil
+			words := stubWords(req)
+			return strings.Join(words, ""), "stub", stubUsage(ctx, req, len(words)), nil
 		case <-ctx.Done():
 			return "", "stub", 0, ctx.Err()
 		}
 	}
 }
+
+// StubStreamProvider streams the StubProvider text word by word, spreading
+// delay across the words.
+func StubStreamProvider(delay time.Duration) dispatcher.StreamProviderFunc {
+	return func(ctx context.Context, req dispatcher.InferenceRequest, onDelta func(string) error) (string, int, error) {
+		words := stubWords(req)
+		step := delay / time.Duration(len(words))
+		for _, w := range words {
+			select {
+			case <-time.After(step):
+			case <-ctx.Done():
+				return "stub", 0, ctx.Err()
+			}
+			if err := onDelta(w); err != nil {
+				return "stub", 0, err
+			}
+		}
+		return "stub", stubUsage(ctx, req, len(words)), nil
+	}
+}
+
+// stubUsage reports one token per word of the conversation and completion.
+func stubUsage(ctx context.Context, req dispatcher.InferenceRequest, completion int) int {
+	prompt := 0
+	for _, m := range req.Conversation() {
+		prompt += len(strings.Fields(m.Content))
+	}
+	meta := dispatcher.MetaFromContext(ctx)
+	meta.PromptTokens, meta.CompletionTokens = prompt, completion
+	return prompt + completion
+}
+
+// stubWords builds the stub completion as whitespace-terminated "tokens",
+// honouring params.stop and params.max_tokens (one word = one token).
+func stubWords(req dispatcher.InferenceRequest) []string {
+	text := "stub response for: " + req.LastUserContent()
+	for _, stop := range req.Params.Stop {
+		if i := strings.Index(text, stop); i >= 0 {
+			text = text[:i]
+		}
+	}
+	words := strings.SplitAfter(text, " ")
+	if n := req.Params.MaxTokens; n != nil && *n < len(words) {
+		words = words[:*n]
+	}
+	return words
+}
@@ -0,0 +1,333 @@
+package usage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/obs"
+)
+
+// Entry is one usage_ledger row.
+type Entry struct {
+	CreatedAt        time.Time
+	RequestID        string
+	UserKey          string
+	Priority         string
+	Provider         string
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+	CostUSD          float64
+	Cached           bool
+	Error            string
+}
+
+// PriceLoader returns the current price table, e.g. models.Service.Prices.
+type PriceLoader func(ctx context.Context) (PriceTable, error)
+
+const (
+	bufferSize   = 4096 // entries waiting for the writer; more are dropped
+	flushEvery   = time.Second
+	flushSize    = 500
+	priceRefresh = 5 * time.Minute
+)
+
+// Ledger prices every dispatched request, counts it in Prometheus and
+// writes it to usage_ledger. Writes are batched on a background goroutine
+// so Record never blocks a worker; Close flushes what is buffered.
+type Ledger struct {
+	db         *pgxpool.Pool
+	loadPrices PriceLoader
+
+	mu     sync.RWMutex
+	prices PriceTable
+
+	closeMu sync.RWMutex
+	closed  bool
+	entries chan Entry
+	done    chan struct{}
+}
+
+// NewLedger starts the ledger writer. loadPrices may be nil, in which case
+// every call costs 0.
+func NewLedger(db *pgxpool.Pool, loadPrices PriceLoader) *Ledger {
+	l := &Ledger{
+		db:         db,
+		loadPrices: loadPrices,
+		entries:    make(chan Entry, bufferSize),
+		done:       make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// UserKey is the usage_ledger.user_key stored for a caller's budget key
+// (dispatcher.InferenceJob.BudgetKey): a truncated SHA-256, so the ledger
+// holds no client IPs or token subjects. Operator work has no budget key and
+// stays "".
+func UserKey(budgetKey string) string {
+	if budgetKey == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(budgetKey))
+	return "u:" + hex.EncodeToString(sum[:8])
+}
+
+// Record is a dispatcher result hook (see dispatcher.WithResultHook).
+func (l *Ledger) Record(job dispatcher.InferenceJob, res dispatcher.InferenceResult) {
+	e := Entry{
+		CreatedAt:        res.FinishedAt,
+		RequestID:        job.RequestID,
+		UserKey:          UserKey(job.BudgetKey),
+		Priority:         job.Priority.String(),
+		Provider:         res.Provider,
+		Model:            res.Model,
+		PromptTokens:     res.Meta.PromptTokens,
+		CompletionTokens: res.Meta.CompletionTokens,
+		TotalTokens:      res.TokenUsage,
+		Cached:           res.Meta.Cached,
+	}
+	if e.Model == "" {
+		e.Model = job.Req.Model
+	}
+	if e.TotalTokens == 0 {
+		e.TotalTokens = e.PromptTokens + e.CompletionTokens
+	}
+	if res.Err != nil {
+		e.Error = res.Err.Error()
+	}
+
+	// A cache hit replays the original token counts but costs nothing.
+	if !e.Cached {
+		l.mu.RLock()
+		e.CostUSD, _ = l.prices.Cost(e.Model, e.PromptTokens, e.CompletionTokens, e.TotalTokens)
+		l.mu.RUnlock()
+		countTokens(e)
+	}
+
+	l.closeMu.RLock()
+	defer l.closeMu.RUnlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.entries <- e:
+	default:
+		log.Printf(`msg="usage ledger full; entry dropped" req_id=%s model=%q`, e.RequestID, e.Model)
+	}
+}
+
+// Prices returns the current price table. Do not modify it.
+func (l *Ledger) Prices() PriceTable {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.prices
+}
+
+func countTokens(e Entry) {
+	provider := e.Provider
+	if provider == "" {
+		provider = "unknown"
+	}
+	prompt, completion := e.PromptTokens, e.CompletionTokens
+	if prompt == 0 && completion == 0 {
+		completion = e.TotalTokens // priced as output; see PriceTable.Cost
+	}
+	obs.Tokens.WithLabelValues(provider, e.Model, "prompt").Add(float64(prompt))
+	obs.Tokens.WithLabelValues(provider, e.Model, "completion").Add(float64(completion))
+	obs.CostUSD.WithLabelValues(provider, e.Model).Add(e.CostUSD)
+}
+
+// Close stops accepting entries and waits until the buffered ones are written.
+func (l *Ledger) Close() {
+	l.closeMu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.entries)
+	}
+	l.closeMu.Unlock()
+	<-l.done
+}
+
+func (l *Ledger) run() {
+	defer close(l.done)
+	l.refreshPrices()
+
+	flush := time.NewTicker(flushEvery)
+	defer flush.Stop()
+	prices := time.NewTicker(priceRefresh)
+	defer prices.Stop()
+
+	var batch []Entry
+	for {
+		select {
+		case e, ok := <-l.entries:
+			if !ok {
+				l.write(batch)
+				return
+			}
+			if batch = append(batch, e); len(batch) >= flushSize {
+				l.write(batch)
+				batch = batch[:0]
+			}
+		case <-flush.C:
+			if len(batch) > 0 {
+				l.write(batch)
+				batch = batch[:0]
+			}
+		case <-prices.C:
+			l.refreshPrices()
+		}
+	}
+}
+
+func (l *Ledger) refreshPrices() {
+	if l.loadPrices == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	t, err := l.loadPrices(ctx)
+	if err != nil {
+		log.Printf("usage prices refresh error: %v", err)
+		return
+	}
+	l.mu.Lock()
+	l.prices = t
+	l.mu.Unlock()
+}
+
+var ledgerColumns = []string{
+	"created_at", "request_id", "user_key", "priority", "provider", "model",
+	"prompt_tokens", "completion_tokens", "total_tokens", "cost_usd", "cached", "error",
+}
+
+func (l *Ledger) write(batch []Entry) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := l.db.CopyFrom(ctx, pgx.Identifier{"usage_ledger"}, ledgerColumns,
+		pgx.CopyFromSlice(len(batch), func(i int) ([]any, error) {
+			e := batch[i]
+			var errMsg *string
+			if e.Error != "" {
+				errMsg = &e.Error
+			}
+			return []any{
+				e.CreatedAt, e.RequestID, e.UserKey, e.Priority, e.Provider, e.Model,
+				e.PromptTokens, e.CompletionTokens, e.TotalTokens, e.CostUSD, e.Cached, errMsg,
+			}, nil
+		}))
+	if err != nil {
+		log.Printf("usage ledger write error: %v (dropped %d entries)", err, len(batch))
+	}
+}
+
+// ErrBadQuery is returned by Summary for unknown group_by dimensions.
+var ErrBadQuery = errors.New("bad usage query")
+
+// Query selects usage_ledger rows in [From, To) and the dimensions to
+// aggregate them by: any of "day" (UTC), "model" and "user".
+type Query struct {
+	GroupBy []string
+	From    time.Time
+	To      time.Time
+	UserKey string // optional filter
+	Model   string // optional filter
+}
+
+// Row is one aggregate; only the grouped dimensions are set.
+type Row struct {
+	Day              string  `json:"day,omitempty"`
+	Model            string  `json:"model,omitempty"`
+	User             string  `json:"user,omitempty"`
+	Requests         int64   `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+const maxSummaryRows = 10000
+
+var groupExprs = map[string]string{
+	"day":   `to_char(created_at at time zone 'UTC', 'YYYY-MM-DD')`,
+	"model": `model`,
+	"user":  `user_key`,
+}
+
+// Summary aggregates the ledger per q.
+func (l *Ledger) Summary(ctx context.Context, q Query) ([]Row, error) {
+	var (
+		cols  []string
+		order []string
+	)
+	for i, g := range q.GroupBy {
+		expr, ok := groupExprs[g]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown group_by %q", ErrBadQuery, g)
+		}
+		cols = append(cols, expr)
+		order = append(order, fmt.Sprint(i+1))
+	}
+
+	where := []string{"created_at >= $1", "created_at < $2"}
+	args := []any{q.From, q.To}
+	if q.UserKey != "" {
+		args = append(args, q.UserKey)
+		where = append(where, fmt.Sprintf("user_key = $%d", len(args)))
+	}
+	if q.Model != "" {
+		args = append(args, q.Model)
+		where = append(where, fmt.Sprintf("model = $%d", len(args)))
+	}
+
+	sql := "select " + strings.Join(append(cols,
+		"count(*)",
+		"coalesce(sum(prompt_tokens), 0)::bigint",
+		"coalesce(sum(completion_tokens), 0)::bigint",
+		"coalesce(sum(total_tokens), 0)::bigint",
+		"coalesce(sum(cost_usd), 0)::float8",
+	), ", ") + "\nfrom usage_ledger\nwhere " + strings.Join(where, " and ")
+	if len(cols) > 0 {
+		sql += "\ngroup by " + strings.Join(order, ", ") + "\norder by " + strings.Join(order, ", ")
+	}
+	sql += fmt.Sprintf("\nlimit %d", maxSummaryRows)
+
+	rows, err := l.db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Row, error) {
+		var r Row
+		dest := make([]any, 0, len(q.GroupBy)+5)
+		for _, g := range q.GroupBy {
+			switch g {
+			case "day":
+				dest = append(dest, &r.Day)
+			case "model":
+				dest = append(dest, &r.Model)
+			case "user":
+				dest = append(dest, &r.User)
+			}
+		}
+		dest = append(dest, &r.Requests, &r.PromptTokens, &r.CompletionTokens, &r.TotalTokens, &r.CostUSD)
+		err := row.Scan(dest...)
+		return r, err
+	})
+}
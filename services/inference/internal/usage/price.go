@@ -0,0 +1,24 @@
+package usage
+
+// Price is a model's list price in USD per million tokens.
+type Price struct {
+	InputPerMTok  float64 `json:"input_per_mtok"`
+	OutputPerMTok float64 `json:"output_per_mtok"`
+}
+
+// PriceTable maps model IDs (as clients send them) to prices.
+type PriceTable map[string]Price
+
+// Cost prices one call. A call whose provider reported only a total is
+// charged entirely at the output price, which overestimates rather than
+// under-reports spend. ok is false for models without a price.
+func (t PriceTable) Cost(model string, promptTokens, completionTokens, totalTokens int) (usd float64, ok bool) {
+	p, ok := t[model]
+	if !ok {
+		return 0, false
+	}
+	if promptTokens == 0 && completionTokens == 0 {
+		completionTokens = totalTokens
+	}
+	return (float64(promptTokens)*p.InputPerMTok + float64(completionTokens)*p.OutputPerMTok) / 1e6, true
+}
@@ -0,0 +1,83 @@
+package usage
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+)
+
+func TestPriceTableCost(t *testing.T) {
+	prices := PriceTable{"m": {InputPerMTok: 3, OutputPerMTok: 15}}
+
+	cases := []struct {
+		name                      string
+		model                     string
+		prompt, completion, total int
+		want                      float64
+		ok                        bool
+	}{
+		{"split", "m", 1000, 500, 1500, 0.003 + 0.0075, true},
+		{"total only priced as output", "m", 0, 0, 1000, 0.015, true},
+		{"unknown model", "other", 1000, 500, 1500, 0, false},
+	}
+	for _, c := range cases {
+		got, ok := prices.Cost(c.model, c.prompt, c.completion, c.total)
+		if ok != c.ok || math.Abs(got-c.want) > 1e-12 {
+			t.Errorf("%s: Cost = %v, %t; want %v, %t", c.name, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestUserKey(t *testing.T) {
+	k := UserKey("ip:203.0.113.7")
+	if !strings.HasPrefix(k, "u:") || strings.Contains(k, "203.0.113.7") || k != UserKey("ip:203.0.113.7") {
+		t.Fatalf("UserKey = %q, want a stable opaque key", k)
+	}
+	if k == UserKey("ip:203.0.113.8") || UserKey("") != "" {
+		t.Fatal("UserKey must tell callers apart and keep operator work empty")
+	}
+}
+
+func TestLedgerRecord(t *testing.T) {
+	l := &Ledger{
+		prices:  PriceTable{"fallback": {InputPerMTok: 1, OutputPerMTok: 2}},
+		entries: make(chan Entry, 2),
+	}
+	job := dispatcher.InferenceJob{
+		Req:       dispatcher.InferenceRequest{Model: "requested"},
+		Key:       "voter:v1",
+		BudgetKey: "ip:203.0.113.7",
+		Priority:  dispatcher.PriorityBatch,
+		RequestID: "r1",
+	}
+	now := time.Now()
+
+	l.Record(job, dispatcher.InferenceResult{
+		Provider:   "p",
+		Model:      "fallback",
+		FinishedAt: now,
+		Meta:       dispatcher.ResultMeta{PromptTokens: 1_000_000, CompletionTokens: 500_000},
+	})
+	e := <-l.entries
+	if e.RequestID != "r1" || e.UserKey != UserKey("ip:203.0.113.7") || e.Priority != "batch" || e.Model != "fallback" {
+		t.Fatalf("entry = %+v", e)
+	}
+	if e.TotalTokens != 1_500_000 || e.CostUSD != 2 {
+		t.Fatalf("total=%d cost=%v, want 1500000 and 2", e.TotalTokens, e.CostUSD)
+	}
+
+	// Cache hits and failures are recorded, but cost nothing.
+	l.Record(job, dispatcher.InferenceResult{
+		Model: "fallback",
+		Err:   errors.New("boom"),
+		Meta:  dispatcher.ResultMeta{PromptTokens: 10, CompletionTokens: 10, Cached: true},
+	})
+	e = <-l.entries
+	if e.CostUSD != 0 || !e.Cached || e.Error != "boom" {
+		t.Fatalf("cached entry = %+v", e)
+	}
+}
@@ -8,6 +8,9 @@ import (
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/dispatcher"
+	"github.com/Tiger-Du/CrowdAudit/services/inference/internal/outbox"
 )
 
 var ErrNotFound = errors.New("not found")
@@ -133,3 +136,71 @@ values ($1, $2, $3, $4::jsonb)
 	}
 	return "recorded", nil
 }
+
+// NewResponse is a generated response to persist alongside its prompt.
+type NewResponse struct {
+	Provider     string
+	Model        string
+	Content      string
+	FinishReason string
+	Safety       *dispatcher.Safety // optional
+}
+
+// CreatePair stores a prompt, its two responses and their pairing in one
+// transaction, and emits pair.upsert so the indexer picks the pair up.
+func (s *Service) CreatePair(ctx context.Context, title, body string, a, b NewResponse) (*PairDTO, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	dto := PairDTO{Title: title, Prompt: body}
+	if err := tx.QueryRow(ctx, `
+insert into prompts (title, body)
+values ($1, $2)
+returning id
+`, title, body).Scan(&dto.PromptID); err != nil {
+		return nil, err
+	}
+
+	for _, r := range []struct {
+		in  NewResponse
+		out *ResponseDTO
+	}{{a, &dto.A}, {b, &dto.B}} {
+		if err := tx.QueryRow(ctx, `
+insert into responses (prompt_id, provider, model, content, finish_reason, safety)
+values ($1, $2, $3, $4, nullif($5, ''), $6)
+returning id
+`, dto.PromptID, r.in.Provider, r.in.Model, r.in.Content, r.in.FinishReason, r.in.Safety).Scan(&r.out.ResponseID); err != nil {
+			return nil, err
+		}
+		r.out.Provider, r.out.Model, r.out.Content = r.in.Provider, r.in.Model, r.in.Content
+	}
+
+	if err := tx.QueryRow(ctx, `
+insert into response_pairs (prompt_id, response_a_id, response_b_id)
+values ($1, $2, $3)
+returning id
+`, dto.PromptID, dto.A.ResponseID, dto.B.ResponseID).Scan(&dto.PairID); err != nil {
+		return nil, err
+	}
+
+	err = outbox.InsertEvent(ctx, tx, outbox.Event{
+		Topic:     "search-index",
+		Key:       "pair:" + strconv.FormatInt(dto.PairID, 10),
+		EventType: "pair.upsert",
+		Payload: map[string]any{
+			"pair_id":    dto.PairID,
+			"updated_at": time.Now().UTC().Format(time.RFC3339Nano),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return &dto, nil
+}
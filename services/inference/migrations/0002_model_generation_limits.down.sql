@@ -0,0 +1,3 @@
+alter table eligible_models
+  drop column max_output_tokens,
+  drop column max_temperature;
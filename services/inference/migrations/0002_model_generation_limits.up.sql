@@ -0,0 +1,4 @@
+-- per-model bounds for request `params`; null = no limit beyond the API defaults
+alter table eligible_models
+  add column max_output_tokens integer,
+  add column max_temperature double precision;
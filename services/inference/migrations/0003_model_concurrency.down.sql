@@ -0,0 +1,2 @@
+alter table eligible_models
+  drop column max_concurrency;
@@ -0,0 +1,3 @@
+-- max in-flight provider calls per model; null = bounded only by the worker pool
+alter table eligible_models
+  add column max_concurrency integer check (max_concurrency > 0);
@@ -0,0 +1 @@
+drop table if exists inference_jobs;
@@ -0,0 +1,27 @@
+-- inference_jobs: asynchronous /api/jobs requests and their outcome
+create table inference_jobs (
+  id uuid primary key default gen_random_uuid(),
+  status text not null default 'queued'
+    check (status in ('queued', 'running', 'succeeded', 'failed', 'cancelled')),
+  request jsonb not null,          -- dispatcher.InferenceRequest as submitted
+  model text not null,
+  owner_key text not null default '',
+
+  provider text,
+  answered_model text,             -- differs from model when a fallback answered
+  result_text text,
+  error text,
+  token_usage int,
+  prompt_tokens int,
+  completion_tokens int,
+  finish_reason text,
+
+  created_at timestamptz not null default now(),
+  started_at timestamptz,
+  finished_at timestamptz
+);
+
+create index idx_inference_jobs_created_at on inference_jobs (created_at);
+create index idx_inference_jobs_unfinished
+  on inference_jobs (created_at)
+  where status in ('queued', 'running');
@@ -0,0 +1,2 @@
+drop table if exists batch_items;
+drop table if exists batch_runs;
@@ -0,0 +1,36 @@
+-- batch_runs: one audit suite of prompts run across several models
+create table batch_runs (
+  id bigserial primary key,
+  name text not null default '',
+  status text not null default 'pending'
+    check (status in ('pending', 'running', 'completed', 'cancelled')),
+  models text[] not null,
+  params jsonb not null default '{}', -- dispatcher.GenerationParams for every item
+  concurrency int not null check (concurrency > 0),
+  created_at timestamptz not null default now(),
+  started_at timestamptz,
+  finished_at timestamptz,
+  heartbeat_at timestamptz          -- refreshed by the executing process; stale = crashed
+);
+
+-- batch_items: one prompt x model generation of a run
+create table batch_items (
+  id bigserial primary key,
+  run_id bigint not null references batch_runs(id) on delete cascade,
+  prompt_id bigint not null references prompts(id) on delete cascade,
+  model text not null,
+  status text not null default 'pending'
+    check (status in ('pending', 'succeeded', 'failed')),
+  response_id bigint references responses(id) on delete set null,
+  provider text,
+  error text,
+  finished_at timestamptz,
+  constraint batch_items_unique unique (run_id, prompt_id, model)
+);
+
+create index idx_batch_items_pending
+  on batch_items (run_id, id)
+  where status = 'pending';
+create index idx_batch_runs_running
+  on batch_runs (heartbeat_at)
+  where status = 'running';
@@ -0,0 +1,5 @@
+drop table if exists usage_ledger;
+
+alter table eligible_models
+  drop column output_price_per_mtok,
+  drop column input_price_per_mtok;
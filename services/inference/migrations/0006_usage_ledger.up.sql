@@ -0,0 +1,25 @@
+-- list prices in USD per million tokens; null = unknown (cost recorded as 0)
+alter table eligible_models
+  add column input_price_per_mtok numeric(12, 6) check (input_price_per_mtok >= 0),
+  add column output_price_per_mtok numeric(12, 6) check (output_price_per_mtok >= 0);
+
+-- usage_ledger: one row per dispatched request (after retries/fallbacks)
+create table usage_ledger (
+  id bigserial primary key,
+  created_at timestamptz not null default now(),
+  request_id text not null default '',
+  user_key text not null default '',  -- usage.UserKey of the caller's budget key (see 0012)
+  priority text not null default 'interactive',
+  provider text not null default '',
+  model text not null,                -- the model that answered
+  prompt_tokens int not null default 0,
+  completion_tokens int not null default 0,
+  total_tokens int not null default 0,
+  cost_usd numeric(14, 8) not null default 0,
+  cached boolean not null default false,
+  error text
+);
+
+create index idx_usage_ledger_created_at on usage_ledger (created_at);
+create index idx_usage_ledger_user on usage_ledger (user_key, created_at);
+create index idx_usage_ledger_model on usage_ledger (model, created_at);
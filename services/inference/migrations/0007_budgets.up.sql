@@ -0,0 +1,15 @@
+-- budgets: daily token/spend caps, re-read by running instances every 30s.
+--   scope 'user':     per caller (api.budgetKey: 'sub:<issuer>|<subject>' when authenticated, else 'ip:<client IP>')
+--   scope 'provider': global per backend (openrouter, gemini, ...)
+-- subject '*' is the default for every user/provider without its own row.
+-- A null cap means unlimited. Example:
+--   insert into budgets (scope, subject, daily_tokens) values ('user', '*', 200000);
+--   insert into budgets (scope, subject, daily_usd) values ('provider', 'openrouter', 50);
+create table budgets (
+  scope text not null check (scope in ('user', 'provider')),
+  subject text not null default '*',
+  daily_tokens bigint check (daily_tokens > 0),
+  daily_usd numeric(12, 4) check (daily_usd > 0),
+  updated_at timestamptz not null default now(),
+  primary key (scope, subject)
+);
@@ -0,0 +1,8 @@
+drop index if exists idx_eligible_models_source;
+
+alter table eligible_models
+  drop column synced_at,
+  drop column source,
+  drop column deprecated_at,
+  drop column modality,
+  drop column context_window;
@@ -0,0 +1,13 @@
+-- provider metadata maintained by cmd/model-sync
+--   source:        listing the row is synced from (e.g. 'openrouter'); null = curated by hand.
+--                  The sync deactivates rows of its source that leave the listing
+--                  and never touches rows without one.
+--   deprecated_at: when the provider retires the model, or when it left the listing
+alter table eligible_models
+  add column context_window integer check (context_window > 0),
+  add column modality text,              -- e.g. 'text->text', 'text+image->text'
+  add column deprecated_at timestamptz,
+  add column source text,
+  add column synced_at timestamptz;
+
+create index idx_eligible_models_source on eligible_models (source) where source is not null;
@@ -0,0 +1,8 @@
+drop index if exists idx_responses_finish_reason;
+
+alter table inference_jobs
+  drop column safety;
+
+alter table responses
+  drop column safety,
+  drop column finish_reason;
@@ -0,0 +1,12 @@
+-- provider outcome kept for refusal/safety audits:
+--   finish_reason: provider's own vocabulary, e.g. 'STOP', 'SAFETY', 'end_turn'
+--   safety:        dispatcher.Safety as JSON (prompt block reason, prompt and
+--                  response ratings); null when the provider reports none
+alter table responses
+  add column finish_reason text,
+  add column safety jsonb;
+
+alter table inference_jobs
+  add column safety jsonb;
+
+create index idx_responses_finish_reason on responses (finish_reason) where finish_reason is not null;
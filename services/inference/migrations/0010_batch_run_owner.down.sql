@@ -0,0 +1,3 @@
+alter table batch_runs
+  drop column budget_key,
+  drop column owner_key;
@@ -0,0 +1,7 @@
+-- who submitted a batch run, so its items are queued and budgeted as that caller:
+--   owner_key:  fair-queueing key (dispatcher.InferenceJob.Key)
+--   budget_key: per-user budget key (dispatcher.InferenceJob.BudgetKey)
+-- Both are null for runs started from cmd/batch-runner.
+alter table batch_runs
+  add column owner_key text,
+  add column budget_key text;
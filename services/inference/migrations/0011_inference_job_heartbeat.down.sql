@@ -0,0 +1 @@
+alter table inference_jobs drop column heartbeat_at;
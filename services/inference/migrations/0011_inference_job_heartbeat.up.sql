@@ -0,0 +1,6 @@
+-- heartbeat_at: refreshed while a job runs in some process; an unfinished job
+-- whose heartbeat (or, before its first beat, created_at) goes stale is
+-- failed by the jobs sweeper.
+-- owner_key now holds the submitter's budget key (authenticated subject, else
+-- client IP) and scopes GET/DELETE /api/jobs/{id}.
+alter table inference_jobs add column heartbeat_at timestamptz;
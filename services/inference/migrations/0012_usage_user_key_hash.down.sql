@@ -0,0 +1,2 @@
+-- The raw keys cannot be recovered.
+select 1;
@@ -0,0 +1,7 @@
+-- usage_ledger.user_key is now usage.UserKey(budget key): "u:" and the first
+-- 8 bytes of its SHA-256, hex. Rows written before held raw queue keys
+-- (client IPs, voter IDs, tenants); hash them so no raw identifier remains.
+-- They no longer match any caller's key.
+update usage_ledger
+set user_key = 'u:' || left(encode(sha256(convert_to(user_key, 'UTF8')), 'hex'), 16)
+where user_key <> '' and user_key not like 'u:%';